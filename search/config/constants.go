@@ -2,59 +2,439 @@ package config
 
 import "math"
 
+// Supported on-disk corpus formats
+const (
+	CORPUS_FORMAT_AUTO = ""
+	CORPUS_FORMAT_TXT  = "txt"
+	CORPUS_FORMAT_NPY  = "npy"
+	CORPUS_FORMAT_CSV  = "csv"
+)
+
+// Supported codecs for compressing URL subclusters
+const (
+	URL_CODEC_NONE      = "none"
+	URL_CODEC_ZLIB      = "zlib"
+	URL_CODEC_ZSTD      = "zstd"
+	URL_CODEC_ZSTD_DICT = "zstd-dict"
+)
+
+// Supported strategies for packing clusters into database columns
+const (
+	PACKING_FIRST_FIT = "ffd"
+	PACKING_BEST_FIT  = "bfd"
+	PACKING_MIN_COST  = "min-cost"
+)
+
+// Ways of spotting duplicate docs while loading the corpus
+const (
+	DEDUP_URL            = "url"            // same url
+	DEDUP_NORMALIZED_URL = "normalized-url" // same url up to scheme, "www.", trailing slash, fragment and tracking params
+	DEDUP_EMBEDDING      = "embedding"      // same quantized embedding
+)
+
+// Where duplicates are looked for: within each cluster (which keeps docs
+// assigned to several clusters on purpose) or across the whole corpus
+const (
+	DEDUP_SCOPE_CLUSTER = "cluster"
+	DEDUP_SCOPE_CORPUS  = "corpus"
+)
+
+// Limits on the shape of a SimplePIR database. Zero means no limit.
+type PlanTargets struct {
+	MaxHintMB   float64 // hint downloaded by the client ahead of time
+	MaxQueryKB  float64 // upload per query
+	MaxAnswerKB float64 // download per query
+	MaxServerMB float64 // database and hint held in server memory
+}
+
+// Shape of the requests that a client sends per search. Every search sends
+// exactly this many queries, padded with dummy ones, so that their number
+// does not depend on the query.
+type RequestPolicy struct {
+	EmbQueries int // embeddings queries, one per probed cluster
+	UrlQueries int // URL queries, one per fetched chunk
+}
+
+// The shape of a search in the original protocol
+func DefaultRequestPolicy() RequestPolicy {
+	return RequestPolicy{EmbQueries: 1, UrlQueries: 1}
+}
+
+// Dummy searches that an idle client sends, so that servers cannot tell
+// when it searches
+type CoverTraffic struct {
+	PerHour      float64 // mean dummy searches per hour, at exponential intervals; 0 disables them
+	MaxMBPerHour float64 // cap on the traffic of dummy searches; 0 means no cap
+}
+
+// Limits on the calls that a server answers. Zero means no limit.
+type ServerLimits struct {
+	PerSec        float64 // calls per second, across connections
+	ConnPerSec    float64 // calls per second on one connection
+	Burst         int     // calls let through at once above the rates (at least 1)
+	MaxConcurrent int     // answers and hint applications computed at once
+	MaxWaitSec    float64 // longest a call waits for its turn before it is refused
+}
+
+// Deadlines of the calls of a client. Zero means none.
+type Timeouts struct {
+	DialSec   float64 // to connect to a server
+	ReadSec   float64 // longest a call waits for data from the server
+	SearchSec float64 // for a whole search, hint applications included
+}
+
+// Connections that a client keeps open to each server between calls
+type ConnPool struct {
+	MaxIdle      int     // idle connections kept per server; 0 closes each after its call
+	IdleSec      float64 // longest a connection is kept idle; 0 means no limit
+	KeepAliveSec float64 // period of TCP keep-alive probes; 0 means the OS default
+	DownSec      float64 // how long a replica that failed is passed over
+}
+
 type Config struct {
-	preamble string
+	preamble     string
+	corpusFormat string
+	urlCodec     string
+	packing      string
+	embTargets   PlanTargets
+	urlTargets   PlanTargets
+	splitRows    uint64
+	embDim       uint64 // 0 means the dimension of the released corpus
+	clusterIds   []uint // nil means clusters 0, ..., TOTAL_NUM_CLUSTERS()-1
+	dedup        []string
+	dedupScope   string
+	integrity    bool
+	policy       RequestPolicy
+	cover        CoverTraffic
+	limits       ServerLimits
+	tokens       bool
+	tokenIssuer  string
+	timeouts     Timeouts
+	connPool     ConnPool
 }
 
 func MakeConfig(preambleStr string) *Config {
 	c := Config{
 		preamble: preambleStr,
+		urlCodec: URL_CODEC_ZLIB,
+		packing:  PACKING_FIRST_FIT,
+
+		dedupScope: DEDUP_SCOPE_CLUSTER,
+		policy:     DefaultRequestPolicy(),
+		limits:     ServerLimits{Burst: 1, MaxWaitSec: 10},
+		timeouts:   DefaultTimeouts(),
+		connPool:   DefaultConnPool(),
+
+		// Roughly the hints of the previous fixed DB shapes
+		embTargets: PlanTargets{MaxHintMB: 1024},
+		urlTargets: PlanTargets{MaxHintMB: 140},
 	}
 	return &c
 }
 
+// Copy of the config, for a corpus under another preamble
+func (c *Config) WithPreamble(preambleStr string) *Config {
+	out := *c
+	out.preamble = preambleStr
+	return &out
+}
+
 func (c *Config) PREAMBLE() string {
 	return c.preamble
 }
 
-func (c *Config) DEFAULT_EMBEDDINGS_HINT_SZ() uint64 {
-	return 500
+func (c *Config) CORPUS_FORMAT() string {
+	return c.corpusFormat
+}
+
+func (c *Config) SetCorpusFormat(format string) {
+	switch format {
+	case CORPUS_FORMAT_AUTO, CORPUS_FORMAT_TXT, CORPUS_FORMAT_NPY, CORPUS_FORMAT_CSV:
+		c.corpusFormat = format
+	default:
+		panic("Unknown corpus format: " + format)
+	}
+}
+
+func (c *Config) URL_CODEC() string {
+	return c.urlCodec
+}
+
+func (c *Config) SetUrlCodec(codec string) {
+	switch codec {
+	case URL_CODEC_NONE, URL_CODEC_ZLIB, URL_CODEC_ZSTD, URL_CODEC_ZSTD_DICT:
+		c.urlCodec = codec
+	default:
+		panic("Unknown URL codec: " + codec)
+	}
+}
+
+func (c *Config) PACKING_STRATEGY() string {
+	return c.packing
+}
+
+func (c *Config) SetPackingStrategy(strategy string) {
+	switch strategy {
+	case PACKING_FIRST_FIT, PACKING_BEST_FIT, PACKING_MIN_COST:
+		c.packing = strategy
+	default:
+		panic("Unknown packing strategy: " + strategy)
+	}
+}
+
+// Duplicate checks applied while loading the corpus (none by default)
+func (c *Config) DEDUP() []string {
+	return c.dedup
+}
+
+func (c *Config) SetDedup(modes []string) {
+	for _, mode := range modes {
+		switch mode {
+		case DEDUP_URL, DEDUP_NORMALIZED_URL, DEDUP_EMBEDDING:
+		default:
+			panic("Unknown dedup mode: " + mode)
+		}
+	}
+	c.dedup = modes
+}
+
+func (c *Config) DEDUP_SCOPE() string {
+	return c.dedupScope
+}
+
+func (c *Config) SetDedupScope(scope string) {
+	switch scope {
+	case DEDUP_SCOPE_CLUSTER, DEDUP_SCOPE_CORPUS:
+		c.dedupScope = scope
+	default:
+		panic("Unknown dedup scope: " + scope)
+	}
+}
+
+// Max size of the shared zstd dictionary sent to clients in the hint
+func (c *Config) URL_DICT_SZ() int {
+	return 16 * 1024
 }
 
-func (c *Config) DEFAULT_URL_HINT_SZ() uint64 {
-	return 100
+// Number of subclusters sampled to train the shared zstd dictionary
+func (c *Config) URL_DICT_SAMPLES() int {
+	return 4096
+}
+
+func (c *Config) EMBEDDINGS_PLAN_TARGETS() PlanTargets {
+	return c.embTargets
+}
+
+func (c *Config) SetEmbeddingsPlanTargets(t PlanTargets) {
+	c.embTargets = t
+}
+
+// Clusters of more embeddings than this are split across DB columns. Zero
+// means splitting only clusters taller than the hint target allows.
+func (c *Config) EMBEDDINGS_SPLIT_ROWS() uint64 {
+	return c.splitRows
+}
+
+func (c *Config) SetEmbeddingsSplitRows(rows uint64) {
+	c.splitRows = rows
+}
+
+func (c *Config) URL_PLAN_TARGETS() PlanTargets {
+	return c.urlTargets
+}
+
+func (c *Config) SetUrlPlanTargets(t PlanTargets) {
+	c.urlTargets = t
 }
 
 func (c *Config) EMBEDDINGS_DIM() uint64 {
+	if c.embDim > 0 {
+		return c.embDim
+	}
 	return 192
 }
 
+// For corpora of other embedding dimensions, e.g. synthetic ones
+func (c *Config) SetEmbeddingsDim(dim uint64) {
+	c.embDim = dim
+}
+
+// Whether clients check every answer against the answer checks written by
+// answer-checks, which servers never see
+func (c *Config) INTEGRITY_CHECKS() bool {
+	return c.integrity
+}
+
+func (c *Config) SetIntegrityChecks(on bool) {
+	c.integrity = on
+}
+
+func (c *Config) REQUEST_POLICY() RequestPolicy {
+	return c.policy
+}
+
+func (c *Config) SetRequestPolicy(p RequestPolicy) {
+	if p.EmbQueries < 1 || p.UrlQueries < 1 {
+		panic("A search needs at least one embeddings and one URL query")
+	}
+	c.policy = p
+}
+
+func (c *Config) COVER_TRAFFIC() CoverTraffic {
+	return c.cover
+}
+
+func (c *Config) SetCoverTraffic(t CoverTraffic) {
+	if t.PerHour < 0 || t.MaxMBPerHour < 0 {
+		panic("Bad cover traffic settings")
+	}
+	c.cover = t
+}
+
+func (c *Config) SERVER_LIMITS() ServerLimits {
+	return c.limits
+}
+
+func (c *Config) SetServerLimits(l ServerLimits) {
+	if l.PerSec < 0 || l.ConnPerSec < 0 || l.MaxConcurrent < 0 || l.MaxWaitSec < 0 {
+		panic("Bad server limits")
+	}
+	if l.Burst < 1 {
+		l.Burst = 1
+	}
+	c.limits = l
+}
+
+// A server may compute for a while before it sends anything, and a hint
+// application to a large DB takes seconds
+func DefaultTimeouts() Timeouts {
+	return Timeouts{DialSec: 10, ReadSec: 120, SearchSec: 300}
+}
+
+func (c *Config) TIMEOUTS() Timeouts {
+	return c.timeouts
+}
+
+func (c *Config) SetTimeouts(t Timeouts) {
+	if t.DialSec < 0 || t.ReadSec < 0 || t.SearchSec < 0 {
+		panic("Bad timeouts")
+	}
+	c.timeouts = t
+}
+
+// Persistent connections are off, as in the original protocol, where each
+// call has a connection of its own
+func DefaultConnPool() ConnPool {
+	return ConnPool{MaxIdle: 0, IdleSec: 60, KeepAliveSec: 15, DownSec: 30}
+}
+
+func (c *Config) CONN_POOL() ConnPool {
+	return c.connPool
+}
+
+func (c *Config) SetConnPool(p ConnPool) {
+	if p.MaxIdle < 0 || p.IdleSec < 0 || p.KeepAliveSec < 0 || p.DownSec < 0 {
+		panic("Bad connection pool settings")
+	}
+	c.connPool = p
+}
+
+// Whether servers answer only calls paid for with a token from the token
+// issuer, one token per PIR answer or hint application
+func (c *Config) TOKENS() bool {
+	return c.tokens
+}
+
+func (c *Config) SetTokens(on bool) {
+	c.tokens = on
+}
+
+// Address of the token issuer that clients get tokens from, and that
+// servers record the tokens they take at
+func (c *Config) TOKEN_ISSUER() string {
+	return c.tokenIssuer
+}
+
+func (c *Config) SetTokenIssuer(addr string) {
+	c.tokenIssuer = addr
+}
+
+// Tokens that a client gets from the issuer at once, and the most that the
+// issuer signs per call
+func (c *Config) TOKENS_PER_BATCH() int {
+	return 64
+}
+
 func SLOT_BITS() uint64 {
 	return 5
 }
 
+// Rebalancing splits clusters of more than this many times the mean
+// cluster size ...
+func (c *Config) REBALANCE_MAX_FACTOR() float64 {
+	return 2
+}
+
+// ... by merging away clusters of less than this many times the mean size
+func (c *Config) REBALANCE_MIN_FACTOR() float64 {
+	return 0.25
+}
+
 func (c *Config) TOTAL_NUM_CLUSTERS() int {
 	return 14000
 }
 
+// Ids of the clusters in the corpus, in the order they are split across
+// servers. Need not be consecutive.
+func (c *Config) CLUSTER_IDS() []uint {
+	if c.clusterIds != nil {
+		return c.clusterIds
+	}
+
+	ids := make([]uint, c.TOTAL_NUM_CLUSTERS())
+	for i := range ids {
+		ids[i] = uint(i)
+	}
+	return ids
+}
+
+func (c *Config) SetClusterIds(ids []uint) {
+	c.clusterIds = ids
+}
+
+func (c *Config) NUM_CLUSTERS() int {
+	if c.clusterIds != nil {
+		return len(c.clusterIds)
+	}
+	return c.TOTAL_NUM_CLUSTERS()
+}
+
+// Ids of clusters [start, stop) of CLUSTER_IDS()
+func (c *Config) ClusterIdsBetween(start, stop int) []uint {
+	ids := c.CLUSTER_IDS()
+	if stop > len(ids) {
+		stop = len(ids)
+	}
+	if start >= stop {
+		return []uint{}
+	}
+	return ids[start:stop]
+}
+
 func (c *Config) MAX_EMBEDDINGS_SERVERS() int {
 	return 1
 }
 
 func (c *Config) EMBEDDINGS_CLUSTERS_PER_SERVER() int {
-	clustersPerServer := float64(c.TOTAL_NUM_CLUSTERS()) / float64(c.MAX_EMBEDDINGS_SERVERS())
+	clustersPerServer := float64(c.NUM_CLUSTERS()) / float64(c.MAX_EMBEDDINGS_SERVERS())
 	return int(math.Ceil(clustersPerServer))
 }
 
 func (c *Config) URL_CLUSTERS_PER_SERVER() int {
-	clustersPerServer := float64(c.TOTAL_NUM_CLUSTERS()) / float64(c.MAX_URL_SERVERS())
+	clustersPerServer := float64(c.NUM_CLUSTERS()) / float64(c.MAX_URL_SERVERS())
 	return int(math.Ceil(clustersPerServer))
 }
 
 func (c *Config) MAX_URL_SERVERS() int {
 	return 1
 }
-
-func (c *Config) SIMPLEPIR_EMBEDDINGS_RECORD_LENGTH() int {
-	return 17
-}
@@ -8,18 +8,43 @@ func (c *Config) TxtCorpus(clusterId int) string {
 		clusterId)
 }
 
+// Cluster centroids read by the embedder, one per line
+func (c *Config) Centroids() string {
+	return fmt.Sprintf("%s/artifact/dim%d/centroids.npy",
+		c.preamble,
+		c.EMBEDDINGS_DIM())
+}
+
+func (c *Config) PcaComponents() string {
+	return fmt.Sprintf("%s/artifact/dim%d/pca_%d.npy",
+		c.preamble,
+		c.EMBEDDINGS_DIM(),
+		c.EMBEDDINGS_DIM())
+}
+
+func (c *Config) ModelDir() string {
+	return fmt.Sprintf("%s/model", c.preamble)
+}
+
+// Version of the encoding of the server state saved in the logs below. It
+// is part of their names, so that a server built after the encoding changed
+// writes its state anew instead of failing to read an old one.
+const STATE_VERSION = 2
+
 func (c *Config) EmbeddingServerLog(serverId int) string {
-	return fmt.Sprintf("%s/artifact/dim%d/cluster-server-%d.log",
+	return fmt.Sprintf("%s/artifact/dim%d/cluster-server-%d.v%d.log",
 		c.preamble,
 		c.EMBEDDINGS_DIM(),
-		serverId)
+		serverId,
+		STATE_VERSION)
 }
 
 func (c *Config) UrlServerlog(serverId int) string {
-	return fmt.Sprintf("%s/artifact/dim%d/url-server-%d.log",
+	return fmt.Sprintf("%s/artifact/dim%d/url-server-%d.v%d.log",
 		c.preamble,
 		c.EMBEDDINGS_DIM(),
-		serverId)
+		serverId,
+		STATE_VERSION)
 }
 
 func (c *Config) CoordinatorLog(numEmbServers, numUrlServers int) string {
@@ -31,15 +56,64 @@ func (c *Config) CoordinatorLog(numEmbServers, numUrlServers int) string {
 }
 
 func (c *Config) EmbeddingServerLogWithoutHint(serverId int) string {
-	return fmt.Sprintf("%s/artifact/dim%d/cluster-server-no-hint-%d.log",
+	return fmt.Sprintf("%s/artifact/dim%d/cluster-server-no-hint-%d.v%d.log",
 		c.preamble,
 		c.EMBEDDINGS_DIM(),
-		serverId)
+		serverId,
+		STATE_VERSION)
 }
 
 func (c *Config) UrlServerLogWithoutHint(serverId int) string {
-	return fmt.Sprintf("%s/artifact/dim%d/url-server-no-hint-%d.log",
+	return fmt.Sprintf("%s/artifact/dim%d/url-server-no-hint-%d.v%d.log",
 		c.preamble,
 		c.EMBEDDINGS_DIM(),
-		serverId)
+		serverId,
+		STATE_VERSION)
+}
+
+func (c *Config) NpyEmbeddings() string {
+	return fmt.Sprintf("%s/npy/embeddings.npy", c.preamble)
+}
+
+func (c *Config) NpyClusterAssignments() string {
+	return fmt.Sprintf("%s/npy/cluster_assignments.npy", c.preamble)
+}
+
+// Subcluster and doc of each row of NpyEmbeddings(), one per line
+func (c *Config) NpyUrls() string {
+	return fmt.Sprintf("%s/npy/urls.txt", c.preamble)
+}
+
+func (c *Config) CsvCorpus() string {
+	return fmt.Sprintf("%s/corpus.csv", c.preamble)
+}
+
+// Ids of the clusters written by gen-corpus, as read by -clusters
+func (c *Config) ClusterIdsFile() string {
+	return fmt.Sprintf("%s/clusters/cluster_ids.txt", c.preamble)
+}
+
+// Answer checks of the DBs, handed to clients but not to servers
+func (c *Config) EmbeddingsCheckFile() string {
+	return fmt.Sprintf("%s/answer_checks/embeddings.gob", c.preamble)
+}
+
+func (c *Config) UrlsCheckFile() string {
+	return fmt.Sprintf("%s/answer_checks/urls.gob", c.preamble)
+}
+
+// Key that the token issuer signs access tokens with
+func (c *Config) TokenKeyFile() string {
+	return fmt.Sprintf("%s/tokens/issuer_key.pem", c.preamble)
+}
+
+// Public half of TokenKeyFile(), which servers check tokens against
+func (c *Config) TokenPublicKeyFile() string {
+	return fmt.Sprintf("%s/tokens/issuer_pub.pem", c.preamble)
+}
+
+// Tokens that the token issuer has seen spent, for those that have not
+// expired yet
+func (c *Config) TokenSpentFile() string {
+	return fmt.Sprintf("%s/tokens/spent.bin", c.preamble)
 }
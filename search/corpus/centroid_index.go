@@ -0,0 +1,157 @@
+package corpus
+
+import (
+	"container/heap"
+	"math/rand"
+)
+
+// Bits of the hash that buckets centroids by the side of random hyperplanes
+// they fall on, so that centroids pointing the same way share a bucket
+const CENTROID_INDEX_MAX_BITS = 16
+
+// Finds the centroid with the largest inner product with a given one,
+// among those in the same bucket or a bucket one bit away, without
+// comparing against every centroid
+type centroidIndex struct {
+	planes  [][]float64
+	buckets map[uint64][]int
+	keys    map[int]uint64 // bucket of each indexed cluster
+}
+
+// Sized for about 8 clusters per bucket
+func newCentroidIndex(numClusters int, slots uint64) *centroidIndex {
+	bits := 0
+	for n := numClusters / 8; n > 1 && bits < CENTROID_INDEX_MAX_BITS; n /= 2 {
+		bits += 1
+	}
+
+	r := rand.New(rand.NewSource(1))
+	planes := make([][]float64, bits)
+	for i := range planes {
+		planes[i] = make([]float64, slots)
+		for j := range planes[i] {
+			planes[i][j] = r.NormFloat64()
+		}
+	}
+
+	return &centroidIndex{planes: planes, buckets: make(map[uint64][]int), keys: make(map[int]uint64)}
+}
+
+func (x *centroidIndex) key(c []float64) uint64 {
+	k := uint64(0)
+	for i, p := range x.planes {
+		if centroidDot(p, c) >= 0 {
+			k |= 1 << i
+		}
+	}
+	return k
+}
+
+// Indexes the centroid of a cluster, replacing its previous one. Empty
+// clusters, with a nil centroid, are not indexed.
+func (x *centroidIndex) set(cluster int, c []float64) {
+	if k, ok := x.keys[cluster]; ok {
+		b := x.buckets[k]
+		for i, other := range b {
+			if other == cluster {
+				x.buckets[k] = append(b[:i], b[i+1:]...)
+				break
+			}
+		}
+		delete(x.keys, cluster)
+	}
+	if c == nil {
+		return
+	}
+
+	k := x.key(c)
+	x.buckets[k] = append(x.buckets[k], cluster)
+	x.keys[cluster] = k
+}
+
+// The cluster among those that ok accepts whose centroid has the largest
+// inner product with c, looking in nearby buckets first and at every
+// cluster only if none of these is accepted. Returns -1 if there is none.
+func (x *centroidIndex) nearest(c []float64, centroids func(int) []float64, ok func(int) bool) int {
+	best, bestDot := -1, 0.0
+	consider := func(i int) {
+		if !ok(i) {
+			return
+		}
+		if d := centroidDot(centroids(i), c); best == -1 || d > bestDot || (d == bestDot && i < best) {
+			best, bestDot = i, d
+		}
+	}
+
+	k := x.key(c)
+	for _, i := range x.buckets[k] {
+		consider(i)
+	}
+	for b := range x.planes {
+		for _, i := range x.buckets[k^(1<<b)] {
+			consider(i)
+		}
+	}
+	if best != -1 {
+		return best
+	}
+
+	for i := range x.keys {
+		consider(i)
+	}
+	return best
+}
+
+type sizeEntry struct {
+	size, cluster int
+}
+
+// Clusters by size, largest first if max. Entries are not updated in place:
+// a cluster whose size changes is pushed again, and entries that no longer
+// match its size are dropped when they come up.
+type sizeHeap struct {
+	entries []sizeEntry
+	max     bool
+}
+
+func (h *sizeHeap) Len() int { return len(h.entries) }
+func (h *sizeHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	if a.size != b.size {
+		return (a.size > b.size) == h.max
+	}
+	return a.cluster < b.cluster
+}
+func (h *sizeHeap) Swap(i, j int) { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *sizeHeap) Push(x any)    { h.entries = append(h.entries, x.(sizeEntry)) }
+func (h *sizeHeap) Pop() any {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return e
+}
+
+func (h *sizeHeap) push(cluster, size int) {
+	heap.Push(h, sizeEntry{size: size, cluster: cluster})
+}
+
+// The first cluster other than skip, or -1 if there is none
+func (h *sizeHeap) top(size func(int) int, skip int) int {
+	held := make([]sizeEntry, 0)
+	defer func() {
+		for _, e := range held {
+			heap.Push(h, e)
+		}
+	}()
+
+	for h.Len() > 0 {
+		e := h.entries[0]
+		if e.size != size(e.cluster) {
+			heap.Pop(h)
+		} else if e.cluster == skip {
+			held = append(held, heap.Pop(h).(sizeEntry))
+		} else {
+			return e.cluster
+		}
+	}
+	return -1
+}
@@ -0,0 +1,77 @@
+package corpus
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"search/config"
+	"search/utils"
+)
+
+// Reads the centroids that the embedder routes queries by, one row per
+// cluster id, in the text format of numpy.savetxt. Centroids written by
+// cluster.py are in the space of the model, and are projected onto the PCA
+// components as the embedder projects queries, so that they compare with
+// the embeddings of the corpus; those written by RebalanceTxt are already.
+func ReadCentroids(conf *config.Config) [][]float64 {
+	file := conf.Centroids()
+	f := utils.OpenFile(file)
+	defer f.Close()
+
+	rows := make([][]float64, 0)
+	scanner := newTxtScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		row := make([]float64, len(fields))
+		for i, v := range fields {
+			var err error
+			if row[i], err = strconv.ParseFloat(v, 64); err != nil {
+				fmt.Println(err)
+				fmt.Printf("Failed on file %s\n", file)
+				panic("Error parsing centroids")
+			}
+		}
+		if len(rows) > 0 && len(row) != len(rows[0]) {
+			fmt.Printf("Row %d has %d values vs. %d\n", len(rows), len(row), len(rows[0]))
+			panic("Error parsing centroids")
+		}
+		rows = append(rows, row)
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Println(err)
+		fmt.Println(file)
+		panic("Error reading file")
+	}
+
+	slots := conf.EMBEDDINGS_DIM()
+	if len(rows) == 0 || uint64(len(rows[0])) == slots {
+		return rows
+	}
+
+	width := uint64(len(rows[0]))
+	shape, components := ReadNpyFloats(conf.PcaComponents())
+	if len(shape) != 2 || shape[0] != width || shape[1] != slots {
+		fmt.Printf("PCA components of shape %v vs. %d by %d\n", shape, width, slots)
+		panic("PCA components do not match the centroids")
+	}
+
+	scale := float64(int(1) << NPY_FLOAT_PREC)
+	for r, row := range rows {
+		projected := make([]float64, slots)
+		for i, v := range row {
+			v = math.RoundToEven(v * scale)
+			for j, c := range components[uint64(i)*slots : uint64(i+1)*slots] {
+				projected[j] += v * c / NPY_PCA_DIVISOR
+			}
+		}
+		rows[r] = projected
+	}
+	return rows
+}
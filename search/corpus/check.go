@@ -0,0 +1,315 @@
+package corpus
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"search/config"
+	"search/utils"
+)
+
+// Number of examples kept of each kind of issue
+const CHECK_MAX_EXAMPLES = 10
+
+// An issue at a line of a cluster file (line 0 if it concerns the whole file)
+type CheckIssue struct {
+	Cluster uint   `json:"cluster"`
+	Line    int    `json:"line"`
+	Detail  string `json:"detail"`
+}
+
+// Number of issues of one kind, and the first few of them
+type CheckIssues struct {
+	Count    int          `json:"count"`
+	Examples []CheckIssue `json:"examples"`
+}
+
+func (is *CheckIssues) add(cluster uint, line int, format string, args ...interface{}) {
+	is.Count += 1
+	if len(is.Examples) < CHECK_MAX_EXAMPLES {
+		is.Examples = append(is.Examples, CheckIssue{
+			Cluster: cluster,
+			Line:    line,
+			Detail:  fmt.Sprintf(format, args...),
+		})
+	}
+}
+
+type SubclusterSize struct {
+	Cluster    uint   `json:"cluster"`
+	Subcluster int    `json:"subcluster"`
+	Docs       uint64 `json:"docs"`
+	Bytes      uint64 `json:"bytes"`
+}
+
+type CheckReport struct {
+	Clusters    int    `json:"clusters"`
+	Docs        uint64 `json:"docs"`
+	Subclusters int    `json:"subclusters"`
+
+	// Issues that make preprocessing panic
+	DimMismatches CheckIssues `json:"dim_mismatches"`
+	ParseErrors   CheckIssues `json:"parse_errors"`
+
+	MissingClusters  CheckIssues `json:"missing_clusters"`
+	EmptyClusters    CheckIssues `json:"empty_clusters"`
+	EmptySubclusters CheckIssues `json:"empty_subclusters"`
+	DuplicateUrls    CheckIssues `json:"duplicate_urls"`
+	LongUrls         CheckIssues `json:"long_urls"` // spill into overflow records
+
+	EmbeddingSlots uint64   `json:"embedding_slots"`
+	SlotBits       uint64   `json:"slot_bits"`
+	ClampedValues  uint64   `json:"clamped_values"`
+	ClampedPerSlot []uint64 `json:"clamped_per_slot"`
+
+	// Every URL answer is UrlBytes long, so a few large subclusters make
+	// every answer large
+	UrlCodec           string           `json:"url_codec"`
+	UrlBytes           uint64           `json:"url_bytes"`
+	MeanSubclusterSz   float64          `json:"mean_subcluster_bytes"`
+	MedianSubclusterSz uint64           `json:"median_subcluster_bytes"`
+	P99SubclusterSz    uint64           `json:"p99_subcluster_bytes"`
+	LargestSubclusters []SubclusterSize `json:"largest_subclusters"`
+}
+
+// Whether the corpus can be preprocessed
+func (r *CheckReport) Ok() bool {
+	return r.DimMismatches.Count == 0 && r.ParseErrors.Count == 0
+}
+
+// Splits a line into its embedding and its doc fields, without panicking
+// on malformed lines as parseDelimitersTxt does.
+func splitLineTxt(txt string) (string, string, bool) {
+	i1 := strings.Index(txt, "|")
+	if i1 == -1 || i1+2 > len(txt) {
+		return "", "", false
+	}
+
+	i2 := strings.Index(txt[i1+2:], "|")
+	if i2 == -1 {
+		return "", "", false
+	}
+	i2 += i1 + 2
+	if i2-1 < i1+2 || i2+2 > len(txt) {
+		return "", "", false
+	}
+
+	return txt[i1+2 : i2-1], txt[i2+2:], true
+}
+
+// Scans the per-cluster text files of conf.CLUSTER_IDS() and reports any
+// issues, without stopping at the first one. Subclusters are compressed
+// with the codec selected by conf, as when building the URL DB.
+func CheckCorpusTxt(conf *config.Config) *CheckReport {
+	r := new(CheckReport)
+	r.EmbeddingSlots = conf.EMBEDDINGS_DIM()
+	r.SlotBits = config.SLOT_BITS()
+	r.ClampedPerSlot = make([]uint64, r.EmbeddingSlots)
+	r.UrlCodec = conf.URL_CODEC()
+
+	minVal := -int(1 << (r.SlotBits - 1))
+	maxVal := int(1 << (r.SlotBits - 1))
+
+	// Compress the urls as the loader would
+	c := new(Corpus)
+	c.setUrlCodec(conf)
+	c.urls = make([][]byte, 0)
+	c.urlClusterMap = make(map[uint][]Subcluster)
+
+	type firstSeen struct {
+		cluster uint
+		line    int
+	}
+	seen := make(map[string]firstSeen)
+
+	for n, cluster := range conf.CLUSTER_IDS() {
+		file := conf.TxtCorpus(int(cluster))
+		if !utils.FileExists(file) {
+			r.MissingClusters.add(cluster, 0, "%s does not exist", file)
+			continue
+		}
+		r.Clusters += 1
+
+		f := utils.OpenFile(file)
+		scanner := newTxtScanner(f)
+
+		urls := [][]Doc{{}}
+		docs := 0
+		line := 0
+		for scanner.Scan() {
+			line += 1
+			txt := scanner.Text()
+			if len(txt) == 0 {
+				continue
+			} else if txt == SUBCLUSTER_DELIM {
+				if len(urls[len(urls)-1]) == 0 {
+					r.EmptySubclusters.add(cluster, line, "subcluster %d is empty", len(urls)-1)
+				}
+				urls = append(urls, []Doc{})
+				continue
+			}
+
+			embTxt, docTxt, ok := splitLineTxt(txt)
+			if !ok {
+				r.ParseErrors.add(cluster, line, "expected \"id | embedding | url\"")
+				continue
+			}
+
+			vals := strings.Split(embTxt, ",")
+			if len(vals) != int(r.EmbeddingSlots) {
+				r.DimMismatches.add(cluster, line, "%d values instead of %d", len(vals), r.EmbeddingSlots)
+			} else {
+				for i, v := range vals {
+					u, err := parseEmbeddingVal(v)
+					if err != nil {
+						r.ParseErrors.add(cluster, line, "slot %d: %s", i, err)
+						break
+					}
+					if u < minVal || u > maxVal {
+						r.ClampedPerSlot[i] += 1
+						r.ClampedValues += 1
+					}
+				}
+			}
+
+			doc := parseDocFields(docTxt)
+			if prev, ok := seen[doc.Url]; ok {
+				r.DuplicateUrls.add(cluster, line, "%s also in cluster %d, line %d", doc.Url, prev.cluster, prev.line)
+			} else {
+				seen[doc.Url] = firstSeen{cluster, line}
+			}
+			if len(doc.Url) > MAX_URL_LEN {
+				r.LongUrls.add(cluster, line, "%d bytes, spills into %d overflow records",
+					len(doc.Url), (len(doc.Url)-1)/MAX_URL_LEN)
+			}
+
+			urls[len(urls)-1] = append(urls[len(urls)-1], doc)
+			docs += 1
+		}
+
+		if err := scanner.Err(); err != nil {
+			r.ParseErrors.add(cluster, line+1, "%s", err)
+		}
+		f.Close()
+
+		// As in ReadUrlsTxt, a trailing empty subcluster is dropped
+		if len(urls[len(urls)-1]) == 0 {
+			urls = urls[:len(urls)-1]
+		}
+		if docs == 0 {
+			r.EmptyClusters.add(cluster, 0, "no docs")
+		}
+		r.Docs += uint64(docs)
+		c.addUrlCluster(cluster, urls)
+
+		if n%1000 == 0 {
+			fmt.Printf("Checked cluster %d\n", cluster)
+		}
+	}
+	c.finishUrls()
+
+	r.subclusterSizes(c)
+	return r
+}
+
+func (r *CheckReport) subclusterSizes(c *Corpus) {
+	sizes := make([]SubclusterSize, 0, len(c.urls))
+	for cluster, scs := range c.urlClusterMap {
+		for i, sc := range scs {
+			sizes = append(sizes, SubclusterSize{
+				Cluster:    cluster,
+				Subcluster: i,
+				Docs:       sc.Size(),
+				Bytes:      uint64(len(c.urls[sc.Index()])),
+			})
+		}
+	}
+	r.Subclusters = len(sizes)
+	r.UrlBytes = c.params.UrlBytes
+	if len(sizes) == 0 {
+		return
+	}
+
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].Bytes != sizes[j].Bytes {
+			return sizes[i].Bytes > sizes[j].Bytes
+		}
+		return sizes[i].Cluster < sizes[j].Cluster
+	})
+
+	total := uint64(0)
+	for _, sz := range sizes {
+		total += sz.Bytes
+	}
+	r.MeanSubclusterSz = float64(total) / float64(len(sizes))
+	r.MedianSubclusterSz = sizes[len(sizes)/2].Bytes
+	r.P99SubclusterSz = sizes[len(sizes)/100].Bytes
+
+	if len(sizes) > CHECK_MAX_EXAMPLES {
+		sizes = sizes[:CHECK_MAX_EXAMPLES]
+	}
+	r.LargestSubclusters = sizes
+}
+
+func printIssues(name string, is *CheckIssues) {
+	fmt.Printf("%-20s %d\n", name, is.Count)
+	for _, e := range is.Examples {
+		if e.Line > 0 {
+			fmt.Printf("\tcluster %d, line %d: %s\n", e.Cluster, e.Line, e.Detail)
+		} else {
+			fmt.Printf("\tcluster %d: %s\n", e.Cluster, e.Detail)
+		}
+	}
+	if is.Count > len(is.Examples) {
+		fmt.Printf("\t... and %d more\n", is.Count-len(is.Examples))
+	}
+}
+
+func (r *CheckReport) Print() {
+	fmt.Printf("\nChecked %d clusters: %d docs in %d subclusters\n", r.Clusters, r.Docs, r.Subclusters)
+
+	printIssues("Dimension mismatches", &r.DimMismatches)
+	printIssues("Parse errors", &r.ParseErrors)
+	printIssues("Missing clusters", &r.MissingClusters)
+	printIssues("Empty clusters", &r.EmptyClusters)
+	printIssues("Empty subclusters", &r.EmptySubclusters)
+	printIssues("Duplicate urls", &r.DuplicateUrls)
+	printIssues("Long urls", &r.LongUrls)
+
+	fmt.Printf("%-20s %d (values outside [%d, %d])\n", "Clamped values",
+		r.ClampedValues, -(1 << (r.SlotBits - 1)), 1<<(r.SlotBits-1))
+	if r.ClampedValues > 0 {
+		for i, count := range r.ClampedPerSlot {
+			if count > 0 {
+				fmt.Printf("\tslot %d: %d\n", i, count)
+			}
+		}
+	}
+
+	fmt.Printf("Subcluster sizes with %s: mean %.1f; median %d; p99 %d; max (UrlBytes) %d bytes\n",
+		r.UrlCodec, r.MeanSubclusterSz, r.MedianSubclusterSz, r.P99SubclusterSz, r.UrlBytes)
+	for _, sz := range r.LargestSubclusters {
+		fmt.Printf("\tcluster %d, subcluster %d: %d docs, %d bytes\n",
+			sz.Cluster, sz.Subcluster, sz.Docs, sz.Bytes)
+	}
+
+	if r.Ok() {
+		fmt.Println("Corpus OK")
+	} else {
+		fmt.Println("Corpus has errors that would stop preprocessing")
+	}
+}
+
+func (r *CheckReport) WriteJson(file string) {
+	f := utils.CreateFile(file)
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		fmt.Println(err)
+		panic("Error writing file")
+	}
+}
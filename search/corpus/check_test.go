@@ -0,0 +1,48 @@
+package corpus_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"search/config"
+	"search/corpus"
+)
+
+// The check accepts what the loaders read: values padded with spaces, and
+// lines longer than bufio's default buffer
+func TestCheckMatchesLoader(t *testing.T) {
+	conf := config.MakeConfig(t.TempDir())
+	conf.SetCorpusFormat(config.CORPUS_FORMAT_TXT)
+	conf.SetEmbeddingsDim(4)
+	conf.SetClusterIds([]uint{0})
+
+	lines := []string{
+		"0 | 1, -2,3 , 4 | https://a.example/ | A | short",
+		"1 | 1,2,3,4 | https://b.example/ | B | " + strings.Repeat("x", 100*1024),
+	}
+	file := conf.TxtCorpus(0)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := corpus.CheckCorpusTxt(conf)
+	if r.ParseErrors.Count != 0 || r.DimMismatches.Count != 0 || r.Docs != 2 {
+		t.Fatalf("check found %d parse errors and %d dim mismatches in %d docs, want none in 2",
+			r.ParseErrors.Count, r.DimMismatches.Count, r.Docs)
+	}
+
+	emb := corpus.ReadEmbeddingsTxt(0, 1, conf)
+	urls := corpus.ReadUrlsTxt(0, 1, conf)
+	if emb.GetNumDocs() != 2 || urls.GetNumDocs() != 2 {
+		t.Fatalf("read %d embeddings and %d urls, want 2", emb.GetNumDocs(), urls.GetNumDocs())
+	}
+	if got := fmt.Sprint(emb.GetEmbedding(0)[:4]); got != "[1 -2 3 4]" {
+		t.Fatalf("embedding %s, want [1 -2 3 4]", got)
+	}
+}
@@ -0,0 +1,77 @@
+package corpus
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"search/utils"
+)
+
+// Reads a list of cluster ids, separated by whitespace or commas. Lines
+// starting with '#' are comments.
+func ReadClusterIds(file string) []uint {
+	f := utils.OpenFile(file)
+	defer f.Close()
+
+	ids := make([]uint, 0)
+	seen := make(map[uint]bool)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		txt := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(txt, "#") {
+			continue
+		}
+
+		for _, field := range strings.FieldsFunc(txt, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		}) {
+			id, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				fmt.Println(err)
+				fmt.Printf("Failed on file %s\n", file)
+				panic("Error parsing cluster ids")
+			}
+			if seen[uint(id)] {
+				fmt.Printf("Cluster %d listed twice in %s\n", id, file)
+				panic("Duplicate cluster id")
+			}
+			seen[uint(id)] = true
+			ids = append(ids, uint(id))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Println(err)
+		fmt.Println(file)
+		panic("Error reading file")
+	}
+
+	return ids
+}
+
+// Position of each cluster id in ids
+func clusterPositions(ids []uint) map[uint]int {
+	pos := make(map[uint]int, len(ids))
+	for i, id := range ids {
+		pos[id] = i
+	}
+	return pos
+}
+
+// Writes ids one per line, as ReadClusterIds reads them
+func writeClusterIds(file string, ids []uint) {
+	f := utils.CreateFile(file)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, id := range ids {
+		fmt.Fprintln(w, id)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Println(err)
+		panic("Error writing file")
+	}
+}
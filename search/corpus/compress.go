@@ -0,0 +1,138 @@
+package corpus
+
+import (
+	"fmt"
+
+	"search/config"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compresses the contents of URL subclusters
+type Compressor interface {
+	Compress(b []byte) []byte
+	Decompress(b []byte) ([]byte, error)
+}
+
+// Urls recovered from a server decompress to at most this many times
+// UrlBytes; larger ones are taken as corrupt, rather than let a server make
+// the client allocate without bound
+const MAX_URL_EXPANSION = 32
+
+type zlibCompressor struct {
+	maxDecoded uint64 // 0 for no limit
+}
+
+func (zlibCompressor) Compress(b []byte) []byte {
+	return Compress(b)
+}
+
+func (z zlibCompressor) Decompress(b []byte) ([]byte, error) {
+	if z.maxDecoded == 0 {
+		return Decompress(b)
+	}
+	return decompressAtMost(b, z.maxDecoded)
+}
+
+type zstdCompressor struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// An empty dict gives plain zstd. Decompresses at most maxDecoded bytes,
+// unless it is 0.
+func newZstdCompressor(d []byte, maxDecoded uint64) *zstdCompressor {
+	eopts := []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithEncoderCRC(false), // records carry their own checksum
+		zstd.WithEncoderConcurrency(1),
+	}
+	dopts := []zstd.DOption{}
+	if maxDecoded > 0 {
+		dopts = append(dopts, zstd.WithDecoderMaxMemory(maxDecoded))
+	}
+	if len(d) > 0 {
+		eopts = append(eopts, zstd.WithEncoderDict(d))
+		dopts = append(dopts, zstd.WithDecoderDicts(d))
+	}
+
+	enc, err := zstd.NewWriter(nil, eopts...)
+	if err != nil {
+		fmt.Println(err)
+		panic("Error with zstd")
+	}
+	dec, err := zstd.NewReader(nil, dopts...)
+	if err != nil {
+		fmt.Println(err)
+		panic("Error with zstd")
+	}
+
+	return &zstdCompressor{enc: enc, dec: dec}
+}
+
+func (z *zstdCompressor) Compress(b []byte) []byte {
+	return z.enc.EncodeAll(b, nil)
+}
+
+func (z *zstdCompressor) Decompress(b []byte) ([]byte, error) {
+	return z.dec.DecodeAll(b, nil)
+}
+
+// Returns nil if codec does not compress. Decompresses at most maxDecoded
+// bytes, unless it is 0.
+func NewCompressor(codec string, d []byte, maxDecoded uint64) Compressor {
+	switch codec {
+	case "", config.URL_CODEC_ZLIB: // corpora preprocessed before codecs existed use zlib
+		return zlibCompressor{maxDecoded}
+	case config.URL_CODEC_ZSTD, config.URL_CODEC_ZSTD_DICT:
+		return newZstdCompressor(d, maxDecoded)
+	case config.URL_CODEC_NONE:
+		return nil
+	}
+
+	panic("Unknown URL codec: " + codec)
+}
+
+func (p *Params) UrlCompressor(d []byte) Compressor {
+	if !p.CompressUrl {
+		return nil
+	}
+	return NewCompressor(p.UrlCodec, d, 0)
+}
+
+// As UrlCompressor, for urls recovered from a server, which it decompresses
+// to at most MAX_URL_EXPANSION times UrlBytes
+func (p *Params) UrlDecompressor(d []byte) Compressor {
+	if !p.CompressUrl {
+		return nil
+	}
+	return NewCompressor(p.UrlCodec, d, MAX_URL_EXPANSION*p.UrlBytes)
+}
+
+// Trains a zstd dictionary of at most size bytes on the given samples.
+// Returns nil if there is too little data to train on.
+func TrainDict(samples [][]byte, size int) []byte {
+	total := 0
+	for _, s := range samples {
+		total += len(s)
+	}
+	if total < 8*size {
+		fmt.Printf("Only %d bytes of samples -- not training a zstd dictionary\n", total)
+		return nil
+	}
+
+	d, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: size,
+		HashBytes:   6,
+		ZstdLevel:   zstd.SpeedBestCompression,
+	})
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("Training zstd dictionary failed -- compressing without one")
+		return nil
+	}
+
+	fmt.Printf("Trained %d-byte zstd dictionary on %d subclusters\n", len(d), len(samples))
+	return d
+}
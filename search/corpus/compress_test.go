@@ -0,0 +1,27 @@
+package corpus_test
+
+import (
+	"bytes"
+	"testing"
+
+	"search/config"
+	"search/corpus"
+)
+
+// A small answer that decompresses to far more than the bound is rejected
+func TestDecompressBound(t *testing.T) {
+	bomb := bytes.Repeat([]byte("a"), 1<<20)
+	for _, codec := range []string{config.URL_CODEC_ZLIB, config.URL_CODEC_ZSTD} {
+		packed := corpus.NewCompressor(codec, nil, 0).Compress(bomb)
+
+		if out, err := corpus.NewCompressor(codec, nil, 0).Decompress(packed); err != nil || !bytes.Equal(out, bomb) {
+			t.Fatalf("%s: unbounded decompression failed: %v", codec, err)
+		}
+		if _, err := corpus.NewCompressor(codec, nil, 1<<20).Decompress(packed); err != nil {
+			t.Fatalf("%s: decompression within the bound failed: %v", codec, err)
+		}
+		if _, err := corpus.NewCompressor(codec, nil, 1<<16).Decompress(packed); err == nil {
+			t.Fatalf("%s: %d bytes from %d decompressed past the bound", codec, len(bomb), len(packed))
+		}
+	}
+}
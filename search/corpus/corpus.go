@@ -2,7 +2,7 @@ package corpus
 
 import (
 	"fmt"
-	"strings"
+	"sort"
 )
 
 type Params struct {
@@ -10,19 +10,31 @@ type Params struct {
 	EmbeddingSlots uint64 // number of slots per embeddign
 	SlotBits       uint64 // precision of each slot (in bits)
 	UrlBytes       uint64 // max bytes/url
-	CompressUrl    bool   // whether the urls are compressed with gzip
+	CompressUrl    bool   // whether the urls are compressed
+	UrlCodec       string // codec used to compress the urls (zlib if empty)
+}
+
+// Slots [start, end) of the embeddings hold the docs of a cluster
+type clusterSpan struct {
+	start uint
+	end   uint
 }
 
 type Corpus struct {
 	params Params
 
 	embeddings           []int8
-	embeddingsClusterMap map[uint]uint
+	embeddingsClusterMap map[uint]clusterSpan
 
 	urls          [][]byte
 	urlClusterMap map[uint][]Subcluster
 
-	maxClusterId uint
+	urlDict        []byte     // shared dictionary used to compress the urls
+	urlCompressor  Compressor // nil if the urls are not compressed
+	urlDictSz      int
+	urlDictSamples int
+	pendingUrls    []uint64 // subclusters waiting for the dictionary to be trained
+	trainingDict   bool
 }
 
 func (c *Corpus) GetParams() Params {
@@ -49,6 +61,14 @@ func (c *Corpus) GetCompressUrl() bool {
 	return c.params.CompressUrl
 }
 
+func (c *Corpus) GetUrlCodec() string {
+	return c.params.UrlCodec
+}
+
+func (c *Corpus) GetUrlDict() []byte {
+	return c.urlDict
+}
+
 func (c *Corpus) NumClusters() int {
 	return len(c.embeddingsClusterMap)
 }
@@ -64,31 +84,46 @@ func (c *Corpus) NumSubclustersInCluster(i uint) int {
 	return len(c.urlClusterMap[i])
 }
 
+// Cluster ids in increasing order. The ids need not be consecutive.
 func (c *Corpus) Clusters() []uint {
 	keys := make([]uint, 0, len(c.embeddingsClusterMap))
 	for k, _ := range c.embeddingsClusterMap {
 		keys = append(keys, k)
 	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
 	return keys
 }
 
+func (c *Corpus) HasCluster(i uint) bool {
+	_, ok := c.embeddingsClusterMap[i]
+	return ok
+}
+
 func (c *Corpus) ClusterToIndex(i uint) uint {
 	if _, ok := c.embeddingsClusterMap[i]; !ok {
 		panic("Cluster does not exist")
 	}
-	return c.embeddingsClusterMap[i]
+	return c.embeddingsClusterMap[i].start
 }
 
-func (c *Corpus) NumDocsInCluster(i uint) uint64 {
-	startIndex := c.ClusterToIndex(i)
+// Appends the embeddings of a cluster, which may be empty
+func (c *Corpus) addEmbeddingsCluster(cluster uint, embs []int8) {
+	if _, ok := c.embeddingsClusterMap[cluster]; ok {
+		fmt.Printf("Cluster %d appears twice\n", cluster)
+		panic("Key should not exist.")
+	}
+
+	start := uint(len(c.embeddings))
+	c.embeddings = append(c.embeddings, embs...)
+	c.embeddingsClusterMap[cluster] = clusterSpan{start: start, end: uint(len(c.embeddings))}
+}
 
-	var endIndex uint
-	if i == c.maxClusterId { // WARNING: Implementation changed here.
-		endIndex = uint(len(c.embeddings))
-	} else {
-		// NOTE: Cluster names must be consecutive. So next cluster should exist...
-		endIndex = c.ClusterToIndex(i + 1)
+func (c *Corpus) NumDocsInCluster(i uint) uint64 {
+	if _, ok := c.embeddingsClusterMap[i]; !ok {
+		panic("Cluster does not exist")
 	}
+	startIndex := c.embeddingsClusterMap[i].start
+	endIndex := c.embeddingsClusterMap[i].end
 	numSlots := uint64(endIndex - startIndex)
 	if numSlots%c.params.EmbeddingSlots != 0 {
 		panic("Should not happen")
@@ -157,31 +192,47 @@ func (c *Corpus) SubclusterToClusterMap() map[uint]uint {
 	return index
 }
 
-func (c *Corpus) GetUrlsInCluster(i uint64) string {
+// Subclusters of each cluster, as in the URL DB's index map. Not a copy.
+func (c *Corpus) UrlSubclusters() map[uint][]Subcluster {
+	return c.urlClusterMap
+}
+
+func (c *Corpus) GetUrlsInSubcluster(cluster uint, index int) []Doc {
+	if index >= c.NumSubclustersInCluster(cluster) {
+		panic("Subcluster does not exist within cluster")
+	}
+
+	docs, err := DecodeSubcluster(c.urls[c.urlClusterMap[cluster][index].Index()], c.urlCompressor)
+	if err != nil {
+		fmt.Println(err)
+		panic("URL recovery failed")
+	}
+	return docs
+}
+
+func (c *Corpus) GetUrlsInCluster(i uint64) []Doc {
 	num := c.NumSubclustersInCluster(uint(i))
-	chunks := make([]string, num)
+	docs := make([]Doc, 0)
 
 	for ch := 0; ch < num; ch++ {
 		at := c.urlClusterMap[uint(i)][ch].Index()
 
-		if c.params.CompressUrl {
-			url_chunk, err := Decompress(c.urls[at])
-			if err != nil {
-				panic("URL recovery failed")
-			}
-			chunks[ch] = url_chunk
-		} else {
-			chunks[ch] = strings.TrimRight(string(c.urls[at]), "\x00")
+		chunkDocs, err := DecodeSubcluster(c.urls[at], c.urlCompressor)
+		if err != nil {
+			fmt.Println(err)
+			panic("URL recovery failed")
 		}
+		docs = append(docs, chunkDocs...)
 	}
 
-	return strings.Join(chunks, "")
+	return docs
 }
 
 func (p *Params) Consistent(np *Params) bool {
 	if (p.EmbeddingSlots != np.EmbeddingSlots) ||
 		(p.SlotBits != np.SlotBits) ||
-		(p.CompressUrl != np.CompressUrl) {
+		(p.CompressUrl != np.CompressUrl) ||
+		(p.UrlCodec != np.UrlCodec) {
 		fmt.Println(np)
 		fmt.Println(p)
 		return false
@@ -0,0 +1,59 @@
+// Package corpustest sets up synthetic corpora for tests, so that they need
+// no real data.
+package corpustest
+
+import (
+	"testing"
+
+	"search/config"
+	"search/corpus"
+)
+
+// A synthetic corpus written under a temporary preamble, along with the
+// corpora that reading it back would give
+type Fixture struct {
+	Conf       *config.Config // reads the corpus back
+	Synthetic  *corpus.Synthetic
+	Embeddings *corpus.Corpus
+	Urls       *corpus.Corpus
+}
+
+// A spec small enough for PIR tests to run in seconds
+func SmallSpec() corpus.SyntheticSpec {
+	return corpus.SyntheticSpec{
+		Clusters:       8,
+		MeanDocs:       24,
+		Sizes:          corpus.SIZES_UNIFORM,
+		SubclusterDocs: 10,
+		Dim:            16,
+		SlotBits:       config.SLOT_BITS(),
+		MinUrlLen:      30,
+		MaxUrlLen:      60,
+		Seed:           1,
+	}
+}
+
+// Writes the corpus of spec to a directory removed at the end of the test
+func New(t testing.TB, spec corpus.SyntheticSpec) *Fixture {
+	t.Helper()
+	if spec.SlotBits > config.SLOT_BITS() {
+		t.Fatalf("%d slot bits would be clamped to %d on loading", spec.SlotBits, config.SLOT_BITS())
+	}
+
+	f := new(Fixture)
+	f.Conf = config.MakeConfig(t.TempDir())
+	f.Conf.SetCorpusFormat(config.CORPUS_FORMAT_TXT)
+	f.Conf.SetEmbeddingsDim(spec.Dim)
+
+	f.Synthetic = corpus.NewSynthetic(spec)
+	f.Conf.SetClusterIds(f.Synthetic.ClusterIds())
+	f.Synthetic.WriteTxt(f.Conf)
+
+	f.Embeddings = f.Synthetic.Embeddings()
+	f.Urls = f.Synthetic.Urls(f.Conf)
+	return f
+}
+
+func Small(t testing.TB) *Fixture {
+	return New(t, SmallSpec())
+}
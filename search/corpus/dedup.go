@@ -0,0 +1,196 @@
+package corpus
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strings"
+
+	"search/config"
+	"search/utils"
+)
+
+type dedupLoc struct {
+	cluster uint
+	line    int
+}
+
+type DedupReport struct {
+	Modes             []string    `json:"modes"`
+	Scope             string      `json:"scope"`
+	Docs              uint64      `json:"docs"` // docs seen, including the dropped ones
+	SameUrl           CheckIssues `json:"same_url"`
+	SameNormalizedUrl CheckIssues `json:"same_normalized_url"`
+	SameEmbedding     CheckIssues `json:"same_embedding"`
+}
+
+func (r *DedupReport) Dropped() int {
+	return r.SameUrl.Count + r.SameNormalizedUrl.Count + r.SameEmbedding.Count
+}
+
+// Drops duplicate docs as the corpus is loaded. The embeddings and the urls
+// are loaded separately, so both loaders must see the docs in the same
+// order and drop the same ones, or the two DBs would disagree on which doc
+// is at each index.
+type Deduper struct {
+	byUrl           bool
+	byNormalizedUrl bool
+	byEmbedding     bool
+	perCluster      bool
+
+	urls           map[uint64]dedupLoc
+	normalizedUrls map[uint64]dedupLoc
+	embs           map[uint64]dedupLoc
+
+	Report DedupReport
+}
+
+// Returns nil if conf asks for no dedup
+func newDeduper(conf *config.Config) *Deduper {
+	if len(conf.DEDUP()) == 0 {
+		return nil
+	}
+
+	// The .npy embeddings are laid out before they are read, so no doc can
+	// be dropped as they are
+	if conf.CORPUS_FORMAT() == config.CORPUS_FORMAT_NPY ||
+		(conf.CORPUS_FORMAT() == config.CORPUS_FORMAT_AUTO && utils.FileExists(conf.NpyEmbeddings())) {
+		panic("Dedup is not supported for npy corpora")
+	}
+
+	d := new(Deduper)
+	for _, mode := range conf.DEDUP() {
+		switch mode {
+		case config.DEDUP_URL:
+			d.byUrl = true
+		case config.DEDUP_NORMALIZED_URL:
+			d.byNormalizedUrl = true
+		case config.DEDUP_EMBEDDING:
+			d.byEmbedding = true
+		}
+	}
+	d.perCluster = (conf.DEDUP_SCOPE() == config.DEDUP_SCOPE_CLUSTER)
+	d.urls = make(map[uint64]dedupLoc)
+	d.normalizedUrls = make(map[uint64]dedupLoc)
+	d.embs = make(map[uint64]dedupLoc)
+	d.Report.Modes = conf.DEDUP()
+	d.Report.Scope = conf.DEDUP_SCOPE()
+
+	return d
+}
+
+func (d *Deduper) needsUrls() bool {
+	return d != nil && (d.byUrl || d.byNormalizedUrl)
+}
+
+func (d *Deduper) needsEmbeddings() bool {
+	return d != nil && d.byEmbedding
+}
+
+// Keys are hashed to keep the maps small on large corpora
+func (d *Deduper) hash(cluster uint, key []byte) uint64 {
+	h := fnv.New64a()
+	if d.perCluster {
+		fmt.Fprintf(h, "%d:", cluster)
+	}
+	h.Write(key)
+	return h.Sum64()
+}
+
+// Whether to keep the doc at a line of a cluster file. The url is ignored
+// unless deduplicating by url, and emb unless deduplicating by embedding.
+func (d *Deduper) keep(cluster uint, line int, docUrl string, emb []int8) bool {
+	if d == nil {
+		return true
+	}
+	d.Report.Docs += 1
+
+	var urlKey, normKey, embKey uint64
+	if d.byUrl {
+		urlKey = d.hash(cluster, []byte(docUrl))
+		if prev, ok := d.urls[urlKey]; ok {
+			d.Report.SameUrl.add(cluster, line, "%s duplicates cluster %d, line %d", docUrl, prev.cluster, prev.line)
+			return false
+		}
+	}
+	if d.byNormalizedUrl {
+		normKey = d.hash(cluster, []byte(NormalizeUrl(docUrl)))
+		if prev, ok := d.normalizedUrls[normKey]; ok {
+			d.Report.SameNormalizedUrl.add(cluster, line, "%s duplicates cluster %d, line %d", docUrl, prev.cluster, prev.line)
+			return false
+		}
+	}
+	if d.byEmbedding {
+		b := make([]byte, len(emb))
+		for i, v := range emb {
+			b[i] = byte(v)
+		}
+		embKey = d.hash(cluster, b)
+		if prev, ok := d.embs[embKey]; ok {
+			d.Report.SameEmbedding.add(cluster, line, "embedding of %s duplicates cluster %d, line %d", docUrl, prev.cluster, prev.line)
+			return false
+		}
+	}
+
+	// Only docs that are kept count as the first copy
+	loc := dedupLoc{cluster, line}
+	if d.byUrl {
+		d.urls[urlKey] = loc
+	}
+	if d.byNormalizedUrl {
+		d.normalizedUrls[normKey] = loc
+	}
+	if d.byEmbedding {
+		d.embs[embKey] = loc
+	}
+	return true
+}
+
+func (d *Deduper) print() {
+	if d == nil {
+		return
+	}
+
+	r := &d.Report
+	fmt.Printf("Dedup by %s within each %s: dropped %d of %d docs\n",
+		strings.Join(r.Modes, ", "), r.Scope, r.Dropped(), r.Docs)
+	if d.byUrl {
+		printIssues("Same url", &r.SameUrl)
+	}
+	if d.byNormalizedUrl {
+		printIssues("Same normalized url", &r.SameNormalizedUrl)
+	}
+	if d.byEmbedding {
+		printIssues("Same embedding", &r.SameEmbedding)
+	}
+}
+
+// Key under which urls count as the same for DEDUP_NORMALIZED_URL: ignores
+// the scheme, a leading "www.", the case of the host, default ports, a
+// trailing slash, the fragment, utm_* tracking params and the order of the
+// query params.
+func NormalizeUrl(raw string) string {
+	raw = strings.TrimSpace(raw)
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return strings.ToLower(raw)
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+
+	q := u.Query()
+	for k := range q {
+		if strings.HasPrefix(strings.ToLower(k), "utm_") {
+			q.Del(k)
+		}
+	}
+
+	out := host + strings.TrimRight(u.EscapedPath(), "/")
+	if enc := q.Encode(); enc != "" { // sorted by key
+		out += "?" + enc
+	}
+	return out
+}
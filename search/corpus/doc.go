@@ -0,0 +1,204 @@
+package corpus
+
+import (
+	"encoding/binary"
+	"errors"
+	"unicode/utf8"
+)
+
+const (
+	MAX_TITLE_LEN   = 100
+	MAX_SNIPPET_LEN = 160
+)
+
+// Entry of a single document in the URL database
+type Doc struct {
+	Url     string
+	Title   string
+	Snippet string
+}
+
+func NewDoc(url, title, snippet string) Doc {
+	return Doc{
+		Url:     url,
+		Title:   truncate(title, MAX_TITLE_LEN),
+		Snippet: truncate(snippet, MAX_SNIPPET_LEN),
+	}
+}
+
+// Truncates s to at most n bytes, without splitting a UTF-8 character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n -= 1
+	}
+	return s[:n]
+}
+
+func appendField(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readField(b []byte) (string, []byte, error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return "", nil, errors.New("Truncated doc field")
+	}
+	return string(b[n : n+int(l)]), b[n+int(l):], nil
+}
+
+// Reference to the next overflow record, stored as index+1 (0 if none)
+func appendLink(b []byte, next int) []byte {
+	return binary.AppendUvarint(b, uint64(next+1))
+}
+
+func readLink(b []byte) (int, []byte, error) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, errors.New("Truncated overflow link")
+	}
+	return int(v) - 1, b[n:], nil
+}
+
+// Encodes the docs of a subcluster as:
+//
+//	numDocs, numOverflow (uvarints)
+//	one 4-byte offset per record, relative to the start of the records
+//	numDocs doc records, followed by numOverflow overflow records
+//
+// A doc record holds the first MAX_URL_LEN bytes of the url, a link to
+// the overflow record holding the rest of the url, the title and the
+// snippet. An overflow record holds up to MAX_URL_LEN bytes and a link to
+// the next overflow record.
+func EncodeDocs(docs []Doc) []byte {
+	records := make([][]byte, len(docs))
+	overflow := make([][]byte, 0)
+
+	for i, d := range docs {
+		url := d.Url
+		head := url
+		if len(head) > MAX_URL_LEN {
+			head = url[:MAX_URL_LEN]
+		}
+
+		// Spill the rest of the url into a chain of overflow records
+		next := -1
+		if len(url) > MAX_URL_LEN {
+			next = len(overflow)
+			rest := url[MAX_URL_LEN:]
+			for len(rest) > 0 {
+				part := rest
+				if len(part) > MAX_URL_LEN {
+					part = rest[:MAX_URL_LEN]
+				}
+				rest = rest[len(part):]
+
+				link := -1
+				if len(rest) > 0 {
+					link = len(overflow) + 1
+				}
+				r := appendField(nil, part)
+				overflow = append(overflow, appendLink(r, link))
+			}
+		}
+
+		r := appendField(nil, head)
+		r = appendLink(r, next)
+		r = appendField(r, d.Title)
+		records[i] = appendField(r, d.Snippet)
+	}
+
+	b := binary.AppendUvarint(nil, uint64(len(records)))
+	b = binary.AppendUvarint(b, uint64(len(overflow)))
+
+	offset := uint32(0)
+	for _, r := range append(records, overflow...) {
+		b = binary.LittleEndian.AppendUint32(b, offset)
+		offset += uint32(len(r))
+	}
+
+	for _, r := range append(records, overflow...) {
+		b = append(b, r...)
+	}
+
+	return b
+}
+
+// Decodes the output of EncodeDocs, reassembling urls that were spilled to
+// overflow records.
+func DecodeDocs(b []byte) ([]Doc, error) {
+	numDocs, n1 := binary.Uvarint(b)
+	if n1 <= 0 {
+		return nil, errors.New("Truncated doc count")
+	}
+	numOverflow, n2 := binary.Uvarint(b[n1:])
+	if n2 <= 0 {
+		return nil, errors.New("Truncated overflow count")
+	}
+	b = b[n1+n2:]
+
+	// Each record takes at least 4 bytes of offset and 2 bytes of content
+	numRecords := numDocs + numOverflow
+	if numRecords > uint64(len(b))/6 {
+		return nil, errors.New("Record count too large")
+	}
+
+	offsets := make([]uint32, numRecords)
+	for i := range offsets {
+		offsets[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	b = b[4*numRecords:]
+
+	record := func(i int) ([]byte, error) {
+		if i < 0 || uint64(i) >= numRecords || uint64(offsets[i]) >= uint64(len(b)) {
+			return nil, errors.New("Bad record offset")
+		}
+		return b[offsets[i]:], nil
+	}
+
+	docs := make([]Doc, numDocs)
+	for i := range docs {
+		r, err := record(i)
+		if err != nil {
+			return nil, err
+		}
+
+		var next int
+		if docs[i].Url, r, err = readField(r); err != nil {
+			return nil, err
+		}
+		if next, r, err = readLink(r); err != nil {
+			return nil, err
+		}
+		if docs[i].Title, r, err = readField(r); err != nil {
+			return nil, err
+		}
+		if docs[i].Snippet, _, err = readField(r); err != nil {
+			return nil, err
+		}
+
+		for hops := uint64(0); next >= 0; hops++ {
+			if hops >= numOverflow {
+				return nil, errors.New("Overflow records form a cycle")
+			}
+			o, err := record(int(numDocs) + next)
+			if err != nil {
+				return nil, err
+			}
+
+			var part string
+			if part, o, err = readField(o); err != nil {
+				return nil, err
+			}
+			if next, _, err = readLink(o); err != nil {
+				return nil, err
+			}
+			docs[i].Url += part
+		}
+	}
+
+	return docs, nil
+}
@@ -0,0 +1,477 @@
+package corpus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"search/config"
+	"search/embeddings"
+	"search/utils"
+)
+
+const NPY_MAGIC = "\x93NUMPY"
+
+// Header of a .npy file, as written by numpy.save
+type npyHeader struct {
+	descr        string
+	fortranOrder bool
+	shape        []uint64
+}
+
+func (h *npyHeader) numElems() uint64 {
+	n := uint64(1)
+	for _, v := range h.shape {
+		n *= v
+	}
+	return n
+}
+
+// Size in bytes of a single element
+func (h *npyHeader) elemSize() int {
+	sz, err := strconv.Atoi(h.descr[2:])
+	if err != nil {
+		fmt.Println(h.descr)
+		panic("Unsupported npy dtype")
+	}
+	return sz
+}
+
+func readNpyHeader(r io.Reader) *npyHeader {
+	preamble := make([]byte, len(NPY_MAGIC)+2)
+	if _, err := io.ReadFull(r, preamble); err != nil {
+		fmt.Println(err)
+		panic("Error reading npy header")
+	}
+	if string(preamble[:len(NPY_MAGIC)]) != NPY_MAGIC {
+		panic("Not a npy file")
+	}
+
+	var headerLen uint32
+	switch major := preamble[len(NPY_MAGIC)]; major {
+	case 1:
+		var l uint16
+		if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+			panic("Error reading npy header")
+		}
+		headerLen = uint32(l)
+	case 2, 3:
+		if err := binary.Read(r, binary.LittleEndian, &headerLen); err != nil {
+			panic("Error reading npy header")
+		}
+	default:
+		fmt.Printf("npy version %d\n", major)
+		panic("Unsupported npy version")
+	}
+
+	buf := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		fmt.Println(err)
+		panic("Error reading npy header")
+	}
+
+	return parseNpyHeader(string(buf))
+}
+
+// Parses the python dict literal stored in the header, e.g.
+// {'descr': '<f4', 'fortran_order': False, 'shape': (1000, 192), }
+func parseNpyHeader(txt string) *npyHeader {
+	h := new(npyHeader)
+
+	descr := npyHeaderField(txt, "descr")
+	h.descr = strings.Trim(descr, "'\"")
+	if len(h.descr) < 3 {
+		fmt.Println(txt)
+		panic("Malformed npy header")
+	}
+	if h.descr[0] == '>' {
+		panic("Big-endian npy files are not supported")
+	}
+
+	h.fortranOrder = (npyHeaderField(txt, "fortran_order") == "True")
+
+	shape := npyHeaderField(txt, "shape")
+	shape = strings.Trim(shape, "()")
+	for _, v := range strings.Split(shape, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		dim, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			fmt.Println(txt)
+			panic("Malformed npy shape")
+		}
+		h.shape = append(h.shape, dim)
+	}
+
+	return h
+}
+
+func npyHeaderField(txt, key string) string {
+	i := strings.Index(txt, "'"+key+"'")
+	if i == -1 {
+		fmt.Println(txt)
+		panic("Missing field in npy header")
+	}
+	txt = strings.TrimSpace(txt[i+len(key)+2:])
+	txt = strings.TrimSpace(strings.TrimPrefix(txt, ":"))
+
+	if strings.HasPrefix(txt, "(") {
+		return txt[:strings.Index(txt, ")")+1]
+	}
+
+	end := strings.IndexAny(txt, ",}")
+	if end == -1 {
+		fmt.Println(txt)
+		panic("Malformed npy header")
+	}
+	return strings.TrimSpace(txt[:end])
+}
+
+// Reads the next element of an integer array as an int
+func readNpyInt(r io.Reader, h *npyHeader, buf []byte) int {
+	if _, err := io.ReadFull(r, buf); err != nil {
+		fmt.Println(err)
+		panic("Error reading npy data")
+	}
+
+	switch h.descr[1:] {
+	case "i1":
+		return int(int8(buf[0]))
+	case "u1":
+		return int(buf[0])
+	case "i2":
+		return int(int16(binary.LittleEndian.Uint16(buf)))
+	case "i4":
+		return int(int32(binary.LittleEndian.Uint32(buf)))
+	case "u4":
+		return int(binary.LittleEndian.Uint32(buf))
+	case "i8":
+		return int(int64(binary.LittleEndian.Uint64(buf)))
+	case "u8":
+		return int(binary.LittleEndian.Uint64(buf))
+	}
+
+	fmt.Println(h.descr)
+	panic("Unsupported npy dtype")
+}
+
+// Reads the next element of a float array
+func readNpyFloat(r io.Reader, h *npyHeader, buf []byte) float64 {
+	if _, err := io.ReadFull(r, buf); err != nil {
+		fmt.Println(err)
+		panic("Error reading npy data")
+	}
+
+	switch h.descr[1:] {
+	case "f4":
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(buf)))
+	case "f8":
+		return math.Float64frombits(binary.LittleEndian.Uint64(buf))
+	}
+
+	fmt.Println(h.descr)
+	panic("Unsupported npy dtype")
+}
+
+func (h *npyHeader) isFloat() bool {
+	return h.descr[1] == 'f'
+}
+
+// Reads a float array, such as the PCA components, in row order
+func ReadNpyFloats(file string) ([]uint64, []float64) {
+	f := utils.OpenFile(file)
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	h := readNpyHeader(r)
+	if h.fortranOrder || !h.isFloat() {
+		fmt.Printf("Failed on file %s\n", file)
+		panic("Expected a C-ordered float npy array")
+	}
+
+	vals := make([]float64, h.numElems())
+	buf := make([]byte, h.elemSize())
+	for i := range vals {
+		vals[i] = readNpyFloat(r, h, buf)
+	}
+	return h.shape, vals
+}
+
+// Float embeddings are quantized as embed_text.py quantizes queries: the
+// model output is scaled by 2^NPY_FLOAT_PREC and rounded, projected onto
+// the PCA components, then divided by NPY_PCA_DIVISOR, rounded and clipped
+// to the slot range. Rows projected already skip the first rounding.
+const (
+	NPY_FLOAT_PREC  = 5
+	NPY_PCA_DIVISOR = 10
+)
+
+// Reads the rows of an embeddings array, quantized to slotBits
+type npyRowReader struct {
+	h          *npyHeader
+	slotBits   uint64
+	components []float64 // width x slots, in row order; nil if rows are projected already
+	buf        []byte
+	vals       []float64
+	sums       []float64
+}
+
+func newNpyRowReader(h *npyHeader, file string, slots, slotBits uint64, conf *config.Config) *npyRowReader {
+	width := h.shape[1]
+	rr := &npyRowReader{h: h, slotBits: slotBits, buf: make([]byte, h.elemSize()),
+		vals: make([]float64, width), sums: make([]float64, slots)}
+	if width == slots {
+		return rr
+	}
+
+	// Rows straight from the model are projected here
+	if !h.isFloat() || !utils.FileExists(conf.PcaComponents()) {
+		fmt.Printf("Shape %v vs. %d slots\n", h.shape, slots)
+		fmt.Printf("Failed on file %s\n", file)
+		panic("Corpus embedding dimension does not match expected.")
+	}
+	shape, components := ReadNpyFloats(conf.PcaComponents())
+	if len(shape) != 2 || shape[0] != width || shape[1] != slots {
+		fmt.Printf("PCA components of shape %v vs. %d by %d\n", shape, width, slots)
+		panic("PCA components do not match the embeddings")
+	}
+	rr.components = components
+	return rr
+}
+
+// Bytes of a row, to skip it
+func (rr *npyRowReader) rowSize() int {
+	return len(rr.vals) * len(rr.buf)
+}
+
+func (rr *npyRowReader) read(r io.Reader, dst []int8) {
+	if !rr.h.isFloat() {
+		for i := range dst {
+			dst[i] = embeddings.Clamp(readNpyInt(r, rr.h, rr.buf), rr.slotBits)
+		}
+		return
+	}
+
+	for i := range rr.vals {
+		rr.vals[i] = readNpyFloat(r, rr.h, rr.buf)
+	}
+
+	// numpy rounds halves to even
+	scale := float64(int(1) << NPY_FLOAT_PREC)
+	if rr.components == nil {
+		for i := range dst {
+			dst[i] = clipSlot(math.RoundToEven(rr.vals[i]*scale/NPY_PCA_DIVISOR), rr.slotBits)
+		}
+		return
+	}
+
+	for j := range rr.sums {
+		rr.sums[j] = 0
+	}
+	slots := len(dst)
+	for i, v := range rr.vals {
+		v = math.RoundToEven(v * scale)
+		row := rr.components[i*slots : (i+1)*slots]
+		for j, c := range row {
+			rr.sums[j] += v * c
+		}
+	}
+	for j, sum := range rr.sums {
+		dst[j] = clipSlot(math.RoundToEven(sum/NPY_PCA_DIVISOR), rr.slotBits)
+	}
+}
+
+// Clips to [-2^(slotBits-1), 2^(slotBits-1)-1], as numpy.clip does in the
+// embedder
+func clipSlot(v float64, slotBits uint64) int8 {
+	max := float64(int(1)<<(slotBits-1)) - 1
+	return int8(math.Max(-max-1, math.Min(max, v)))
+}
+
+func ReadClusterAssignmentsNpy(file string) []uint {
+	f := utils.OpenFile(file)
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	h := readNpyHeader(r)
+	if len(h.shape) != 1 && !(len(h.shape) == 2 && h.shape[1] == 1) {
+		fmt.Println(h.shape)
+		panic("Cluster assignments should be a 1-D array")
+	}
+
+	assignments := make([]uint, h.numElems())
+	buf := make([]byte, h.elemSize())
+	for i := range assignments {
+		v := readNpyInt(r, h, buf)
+		if v < 0 {
+			fmt.Printf("Doc %d assigned to cluster %d\n", i, v)
+			panic("Negative cluster id")
+		}
+		assignments[i] = uint(v)
+	}
+
+	return assignments
+}
+
+// Reads the embeddings of clusters [clusterStart, clusterStop) of
+// conf.CLUSTER_IDS() directly from a 2-D .npy array (one row per doc), a
+// sidecar .npy array holding the cluster of each row, and the URL sidecar,
+// which gives the subcluster of each row. The docs of a cluster are laid out
+// by subcluster, then in row order, as ReadUrlsNpy lays out their urls.
+func ReadEmbeddingsNpy(clusterStart, clusterStop int, conf *config.Config) *Corpus {
+	c := new(Corpus)
+	c.params = Params{
+		NumDocs:        0,
+		EmbeddingSlots: conf.EMBEDDINGS_DIM(),
+		SlotBits:       config.SLOT_BITS(),
+	}
+	c.params.checkParams()
+	slots := c.params.EmbeddingSlots
+
+	ids := conf.ClusterIdsBetween(clusterStart, clusterStop)
+	pos := clusterPositions(ids)
+
+	assignments := ReadClusterAssignmentsNpy(conf.NpyClusterAssignments())
+	rows := make([]map[int][]int, len(ids))
+	readNpyUrls(conf, len(assignments), func(row, subcluster int, doc string) {
+		if i, ok := pos[assignments[row]]; ok {
+			if rows[i] == nil {
+				rows[i] = make(map[int][]int)
+			}
+			rows[i][subcluster] = append(rows[i][subcluster], row)
+		}
+	})
+
+	c.embeddingsClusterMap = make(map[uint]clusterSpan)
+	dst := make([]uint64, len(assignments))
+	at := uint64(0)
+	for i, bySubcluster := range rows {
+		start := at
+		for _, sc := range sortedSubclusters(bySubcluster) {
+			for _, row := range bySubcluster[sc] {
+				dst[row] = at
+				at += slots
+			}
+		}
+		c.embeddingsClusterMap[ids[i]] = clusterSpan{start: uint(start), end: uint(at)}
+		c.params.NumDocs += (at - start) / slots
+	}
+	c.embeddings = make([]int8, at)
+
+	file := conf.NpyEmbeddings()
+	f := utils.OpenFile(file)
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 1<<20)
+	h := readNpyHeader(r)
+	if h.fortranOrder {
+		panic("Fortran-ordered npy files are not supported")
+	}
+	if len(h.shape) != 2 {
+		fmt.Printf("Shape %v\n", h.shape)
+		fmt.Printf("Failed on file %s\n", file)
+		panic("Embeddings should be a 2-D array")
+	}
+	if h.shape[0] != uint64(len(assignments)) {
+		fmt.Printf("%d embeddings vs. %d cluster assignments\n", h.shape[0], len(assignments))
+		panic("Cluster assignments do not match embeddings")
+	}
+	rr := newNpyRowReader(h, file, slots, c.params.SlotBits, conf)
+
+	for row, cluster := range assignments {
+		if _, ok := pos[cluster]; !ok {
+			if _, err := r.Discard(rr.rowSize()); err != nil {
+				fmt.Println(err)
+				panic("Error reading npy data")
+			}
+			continue
+		}
+
+		rr.read(r, c.embeddings[dst[row]:dst[row]+slots])
+
+		if row%1000000 == 0 {
+			fmt.Printf("Read row %d of %d\n", row, len(assignments))
+		}
+	}
+
+	fmt.Printf("Read %d docs\n", c.params.NumDocs)
+	return c
+}
+
+// Reads the urls of clusters [clusterStart, clusterStop) of
+// conf.CLUSTER_IDS() from the URL sidecar of a .npy corpus
+func ReadUrlsNpy(clusterStart, clusterStop int, conf *config.Config) *Corpus {
+	c := new(Corpus)
+	c.params = Params{
+		NumDocs: 0,
+	}
+	c.params.checkParams()
+	c.setUrlCodec(conf)
+
+	c.urls = make([][]byte, 0)
+	c.urlClusterMap = make(map[uint][]Subcluster)
+
+	ids := conf.ClusterIdsBetween(clusterStart, clusterStop)
+	pos := clusterPositions(ids)
+
+	assignments := ReadClusterAssignmentsNpy(conf.NpyClusterAssignments())
+	byCluster := make([]map[int][]Doc, len(ids))
+	readNpyUrls(conf, len(assignments), func(row, subcluster int, doc string) {
+		if i, ok := pos[assignments[row]]; ok {
+			if byCluster[i] == nil {
+				byCluster[i] = make(map[int][]Doc)
+			}
+			byCluster[i][subcluster] = append(byCluster[i][subcluster], parseDocFields(doc))
+		}
+	})
+
+	c.addUrlSubclusters(ids, byCluster)
+	c.finishUrls()
+
+	fmt.Printf("Read %d docs\n", c.params.NumDocs)
+	return c
+}
+
+// Calls fn on each line of the URL sidecar of a .npy corpus, which holds
+// "subcluster | url | title | snippet" for each row of the embeddings
+// array, in row order
+func readNpyUrls(conf *config.Config, rows int, fn func(row, subcluster int, doc string)) {
+	file := conf.NpyUrls()
+	if !utils.FileExists(file) {
+		fmt.Printf("No URL sidecar at %s\n", file)
+		panic("npy corpora need the urls of their rows")
+	}
+	f := utils.OpenFile(file)
+	defer f.Close()
+
+	scanner := newTxtScanner(f)
+	row := 0
+	for scanner.Scan() {
+		txt := scanner.Text()
+		fields := strings.SplitN(txt, DOC_FIELD_DELIM, 2)
+		subcluster, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil || len(fields) != 2 || row >= rows {
+			fmt.Println(txt)
+			fmt.Printf("Failed on line %d of file %s\n", row+1, file)
+			panic("Malformed URL sidecar")
+		}
+		fn(row, subcluster, fields[1])
+		row += 1
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Println(err)
+		fmt.Println(file)
+		panic("Error reading")
+	}
+	if row != rows {
+		fmt.Printf("%d urls vs. %d embeddings\n", row, rows)
+		panic("URL sidecar does not match embeddings")
+	}
+}
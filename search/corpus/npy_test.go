@@ -0,0 +1,141 @@
+package corpus_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"search/config"
+	"search/corpus"
+	"search/corpus/corpustest"
+)
+
+// Writes a C-ordered float32 or int64 array as numpy.save does
+func writeNpy(t *testing.T, file, descr string, shape []int, vals []float64) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dims := fmt.Sprint(shape[0]) + ","
+	if len(shape) == 2 {
+		dims = fmt.Sprintf("%d, %d", shape[0], shape[1])
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }\n", descr, dims)
+
+	buf := append([]byte(corpus.NPY_MAGIC), 1, 0)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(header)))
+	buf = append(buf, header...)
+	for _, v := range vals {
+		if descr == "<f4" {
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v)))
+		} else {
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(int64(v)))
+		}
+	}
+	if err := os.WriteFile(file, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type npyDoc struct {
+	cluster, subcluster int
+	doc                 corpus.Doc
+	emb                 []int8
+}
+
+// Writes the docs of syn as a .npy corpus in shuffled row order, with
+// float rows that quantize back to their embeddings. With raw set, rows
+// are as wide as twice the embeddings, and projected by the PCA components.
+func writeShuffledNpy(t *testing.T, syn *corpus.Synthetic, conf *config.Config, raw bool) {
+	docs := make([]npyDoc, 0)
+	for _, cluster := range syn.ClusterIds() {
+		for sc, subcluster := range syn.Cluster(cluster) {
+			for _, d := range subcluster {
+				docs = append(docs, npyDoc{int(cluster), sc, d.Doc, d.Emb})
+			}
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	rng.Shuffle(len(docs), func(i, j int) { docs[i], docs[j] = docs[j], docs[i] })
+
+	slots := int(syn.Spec.Dim)
+	width := slots
+	if raw {
+		width = 2 * slots
+		components := make([]float64, width*slots)
+		for j := 0; j < slots; j++ {
+			components[j*slots+j] = corpus.NPY_PCA_DIVISOR
+		}
+		writeNpy(t, conf.PcaComponents(), "<f4", []int{width, slots}, components)
+	}
+
+	vals := make([]float64, 0, len(docs)*width)
+	assignments := make([]float64, len(docs))
+	if err := os.MkdirAll(filepath.Dir(conf.NpyUrls()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	urls, err := os.Create(conf.NpyUrls())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer urls.Close()
+	for i, d := range docs {
+		for _, v := range d.emb {
+			if raw {
+				vals = append(vals, float64(v)/(1<<corpus.NPY_FLOAT_PREC))
+			} else {
+				vals = append(vals, float64(v)*corpus.NPY_PCA_DIVISOR/(1<<corpus.NPY_FLOAT_PREC))
+			}
+		}
+		for j := slots; j < width; j++ {
+			vals = append(vals, rng.NormFloat64())
+		}
+		assignments[i] = float64(d.cluster)
+		fmt.Fprintf(urls, "%d | %s | %s | %s\n", d.subcluster, d.doc.Url, d.doc.Title, d.doc.Snippet)
+	}
+	writeNpy(t, conf.NpyEmbeddings(), "<f4", []int{len(docs), width}, vals)
+	writeNpy(t, conf.NpyClusterAssignments(), "<i8", []int{len(docs)}, assignments)
+}
+
+// The i-th embedding of a cluster belongs to its i-th URL, however the rows
+// of the .npy corpus are ordered, and float rows quantize as queries do
+func TestNpyUnsortedRows(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		f := corpustest.Small(t)
+		writeShuffledNpy(t, f.Synthetic, f.Conf, raw)
+		f.Conf.SetCorpusFormat(config.CORPUS_FORMAT_NPY)
+
+		emb := corpus.ReadEmbeddings(0, f.Conf.NUM_CLUSTERS(), f.Conf)
+		urls := corpus.ReadUrls(0, f.Conf.NUM_CLUSTERS(), f.Conf)
+		if emb.GetNumDocs() != f.Synthetic.NumDocs() {
+			t.Fatalf("read %d docs, want %d", emb.GetNumDocs(), f.Synthetic.NumDocs())
+		}
+
+		embOf := make(map[string][]int8)
+		for _, cluster := range f.Synthetic.ClusterIds() {
+			for _, docs := range f.Synthetic.Cluster(cluster) {
+				for _, d := range docs {
+					embOf[d.Doc.Url] = d.Emb
+				}
+			}
+		}
+
+		slots := emb.GetEmbeddingSlots()
+		for _, cluster := range emb.Clusters() {
+			docs := urls.GetUrlsInCluster(uint64(cluster))
+			if uint64(len(docs)) != emb.NumDocsInCluster(cluster) {
+				t.Fatalf("cluster %d: %d urls, %d embeddings", cluster, len(docs), emb.NumDocsInCluster(cluster))
+			}
+			for j, d := range docs {
+				got := emb.GetEmbedding(uint64(emb.ClusterToIndex(cluster)) + uint64(j)*slots)
+				if !reflect.DeepEqual(got, embOf[d.Url]) {
+					t.Fatalf("raw %v, cluster %d, doc %d: %v, want the embedding %v of %s", raw, cluster, j, got, embOf[d.Url], d.Url)
+				}
+			}
+		}
+	}
+}
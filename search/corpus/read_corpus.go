@@ -1,7 +1,6 @@
 package corpus
 
 import (
-	"bufio"
 	"fmt"
 	"strconv"
 	"strings"
@@ -17,6 +16,38 @@ func (p *Params) checkParams() {
 	}
 }
 
+// Reads the embeddings in the format selected by conf. If none is selected,
+// reads from .npy files if they exist, and from the per-cluster text files
+// otherwise.
+func ReadEmbeddings(clusterStart, clusterStop int, conf *config.Config) *Corpus {
+	switch conf.CORPUS_FORMAT() {
+	case config.CORPUS_FORMAT_TXT:
+		return ReadEmbeddingsTxt(clusterStart, clusterStop, conf)
+	case config.CORPUS_FORMAT_NPY:
+		return ReadEmbeddingsNpy(clusterStart, clusterStop, conf)
+	case config.CORPUS_FORMAT_CSV:
+		return ReadEmbeddingsCsv(clusterStart, clusterStop, conf)
+	}
+
+	if utils.FileExists(conf.NpyEmbeddings()) {
+		return ReadEmbeddingsNpy(clusterStart, clusterStop, conf)
+	}
+	return ReadEmbeddingsTxt(clusterStart, clusterStop, conf)
+}
+
+// Cluster files may be missing, e.g. for clusters that were dropped, in
+// which case the cluster is left out of the corpus.
+func clusterTxtExists(cluster uint, conf *config.Config) bool {
+	file := conf.TxtCorpus(int(cluster))
+	if !utils.FileExists(file) {
+		fmt.Printf("Skipping cluster %d: %s does not exist\n", cluster, file)
+		return false
+	}
+	return true
+}
+
+// Reads the embeddings of clusters [clusterStart, clusterStop) of
+// conf.CLUSTER_IDS() from the per-cluster text files.
 func ReadEmbeddingsTxt(clusterStart, clusterStop int, conf *config.Config) *Corpus {
 	c := new(Corpus)
 	c.params = Params{
@@ -27,111 +58,162 @@ func ReadEmbeddingsTxt(clusterStart, clusterStop int, conf *config.Config) *Corp
 	c.params.checkParams()
 
 	c.embeddings = make([]int8, 0)
-	c.embeddingsClusterMap = make(map[uint]uint)
+	c.embeddingsClusterMap = make(map[uint]clusterSpan)
+
+	d := newDeduper(conf)
+	for _, cluster := range conf.ClusterIdsBetween(clusterStart, clusterStop) {
+		if !clusterTxtExists(cluster, conf) {
+			continue
+		}
 
-	if clusterStop > conf.TOTAL_NUM_CLUSTERS() {
-		clusterStop = conf.TOTAL_NUM_CLUSTERS()
+		embs := c.readEmbeddingsClusterTxt(cluster, conf.TxtCorpus(int(cluster)), d)
+		c.addEmbeddingsCluster(cluster, embs)
+		c.params.NumDocs += uint64(len(embs)) / c.params.EmbeddingSlots
+	}
+	d.print()
+	fmt.Printf("Read %d docs\n", c.params.NumDocs)
+	if uint64(len(c.embeddings)) != c.params.NumDocs*c.params.EmbeddingSlots {
+		panic("Should not happen!")
 	}
 
-	c.maxClusterId = uint(clusterStop - 1)
+	return c
+}
 
-	for cluster := clusterStart; cluster < clusterStop; cluster++ {
-		c.embeddingsClusterMap[uint(cluster)] = uint(len(c.embeddings))
+func (c *Corpus) readEmbeddingsClusterTxt(cluster uint, file string, d *Deduper) []int8 {
+	f := utils.OpenFile(file)
+	defer f.Close()
+
+	embs := make([]int8, 0)
+	scanner := newTxtScanner(f)
+	line := 0
+
+	for scanner.Scan() {
+		line += 1
+		txt := scanner.Text()
+		if len(txt) == 0 {
+			continue
+		} else if txt == SUBCLUSTER_DELIM { // 忽略嵌入步骤中的 URL 子群
+			continue
+		}
 
-		file := conf.TxtCorpus(cluster)
-		f := utils.OpenFile(file)
-		defer f.Close()
+		emb := parseEmbeddingLineTxt(txt, file, c.params.EmbeddingSlots, c.params.SlotBits)
 
-		scanner := bufio.NewScanner(f)
+		url := ""
+		if d.needsUrls() {
+			url = parseDocTxt(txt).Url
+		}
+		if !d.keep(cluster, line, url, emb) {
+			continue
+		}
 
-		for scanner.Scan() {
-			txt := scanner.Text()
-			if len(txt) == 0 {
-				continue
-			} else if txt == SUBCLUSTER_DELIM { // 忽略嵌入步骤中的 URL 子群
-				continue
-			}
+		embs = append(embs, emb...)
+	}
 
-			vals := parseEmbeddingsTxt(txt)
-			if len(vals) != int(c.params.EmbeddingSlots) {
-				fmt.Println(txt)
-				fmt.Printf("%d vs. %d\n", len(vals), c.params.EmbeddingSlots)
-				fmt.Printf("Failed on file %s\n", file)
-				panic("Corpus embedding dimension does not match expected.")
-			}
+	if err := scanner.Err(); err != nil {
+		fmt.Println(err)
+		fmt.Println(file)
+		panic("Error reading")
+	}
 
-			emb := make([]int8, c.params.EmbeddingSlots)
-			for i := uint64(0); i < c.params.EmbeddingSlots; i++ {
-				u, err := strconv.Atoi(vals[i])
-				if err != nil {
-					fmt.Println(vals[i])
-					fmt.Println(u)
-					fmt.Println(err)
-					panic("Error parsing corpus emebddings")
-				}
-				emb[i] = embeddings.Clamp(int(u), c.params.SlotBits)
-			}
+	return embs
+}
 
-			c.embeddings = append(c.embeddings, emb...)
-			c.params.NumDocs += 1
-		}
+func parseEmbeddingLineTxt(txt, file string, slots, slotBits uint64) []int8 {
+	vals := parseEmbeddingsTxt(txt)
+	if len(vals) != int(slots) {
+		fmt.Println(txt)
+		fmt.Printf("%d vs. %d\n", len(vals), slots)
+		fmt.Printf("Failed on file %s\n", file)
+		panic("Corpus embedding dimension does not match expected.")
+	}
 
-		if err := scanner.Err(); err != nil {
+	return parseEmbeddingVals(vals, slotBits)
+}
+
+func parseEmbeddingVals(vals []string, slotBits uint64) []int8 {
+	emb := make([]int8, len(vals))
+	for i, v := range vals {
+		u, err := parseEmbeddingVal(v)
+		if err != nil {
+			fmt.Println(v)
 			fmt.Println(err)
-			fmt.Println(file)
-			panic("Error reading")
+			panic("Error parsing corpus emebddings")
 		}
+		emb[i] = embeddings.Clamp(u, slotBits)
 	}
-	fmt.Printf("Read %d docs\n", c.params.NumDocs)
-	if uint64(len(c.embeddings)) != c.params.NumDocs*c.params.EmbeddingSlots {
-		panic("Should not happen!")
+	return emb
+}
+
+// Parses one value of an embedding, before it is clamped
+func parseEmbeddingVal(v string) (int, error) {
+	return strconv.Atoi(strings.TrimSpace(v))
+}
+
+// Reads the urls in the format selected by conf, or else in the format
+// that ReadEmbeddings picks
+func ReadUrls(clusterStart, clusterStop int, conf *config.Config) *Corpus {
+	switch conf.CORPUS_FORMAT() {
+	case config.CORPUS_FORMAT_TXT:
+		return ReadUrlsTxt(clusterStart, clusterStop, conf)
+	case config.CORPUS_FORMAT_NPY:
+		return ReadUrlsNpy(clusterStart, clusterStop, conf)
+	case config.CORPUS_FORMAT_CSV:
+		return ReadUrlsCsv(clusterStart, clusterStop, conf)
 	}
 
-	return c
+	if utils.FileExists(conf.NpyEmbeddings()) {
+		return ReadUrlsNpy(clusterStart, clusterStop, conf)
+	}
+	return ReadUrlsTxt(clusterStart, clusterStop, conf)
 }
 
 func ReadUrlsTxt(clusterStart, clusterStop int, conf *config.Config) *Corpus {
 	c := new(Corpus)
 	c.params = Params{
-		NumDocs:     0,
-		CompressUrl: true,
+		NumDocs: 0,
 	}
 	c.params.checkParams()
+	c.setUrlCodec(conf)
 
 	c.urls = make([][]byte, 0)
 	c.urlClusterMap = make(map[uint][]Subcluster)
 
-	if clusterStop > conf.TOTAL_NUM_CLUSTERS() {
-		clusterStop = conf.TOTAL_NUM_CLUSTERS()
-	}
-
-	c.maxClusterId = uint(clusterStop - 1)
+	d := newDeduper(conf)
+	for i, cluster := range conf.ClusterIdsBetween(clusterStart, clusterStop) {
+		if !clusterTxtExists(cluster, conf) {
+			continue
+		}
 
-	for cluster := clusterStart; cluster < clusterStop; cluster++ {
-		file := conf.TxtCorpus(cluster)
+		file := conf.TxtCorpus(int(cluster))
 		f := utils.OpenFile(file)
 		defer f.Close()
 
-		scanner := bufio.NewScanner(f)
+		scanner := newTxtScanner(f)
 
-		urls := make([][]string, 1)
-		urls[0] = make([]string, 0)
+		urls := make([][]Doc, 1)
+		urls[0] = make([]Doc, 0)
 		subclusterNum := 0
+		line := 0
 
 		for scanner.Scan() {
+			line += 1
 			txt := scanner.Text()
 
 			if len(txt) == 0 {
 				continue
 			} else if txt == SUBCLUSTER_DELIM {
 				subclusterNum += 1
-				urls = append(urls, []string{})
+				urls = append(urls, []Doc{})
 			} else {
-				url := parseUrlTxt(txt)
-				if len(url) > MAX_URL_LEN {
-					url = "0000"
+				doc := parseDocTxt(txt)
+
+				var emb []int8
+				if d.needsEmbeddings() {
+					emb = parseEmbeddingLineTxt(txt, file, conf.EMBEDDINGS_DIM(), config.SLOT_BITS())
+				}
+				if d.keep(cluster, line, doc.Url, emb) {
+					urls[subclusterNum] = append(urls[subclusterNum], doc)
 				}
-				urls[subclusterNum] = append(urls[subclusterNum], url)
 			}
 		}
 
@@ -145,50 +227,153 @@ func ReadUrlsTxt(clusterStart, clusterStop int, conf *config.Config) *Corpus {
 			urls = urls[:subclusterNum]
 		}
 
-		ch := make(chan bool)
-		compressed := make([][]byte, len(urls))
-		lengths := make([]uint64, len(urls))
-		for sc := 0; sc < len(urls); sc++ {
-			go func(i int) {
-				lengths[i] = uint64(len(urls[i]))
-				txt := strings.Join(urls[i], URL_DELIM)
-				compressed[i] = Compress(txt)
-				ch <- true
-			}(sc)
+		c.addUrlCluster(cluster, urls)
+
+		if i%100 == 0 {
+			fmt.Printf("Finished cluster %d\n", cluster)
 		}
+	}
 
-		utils.ReadFromChannel(ch, len(urls), false)
+	c.finishUrls()
+	d.print()
+	fmt.Printf("Read %d docs\n", c.params.NumDocs)
+	return c
+}
 
-		if _, ok := c.urlClusterMap[uint(cluster)]; ok {
-			panic("Key should not exist.")
+// Maps the id at the start of each line of the per-cluster text files to
+// the url of the doc, to match judgments keyed by doc id with results.
+func ReadDocUrlsTxt(conf *config.Config) map[string]string {
+	docUrls := make(map[string]string)
+	for _, cluster := range conf.CLUSTER_IDS() {
+		if !clusterTxtExists(cluster, conf) {
+			continue
 		}
-		c.urlClusterMap[uint(cluster)] = make([]Subcluster, len(urls))
 
-		for sc := 0; sc < len(urls); sc++ {
-			compressed := compressed[sc]
-			num := lengths[sc]
-
-			l := uint64(len(c.urls))
-			c.urls = append(c.urls, compressed)
-			c.params.NumDocs += num
+		file := conf.TxtCorpus(int(cluster))
+		f := utils.OpenFile(file)
+		scanner := newTxtScanner(f)
 
-			chunk := Subcluster{
-				index: l,
-				size:  num,
+		for scanner.Scan() {
+			txt := scanner.Text()
+			if len(txt) == 0 || txt == SUBCLUSTER_DELIM {
+				continue
 			}
-			c.urlClusterMap[uint(cluster)][sc] = chunk
 
-			length := uint64(len(compressed))
-			if length > c.params.UrlBytes {
-				c.params.UrlBytes = length
+			i1, _ := parseDelimitersTxt(txt)
+			docUrls[strings.TrimSpace(txt[:i1])] = parseDocTxt(txt).Url
+		}
+
+		if err := scanner.Err(); err != nil {
+			fmt.Println(err)
+			fmt.Println(file)
+			panic("Error reading file")
+		}
+		f.Close()
+	}
+
+	fmt.Printf("Read the ids of %d docs\n", len(docUrls))
+	return docUrls
+}
+
+// Sets up compression of the urls with the codec selected by conf
+func (c *Corpus) setUrlCodec(conf *config.Config) {
+	c.params.UrlCodec = conf.URL_CODEC()
+	c.params.CompressUrl = (c.params.UrlCodec != config.URL_CODEC_NONE)
+	c.urlDictSz = conf.URL_DICT_SZ()
+	c.urlDictSamples = conf.URL_DICT_SAMPLES()
+
+	// With a shared dictionary, the first subclusters are stored
+	// uncompressed until there are enough of them to train on.
+	c.trainingDict = (c.params.UrlCodec == config.URL_CODEC_ZSTD_DICT)
+	if !c.trainingDict {
+		c.urlCompressor = c.params.UrlCompressor(nil)
+	}
+}
+
+// Encodes each subcluster of docs and appends it to the corpus
+func (c *Corpus) addUrlCluster(cluster uint, urls [][]Doc) {
+	ch := make(chan bool)
+	stored := make([][]byte, len(urls))
+	lengths := make([]uint64, len(urls))
+	for sc := 0; sc < len(urls); sc++ {
+		go func(i int) {
+			lengths[i] = uint64(len(urls[i]))
+			if c.trainingDict {
+				stored[i] = EncodeDocs(urls[i])
+			} else {
+				stored[i] = EncodeSubcluster(urls[i], c.urlCompressor)
 			}
+			ch <- true
+		}(sc)
+	}
+
+	utils.ReadFromChannel(ch, len(urls), false)
+
+	if _, ok := c.urlClusterMap[cluster]; ok {
+		panic("Key should not exist.")
+	}
+	c.urlClusterMap[cluster] = make([]Subcluster, len(urls))
+
+	for sc := 0; sc < len(urls); sc++ {
+		l := uint64(len(c.urls))
+		c.urls = append(c.urls, stored[sc])
+		c.params.NumDocs += lengths[sc]
+
+		chunk := Subcluster{
+			index: l,
+			size:  lengths[sc],
 		}
+		c.urlClusterMap[cluster][sc] = chunk
 
-		if cluster%100 == 0 {
-			fmt.Printf("Finished cluster %d\n", cluster)
+		if c.trainingDict {
+			c.pendingUrls = append(c.pendingUrls, l)
+		} else {
+			c.updateUrlBytes(l)
 		}
 	}
 
-	fmt.Printf("Read %d docs\n", c.params.NumDocs)
-	return c
+	if c.trainingDict && len(c.pendingUrls) >= c.urlDictSamples {
+		c.trainUrlDict()
+	}
+}
+
+func (c *Corpus) updateUrlBytes(index uint64) {
+	length := uint64(len(c.urls[index]))
+	if length > c.params.UrlBytes {
+		c.params.UrlBytes = length
+	}
+}
+
+// Trains the shared dictionary on the pending subclusters, then compresses
+// them with it.
+func (c *Corpus) trainUrlDict() {
+	samples := make([][]byte, len(c.pendingUrls))
+	for i, index := range c.pendingUrls {
+		samples[i] = c.urls[index]
+	}
+
+	c.urlDict = TrainDict(samples, c.urlDictSz)
+	c.urlCompressor = c.params.UrlCompressor(c.urlDict)
+	c.trainingDict = false
+
+	ch := make(chan bool)
+	for _, index := range c.pendingUrls {
+		go func(i uint64) {
+			c.urls[i] = FrameRecord(c.urlCompressor.Compress(c.urls[i]))
+			ch <- true
+		}(index)
+	}
+	utils.ReadFromChannel(ch, len(c.pendingUrls), false)
+
+	for _, index := range c.pendingUrls {
+		c.updateUrlBytes(index)
+	}
+	c.pendingUrls = nil
+}
+
+// Must be called once all urls have been added
+func (c *Corpus) finishUrls() {
+	if c.trainingDict {
+		c.trainUrlDict()
+	}
 }
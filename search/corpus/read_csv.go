@@ -0,0 +1,195 @@
+package corpus
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"search/config"
+	"search/utils"
+)
+
+// Column layout of each row following the CSV header:
+//
+//	cluster, subcluster, url, title, snippet, slot_0, ..., slot_{EmbeddingSlots-1}
+const (
+	CSV_CLUSTER_COL    = 0
+	CSV_SUBCLUSTER_COL = 1
+	CSV_URL_COL        = 2
+	CSV_TITLE_COL      = 3
+	CSV_SNIPPET_COL    = 4
+	CSV_EMB_COL        = 5
+)
+
+// Reads every row of the CSV corpus, checking the header against conf,
+// and calls fn on each doc, along with the line of the file it starts on.
+func readCsvCorpus(conf *config.Config, fn func(line, cluster, subcluster int, doc Doc, emb []string)) {
+	file := conf.CsvCorpus()
+	f := utils.OpenFile(file)
+	defer f.Close()
+
+	reader, numDocs, embeddingSlots, slotBits := parseCsvHeader(f)
+	if embeddingSlots != conf.EMBEDDINGS_DIM() {
+		fmt.Printf("%d vs. %d\n", embeddingSlots, conf.EMBEDDINGS_DIM())
+		fmt.Printf("Failed on file %s\n", file)
+		panic("Corpus embedding dimension does not match expected.")
+	}
+	if slotBits != config.SLOT_BITS() {
+		fmt.Printf("%d vs. %d\n", slotBits, config.SLOT_BITS())
+		fmt.Printf("Failed on file %s\n", file)
+		panic("Corpus slot bits do not match expected.")
+	}
+
+	reader.FieldsPerRecord = CSV_EMB_COL + int(embeddingSlots)
+	reader.ReuseRecord = true
+
+	rows := uint64(0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Println(err)
+			fmt.Println(file)
+			panic("Error reading CSV corpus")
+		}
+
+		cluster, err1 := strconv.Atoi(record[CSV_CLUSTER_COL])
+		subcluster, err2 := strconv.Atoi(record[CSV_SUBCLUSTER_COL])
+		if (err1 != nil) || (err2 != nil) || (cluster < 0) || (subcluster < 0) {
+			fmt.Println(record[:CSV_URL_COL])
+			panic("Error parsing CSV cluster columns")
+		}
+
+		doc := NewDoc(strings.TrimSpace(record[CSV_URL_COL]),
+			strings.TrimSpace(record[CSV_TITLE_COL]),
+			strings.TrimSpace(record[CSV_SNIPPET_COL]))
+		line, _ := reader.FieldPos(0)
+		fn(line, cluster, subcluster, doc, record[CSV_EMB_COL:])
+		rows += 1
+	}
+
+	if rows != numDocs {
+		fmt.Printf("Header says %d docs; read %d\n", numDocs, rows)
+		panic("CSV corpus does not match its header")
+	}
+}
+
+func ReadEmbeddingsCsv(clusterStart, clusterStop int, conf *config.Config) *Corpus {
+	c := new(Corpus)
+	c.params = Params{
+		NumDocs:        0,
+		EmbeddingSlots: conf.EMBEDDINGS_DIM(),
+		SlotBits:       config.SLOT_BITS(),
+	}
+	c.params.checkParams()
+
+	ids := conf.ClusterIdsBetween(clusterStart, clusterStop)
+	pos := clusterPositions(ids)
+
+	// Rows need not be grouped by cluster or subcluster, so embeddings are
+	// laid out by subcluster, in the order of the docs that ReadUrlsCsv reads
+	d := newDeduper(conf)
+	byCluster := make([]map[int][]int8, len(ids))
+	readCsvCorpus(conf, func(line, cluster, subcluster int, doc Doc, vals []string) {
+		i, ok := pos[uint(cluster)]
+		if !ok {
+			return
+		}
+
+		emb := parseEmbeddingVals(vals, c.params.SlotBits)
+		if !d.keep(uint(cluster), line, doc.Url, emb) {
+			return
+		}
+		if byCluster[i] == nil {
+			byCluster[i] = make(map[int][]int8)
+		}
+		byCluster[i][subcluster] = append(byCluster[i][subcluster], emb...)
+		c.params.NumDocs += 1
+	})
+	d.print()
+
+	c.embeddings = make([]int8, 0, c.params.NumDocs*c.params.EmbeddingSlots)
+	c.embeddingsClusterMap = make(map[uint]clusterSpan)
+	for i, subclusters := range byCluster {
+		embs := make([]int8, 0)
+		for _, sc := range sortedSubclusters(subclusters) {
+			embs = append(embs, subclusters[sc]...)
+		}
+		c.addEmbeddingsCluster(ids[i], embs)
+	}
+
+	fmt.Printf("Read %d docs\n", c.params.NumDocs)
+	if uint64(len(c.embeddings)) != c.params.NumDocs*c.params.EmbeddingSlots {
+		panic("Should not happen!")
+	}
+
+	return c
+}
+
+func ReadUrlsCsv(clusterStart, clusterStop int, conf *config.Config) *Corpus {
+	c := new(Corpus)
+	c.params = Params{
+		NumDocs: 0,
+	}
+	c.params.checkParams()
+	c.setUrlCodec(conf)
+
+	c.urls = make([][]byte, 0)
+	c.urlClusterMap = make(map[uint][]Subcluster)
+
+	clusterIds := conf.ClusterIdsBetween(clusterStart, clusterStop)
+	pos := clusterPositions(clusterIds)
+
+	d := newDeduper(conf)
+	byCluster := make([]map[int][]Doc, len(clusterIds))
+	readCsvCorpus(conf, func(line, cluster, subcluster int, doc Doc, vals []string) {
+		i, ok := pos[uint(cluster)]
+		if !ok {
+			return
+		}
+
+		var emb []int8
+		if d.needsEmbeddings() {
+			emb = parseEmbeddingVals(vals, config.SLOT_BITS())
+		}
+		if !d.keep(uint(cluster), line, doc.Url, emb) {
+			return
+		}
+
+		if byCluster[i] == nil {
+			byCluster[i] = make(map[int][]Doc)
+		}
+		byCluster[i][subcluster] = append(byCluster[i][subcluster], doc)
+	})
+
+	c.addUrlSubclusters(clusterIds, byCluster)
+	c.finishUrls()
+	d.print()
+
+	fmt.Printf("Read %d docs\n", c.params.NumDocs)
+	return c
+}
+
+// Adds the urls of each of clusterIds, by subcluster in order of their ids
+func (c *Corpus) addUrlSubclusters(clusterIds []uint, byCluster []map[int][]Doc) {
+	for i, subclusters := range byCluster {
+		ids := sortedSubclusters(subclusters)
+		urls := make([][]Doc, len(ids))
+		for j, sc := range ids {
+			urls[j] = subclusters[sc]
+		}
+		c.addUrlCluster(clusterIds[i], urls)
+	}
+}
+
+func sortedSubclusters[T any](subclusters map[int][]T) []int {
+	ids := make([]int, 0, len(subclusters))
+	for sc := range subclusters {
+		ids = append(ids, sc)
+	}
+	sort.Ints(ids)
+	return ids
+}
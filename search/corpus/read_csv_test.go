@@ -0,0 +1,80 @@
+package corpus_test
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"search/config"
+	"search/corpus"
+	"search/corpus/corpustest"
+)
+
+// Writes the docs of syn as a CSV corpus, in shuffled row order
+func writeShuffledCsv(t *testing.T, syn *corpus.Synthetic, conf *config.Config) {
+	rows := make([][]string, 0)
+	for _, cluster := range syn.ClusterIds() {
+		for sc, docs := range syn.Cluster(cluster) {
+			for _, d := range docs {
+				row := []string{fmt.Sprint(cluster), fmt.Sprint(sc), d.Doc.Url, d.Doc.Title, d.Doc.Snippet}
+				for _, v := range d.Emb {
+					row = append(row, strconv.Itoa(int(v)))
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(rows), func(i, j int) { rows[i], rows[j] = rows[j], rows[i] })
+
+	f, err := os.Create(conf.CsvCorpus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%d\n%d\n%d\n", len(rows), syn.Spec.Dim, syn.Spec.SlotBits)
+	w := csv.NewWriter(f)
+	if err := w.WriteAll(rows); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The i-th embedding of a cluster belongs to its i-th URL, however the rows
+// of the CSV corpus are ordered
+func TestCsvUnsortedRows(t *testing.T) {
+	f := corpustest.Small(t)
+	writeShuffledCsv(t, f.Synthetic, f.Conf)
+	f.Conf.SetCorpusFormat(config.CORPUS_FORMAT_CSV)
+
+	emb := corpus.ReadEmbeddingsCsv(0, f.Conf.NUM_CLUSTERS(), f.Conf)
+	urls := corpus.ReadUrlsCsv(0, f.Conf.NUM_CLUSTERS(), f.Conf)
+	if emb.GetNumDocs() != f.Synthetic.NumDocs() {
+		t.Fatalf("read %d docs, want %d", emb.GetNumDocs(), f.Synthetic.NumDocs())
+	}
+
+	embOf := make(map[string][]int8)
+	for _, cluster := range f.Synthetic.ClusterIds() {
+		for _, docs := range f.Synthetic.Cluster(cluster) {
+			for _, d := range docs {
+				embOf[d.Doc.Url] = d.Emb
+			}
+		}
+	}
+
+	slots := emb.GetEmbeddingSlots()
+	for _, cluster := range emb.Clusters() {
+		docs := urls.GetUrlsInCluster(uint64(cluster))
+		if uint64(len(docs)) != emb.NumDocsInCluster(cluster) {
+			t.Fatalf("cluster %d: %d urls, %d embeddings", cluster, len(docs), emb.NumDocsInCluster(cluster))
+		}
+		for j, d := range docs {
+			got := emb.GetEmbedding(uint64(emb.ClusterToIndex(cluster)) + uint64(j)*slots)
+			if !reflect.DeepEqual(got, embOf[d.Url]) {
+				t.Fatalf("cluster %d, doc %d: embedding of another doc than %s", cluster, j, d.Url)
+			}
+		}
+	}
+}
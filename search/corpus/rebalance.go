@@ -0,0 +1,376 @@
+package corpus
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"search/config"
+	"search/utils"
+)
+
+const REBALANCE_KMEANS_ITERS = 10
+
+// A line of a per-cluster text file. Subclusters are numbered across all
+// clusters, so that they stay apart when clusters are merged.
+type txtDoc struct {
+	line       string
+	emb        []int8
+	subcluster int
+}
+
+type txtCluster struct {
+	docs     []txtDoc
+	centroid []float64
+}
+
+func readClusterTxt(file string, slots uint64, nextSubcluster *int) []txtDoc {
+	f := utils.OpenFile(file)
+	defer f.Close()
+
+	docs := make([]txtDoc, 0)
+	scanner := newTxtScanner(f)
+
+	for scanner.Scan() {
+		txt := scanner.Text()
+		if len(txt) == 0 {
+			continue
+		} else if txt == SUBCLUSTER_DELIM {
+			*nextSubcluster += 1
+			continue
+		}
+
+		emb := parseEmbeddingLineTxt(txt, file, slots, config.SLOT_BITS())
+		docs = append(docs, txtDoc{line: txt, emb: emb, subcluster: *nextSubcluster})
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Println(err)
+		fmt.Println(file)
+		panic("Error reading file")
+	}
+
+	*nextSubcluster += 1
+	return docs
+}
+
+func writeClusterTxt(file string, docs []txtDoc) {
+	f := utils.CreateFile(file)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for i, d := range docs {
+		if i > 0 && d.subcluster != docs[i-1].subcluster {
+			fmt.Fprintln(w, SUBCLUSTER_DELIM)
+		}
+		fmt.Fprintln(w, d.line)
+	}
+
+	if err := w.Flush(); err != nil {
+		fmt.Println(err)
+		panic("Error writing file")
+	}
+}
+
+// Writes the centroids in the text format of numpy.savetxt, one row per
+// cluster id up to the largest one
+func writeCentroids(file string, ids []uint, clusters []txtCluster, slots uint64) {
+	f := utils.CreateFile(file)
+	defer f.Close()
+
+	maxId := uint(0)
+	for _, id := range ids {
+		if id > maxId {
+			maxId = id
+		}
+	}
+	rows := make([][]float64, maxId+1)
+	for i, cl := range clusters {
+		rows[ids[i]] = cl.centroid
+	}
+
+	w := bufio.NewWriter(f)
+	for _, centroid := range rows {
+		if centroid == nil {
+			centroid = make([]float64, slots)
+		}
+
+		for i, v := range centroid {
+			if i > 0 {
+				w.WriteString(" ")
+			}
+			w.WriteString(strconv.FormatFloat(v, 'e', 18, 64))
+		}
+		w.WriteString("\n")
+	}
+
+	if err := w.Flush(); err != nil {
+		fmt.Println(err)
+		panic("Error writing file")
+	}
+}
+
+func centroid(docs []txtDoc) []float64 {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	c := make([]float64, len(docs[0].emb))
+	for _, d := range docs {
+		for i, v := range d.emb {
+			c[i] += float64(v)
+		}
+	}
+	for i := range c {
+		c[i] /= float64(len(docs))
+	}
+	return c
+}
+
+// Similarity as the search ranks docs by: the inner product
+func dot(emb []int8, c []float64) float64 {
+	d := 0.0
+	for i, v := range emb {
+		d += float64(v) * c[i]
+	}
+	return d
+}
+
+func centroidDot(a, b []float64) float64 {
+	d := 0.0
+	for i := range a {
+		d += a[i] * b[i]
+	}
+	return d
+}
+
+// Splits the docs into two halves of equal size. Runs 2-means to find the
+// direction to split along, then cuts at the median, keeping the order of
+// the docs (and so their subclusters) within each half.
+func splitInHalf(docs []txtDoc) ([]txtDoc, []txtDoc) {
+	// Start from the doc least similar to the centroid, and the doc least
+	// similar to that one
+	mean := centroid(docs)
+	a := 0
+	for i := range docs {
+		if dot(docs[i].emb, mean) < dot(docs[a].emb, mean) {
+			a = i
+		}
+	}
+	ca := centroid(docs[a : a+1])
+	b := 0
+	for i := range docs {
+		if dot(docs[i].emb, ca) < dot(docs[b].emb, ca) {
+			b = i
+		}
+	}
+	cb := centroid(docs[b : b+1])
+
+	for iter := 0; iter < REBALANCE_KMEANS_ITERS; iter++ {
+		as := make([]txtDoc, 0)
+		bs := make([]txtDoc, 0)
+		for _, d := range docs {
+			if dot(d.emb, ca) >= dot(d.emb, cb) {
+				as = append(as, d)
+			} else {
+				bs = append(bs, d)
+			}
+		}
+		if len(as) == 0 || len(bs) == 0 {
+			break
+		}
+		ca, cb = centroid(as), centroid(bs)
+	}
+
+	// Cut at the median of how much more similar each doc is to the first
+	// centroid
+	order := make([]int, len(docs))
+	for i := range order {
+		order[i] = i
+	}
+	margin := func(i int) float64 {
+		return dot(docs[i].emb, cb) - dot(docs[i].emb, ca)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return margin(order[i]) < margin(order[j])
+	})
+
+	inFirst := make([]bool, len(docs))
+	for _, i := range order[:len(docs)/2] {
+		inFirst[i] = true
+	}
+
+	first := make([]txtDoc, 0, len(docs)/2)
+	second := make([]txtDoc, 0, len(docs)-len(docs)/2)
+	for i, d := range docs {
+		if inFirst[i] {
+			first = append(first, d)
+		} else {
+			second = append(second, d)
+		}
+	}
+
+	return first, second
+}
+
+// Rebalances the per-cluster text files of conf, and writes the result,
+// the new centroids and the new cluster ids to out, which is left set to
+// serve them. First merges each cluster of less than minDocs docs into the
+// cluster whose centroid has the largest inner product with its own, as
+// queries are routed by, while it has room. Then splits each cluster of
+// more than maxDocs docs in two, the second half taking an id freed by a
+// merge if any is left, and a new id past the largest one otherwise.
+// Missing cluster files count as empty clusters.
+func RebalanceTxt(conf, out *config.Config, maxDocs, minDocs uint64) {
+	ids := append([]uint{}, conf.CLUSTER_IDS()...)
+	slots := conf.EMBEDDINGS_DIM()
+
+	clusters := make([]txtCluster, len(ids))
+	nextSubcluster := 0
+	nextId := uint(0)
+	for i, id := range ids {
+		if clusterTxtExists(id, conf) {
+			clusters[i].docs = readClusterTxt(conf.TxtCorpus(int(id)), slots, &nextSubcluster)
+			clusters[i].centroid = centroid(clusters[i].docs)
+		}
+		if id >= nextId {
+			nextId = id + 1
+		}
+
+		if i%1000 == 0 {
+			fmt.Printf("Read cluster %d\n", i)
+		}
+	}
+
+	// Clusters by size and by centroid, updated as clusters change, so that
+	// each merge or split takes no pass over all clusters. Merged clusters
+	// have size -1, and so drop out of the heaps, as do clusters left with
+	// no room to merge into.
+	merged := make([]bool, len(clusters))
+	stuck := make([]bool, len(clusters))
+	size := func(i int) int {
+		if merged[i] {
+			return -1
+		}
+		return len(clusters[i].docs)
+	}
+	mergeSize := func(i int) int {
+		if stuck[i] {
+			return -1
+		}
+		return size(i)
+	}
+	bigs, smalls := &sizeHeap{max: true}, &sizeHeap{}
+	index := newCentroidIndex(len(clusters), slots)
+	update := func(i int) {
+		bigs.push(i, size(i))
+		smalls.push(i, size(i))
+		index.set(i, clusters[i].centroid)
+	}
+	for i := range clusters {
+		update(i)
+	}
+
+	freed := make([]uint, 0)
+	for {
+		small := smalls.top(mergeSize, -1)
+		if small == -1 || uint64(size(small)) >= minDocs {
+			break
+		}
+
+		if len(clusters[small].docs) > 0 {
+			nearest := index.nearest(clusters[small].centroid,
+				func(i int) []float64 { return clusters[i].centroid },
+				func(i int) bool {
+					return i != small && uint64(len(clusters[i].docs)+len(clusters[small].docs)) <= maxDocs
+				})
+			if nearest == -1 {
+				fmt.Printf("No room to merge cluster %d -- keeping it\n", ids[small])
+				stuck[small] = true
+				continue
+			}
+
+			clusters[nearest].docs = append(clusters[nearest].docs, clusters[small].docs...)
+			clusters[nearest].centroid = centroid(clusters[nearest].docs)
+			update(nearest)
+		}
+
+		merged[small] = true
+		clusters[small] = txtCluster{}
+		index.set(small, nil)
+		freed = append(freed, ids[small])
+	}
+	fmt.Printf("Merged %d clusters\n", len(freed))
+
+	// Ids are reused in increasing order
+	sort.Slice(freed, func(i, j int) bool { return freed[i] < freed[j] })
+	splits := 0
+	for {
+		big := bigs.top(size, -1)
+		if big == -1 || uint64(size(big)) <= maxDocs || size(big) < 2 {
+			break
+		}
+
+		id := nextId
+		if len(freed) > 0 {
+			id, freed = freed[0], freed[1:]
+		} else {
+			nextId += 1
+		}
+
+		first, second := splitInHalf(clusters[big].docs)
+		clusters[big] = txtCluster{docs: first, centroid: centroid(first)}
+		clusters = append(clusters, txtCluster{docs: second, centroid: centroid(second)})
+		ids = append(ids, id)
+		merged = append(merged, false)
+		stuck = append(stuck, false)
+		update(big)
+		update(len(clusters) - 1)
+		splits += 1
+	}
+	fmt.Printf("Split %d clusters\n", splits)
+
+	kept := make([]uint, 0, len(ids))
+	keptClusters := make([]txtCluster, 0, len(ids))
+	for i, cl := range clusters {
+		if merged[i] {
+			continue
+		}
+		writeClusterTxt(out.TxtCorpus(int(ids[i])), cl.docs)
+		kept = append(kept, ids[i])
+		keptClusters = append(keptClusters, cl)
+	}
+	writeCentroids(out.Centroids(), kept, keptClusters, slots)
+	writeClusterIds(out.ClusterIdsFile(), kept)
+	out.SetClusterIds(kept)
+	linkEmbedderFiles(conf, out)
+
+	fmt.Printf("Wrote %d clusters to %s\n", len(kept), out.PREAMBLE())
+	fmt.Printf("Load them with -format txt -clusters %s\n", out.ClusterIdsFile())
+}
+
+// The embedder also needs the model and PCA components of the original
+// corpus, so link to them from the new one.
+func linkEmbedderFiles(conf, out *config.Config) {
+	links := [][2]string{
+		{conf.ModelDir(), out.ModelDir()},
+		{conf.PcaComponents(), out.PcaComponents()},
+	}
+
+	for _, l := range links {
+		if !utils.FileExists(l[0]) || utils.FileExists(l[1]) {
+			continue
+		}
+		src, err := filepath.Abs(l[0])
+		if err == nil {
+			err = os.Symlink(src, l[1])
+		}
+		if err != nil {
+			fmt.Println(err)
+			fmt.Printf("Could not link %s -- copy it by hand\n", l[0])
+		}
+	}
+}
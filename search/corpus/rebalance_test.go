@@ -0,0 +1,46 @@
+package corpus_test
+
+import (
+	"testing"
+
+	"search/corpus"
+	"search/corpus/corpustest"
+)
+
+// Splits take new ids even when no cluster is small enough to merge
+func TestRebalanceNewIds(t *testing.T) {
+	spec := corpustest.SmallSpec()
+	spec.Clusters = 16
+	spec.Sizes = corpus.SIZES_ZIPF
+	f := corpustest.New(t, spec)
+
+	for _, minDocs := range []uint64{0, 12} {
+		out := f.Conf.WithPreamble(t.TempDir())
+		maxDocs := uint64(2 * spec.MeanDocs)
+		corpus.RebalanceTxt(f.Conf, out, maxDocs, minDocs)
+
+		ids := corpus.ReadClusterIds(out.ClusterIdsFile())
+		if len(ids) != out.NUM_CLUSTERS() {
+			t.Fatalf("min %d: wrote %d ids, serving %d", minDocs, len(ids), out.NUM_CLUSTERS())
+		}
+
+		c := corpus.ReadEmbeddingsTxt(0, out.NUM_CLUSTERS(), out)
+		if c.GetNumDocs() != f.Embeddings.GetNumDocs() {
+			t.Fatalf("min %d: %d docs after rebalancing, want %d", minDocs, c.GetNumDocs(), f.Embeddings.GetNumDocs())
+		}
+		for _, id := range c.Clusters() {
+			if n := c.NumDocsInCluster(id); n > maxDocs {
+				t.Fatalf("min %d: cluster %d has %d docs", minDocs, id, n)
+			}
+		}
+		centroids := corpus.ReadCentroids(out)
+		for _, id := range ids {
+			if int(id) >= len(centroids) || uint64(len(centroids[id])) != spec.Dim {
+				t.Fatalf("min %d: no centroid of cluster %d among %d", minDocs, id, len(centroids))
+			}
+		}
+		if minDocs == 0 && len(ids) <= spec.Clusters {
+			t.Fatalf("min %d: no cluster split into a new id: %v", minDocs, ids)
+		}
+	}
+}
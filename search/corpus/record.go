@@ -0,0 +1,76 @@
+package corpus
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// Each subcluster is stored in the URL database as:
+//
+//	version (1 byte), payload length (4 bytes), CRC-32 of payload (4 bytes), payload
+//
+// so that the client can recover exactly the payload from a database column,
+// regardless of what is stored after it.
+const (
+	RECORD_VERSION    = 1
+	RECORD_HEADER_LEN = 9
+)
+
+func FrameRecord(payload []byte) []byte {
+	b := make([]byte, RECORD_HEADER_LEN, RECORD_HEADER_LEN+len(payload))
+	b[0] = RECORD_VERSION
+	binary.LittleEndian.PutUint32(b[1:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(b[5:], crc32.ChecksumIEEE(payload))
+	return append(b, payload...)
+}
+
+func UnframeRecord(b []byte) ([]byte, error) {
+	if len(b) < RECORD_HEADER_LEN {
+		return nil, errors.New("Record is shorter than its header")
+	}
+	if b[0] != RECORD_VERSION {
+		return nil, errors.New("Unknown record version")
+	}
+
+	l := binary.LittleEndian.Uint32(b[1:])
+	sum := binary.LittleEndian.Uint32(b[5:])
+	if uint64(len(b)-RECORD_HEADER_LEN) < uint64(l) {
+		return nil, errors.New("Record is truncated")
+	}
+
+	payload := b[RECORD_HEADER_LEN : RECORD_HEADER_LEN+l]
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, errors.New("Record checksum mismatch")
+	}
+
+	return payload, nil
+}
+
+// Builds the stored form of a subcluster of docs. A nil compressor stores
+// the docs uncompressed.
+func EncodeSubcluster(docs []Doc, comp Compressor) []byte {
+	payload := EncodeDocs(docs)
+	if comp != nil {
+		payload = comp.Compress(payload)
+	}
+	return FrameRecord(payload)
+}
+
+// Recovers the docs from the stored form of a subcluster, which may be
+// followed by arbitrary bytes.
+func DecodeSubcluster(b []byte, comp Compressor) ([]Doc, error) {
+	payload, err := UnframeRecord(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if comp != nil {
+		payload, err = comp.Decompress(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return DecodeDocs(payload)
+}
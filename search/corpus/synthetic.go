@@ -0,0 +1,302 @@
+package corpus
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"search/config"
+)
+
+// Distributions of the number of docs per cluster
+const (
+	SIZES_FIXED   = "fixed"   // MeanDocs docs in every cluster
+	SIZES_UNIFORM = "uniform" // uniform in [0, 2*MeanDocs]
+	SIZES_ZIPF    = "zipf"    // the i-th largest cluster is i times smaller than the largest
+)
+
+// Words that urls are padded with to reach their target length
+var syntheticWords = []string{"news", "blog", "about", "index", "page", "shop", "product", "en", "fr", "2021", "2022", "weather", "sports", "search"}
+
+// Shape of a synthetic corpus
+type SyntheticSpec struct {
+	Clusters       int     // with ids 0, ..., Clusters-1
+	MeanDocs       int     // mean number of docs per cluster
+	Sizes          string  // distribution of the number of docs per cluster
+	EmptyFrac      float64 // fraction of the clusters left empty
+	SubclusterDocs int     // docs per URL subcluster (0 for one subcluster per cluster)
+	Dim            uint64
+	SlotBits       uint64
+	MinUrlLen      int // urls are at least as long as "https://www.siteN.example/dM"
+	MaxUrlLen      int
+	Seed           int64
+}
+
+// A small corpus shaped as conf expects
+func DefaultSyntheticSpec(conf *config.Config) SyntheticSpec {
+	return SyntheticSpec{
+		Clusters:       100,
+		MeanDocs:       50,
+		Sizes:          SIZES_ZIPF,
+		SubclusterDocs: 20,
+		Dim:            conf.EMBEDDINGS_DIM(),
+		SlotBits:       config.SLOT_BITS(),
+		MinUrlLen:      30,
+		MaxUrlLen:      80,
+		Seed:           1,
+	}
+}
+
+type SyntheticDoc struct {
+	Id  uint64
+	Emb []int8
+	Doc Doc
+}
+
+// A corpus of random docs. The embeddings of each cluster are scattered
+// around a random center, so that the nearest center is the right cluster
+// to search. Clusters are generated from the seed as they are needed, so
+// that large corpora need not fit in memory.
+type Synthetic struct {
+	Spec SyntheticSpec
+
+	sizes    []int
+	firstIds []uint64 // id of the first doc of each cluster
+}
+
+func NewSynthetic(spec SyntheticSpec) *Synthetic {
+	if spec.SlotBits < 2 || spec.SlotBits > 8 {
+		panic("Not supported. Embeddings are represented as 8-bit values.")
+	}
+	if spec.Clusters < 1 || spec.MeanDocs < 0 || spec.Dim == 0 || spec.MaxUrlLen < spec.MinUrlLen ||
+		spec.EmptyFrac < 0 || spec.EmptyFrac > 1 {
+		fmt.Printf("%+v\n", spec)
+		panic("Bad synthetic corpus spec")
+	}
+
+	s := new(Synthetic)
+	s.Spec = spec
+	s.sizes = syntheticSizes(spec)
+	s.firstIds = make([]uint64, spec.Clusters)
+	next := uint64(0)
+	for i, sz := range s.sizes {
+		s.firstIds[i] = next
+		next += uint64(sz)
+	}
+	return s
+}
+
+func syntheticSizes(spec SyntheticSpec) []int {
+	r := rand.New(rand.NewSource(spec.Seed))
+	sizes := make([]int, spec.Clusters)
+	total := spec.Clusters * spec.MeanDocs
+
+	switch spec.Sizes {
+	case SIZES_FIXED:
+		for i := range sizes {
+			sizes[i] = spec.MeanDocs
+		}
+	case SIZES_UNIFORM:
+		for i := range sizes {
+			sizes[i] = r.Intn(2*spec.MeanDocs + 1)
+		}
+	case SIZES_ZIPF:
+		harmonic := 0.0
+		for i := range sizes {
+			harmonic += 1 / float64(i+1)
+		}
+		for i, rank := range r.Perm(spec.Clusters) {
+			sizes[i] = int(math.Round(float64(total) / (harmonic * float64(rank+1))))
+		}
+	default:
+		fmt.Println(spec.Sizes)
+		panic("Unknown cluster size distribution")
+	}
+
+	for _, i := range r.Perm(spec.Clusters)[:int(spec.EmptyFrac*float64(spec.Clusters))] {
+		sizes[i] = 0
+	}
+	return sizes
+}
+
+func (s *Synthetic) NumDocs() uint64 {
+	last := len(s.sizes) - 1
+	return s.firstIds[last] + uint64(s.sizes[last])
+}
+
+func (s *Synthetic) NumDocsInCluster(cluster uint) int {
+	return s.sizes[cluster]
+}
+
+// Ids of all the clusters, including the empty ones
+func (s *Synthetic) ClusterIds() []uint {
+	ids := make([]uint, s.Spec.Clusters)
+	for i := range ids {
+		ids[i] = uint(i)
+	}
+	return ids
+}
+
+func (s *Synthetic) clusterRand(cluster uint) *rand.Rand {
+	return rand.New(rand.NewSource(s.Spec.Seed*1000003 + int64(cluster) + 1))
+}
+
+func (s *Synthetic) slotRange() (int, int) {
+	return -(1 << (s.Spec.SlotBits - 1)), (1 << (s.Spec.SlotBits - 1)) - 1
+}
+
+// The center that the embeddings of a cluster are scattered around
+func (s *Synthetic) Center(cluster uint) []int8 {
+	r := s.clusterRand(cluster)
+	lo, hi := s.slotRange()
+
+	center := make([]int8, s.Spec.Dim)
+	for i := range center {
+		center[i] = int8(lo + r.Intn(hi-lo+1))
+	}
+	return center
+}
+
+// The docs of a cluster, by subcluster
+func (s *Synthetic) Cluster(cluster uint) [][]SyntheticDoc {
+	r := s.clusterRand(cluster)
+	center := s.Center(cluster)
+	r.Int63() // not to reuse the draws of the center
+	lo, hi := s.slotRange()
+	spread := 1 << (s.Spec.SlotBits - 2)
+
+	n := s.sizes[cluster]
+	per := s.Spec.SubclusterDocs
+	if per <= 0 {
+		per = n
+	}
+
+	subclusters := make([][]SyntheticDoc, 0)
+	for j := 0; j < n; j++ {
+		if j%per == 0 {
+			subclusters = append(subclusters, make([]SyntheticDoc, 0, per))
+		}
+
+		emb := make([]int8, s.Spec.Dim)
+		for i := range emb {
+			v := int(center[i]) + r.Intn(2*spread+1) - spread
+			if v < lo {
+				v = lo
+			} else if v > hi {
+				v = hi
+			}
+			emb[i] = int8(v)
+		}
+
+		id := s.firstIds[cluster] + uint64(j)
+		doc := NewDoc(s.url(r, cluster, id), fmt.Sprintf("Doc %d", id), fmt.Sprintf("snippet of doc %d in cluster %d", id, cluster))
+		last := len(subclusters) - 1
+		subclusters[last] = append(subclusters[last], SyntheticDoc{Id: id, Emb: emb, Doc: doc})
+	}
+	return subclusters
+}
+
+// A url unique to the doc, of random length in [MinUrlLen, MaxUrlLen]
+// unless its unique prefix is longer
+func (s *Synthetic) url(r *rand.Rand, cluster uint, id uint64) string {
+	target := s.Spec.MinUrlLen + r.Intn(s.Spec.MaxUrlLen-s.Spec.MinUrlLen+1)
+	prefix := fmt.Sprintf("https://www.site%d.example/d%d", cluster, id)
+
+	url := prefix
+	for len(url) < target {
+		url += "/" + syntheticWords[r.Intn(len(syntheticWords))]
+	}
+	if len(url) > target && target > len(prefix) {
+		url = strings.TrimRight(url[:target], "/")
+	}
+	return url
+}
+
+func (d *SyntheticDoc) txt() string {
+	vals := make([]string, len(d.Emb))
+	for i, v := range d.Emb {
+		vals[i] = strconv.Itoa(int(v))
+	}
+	return fmt.Sprintf("%d | %s | %s | %s | %s", d.Id, strings.Join(vals, ","), d.Doc.Url, d.Doc.Title, d.Doc.Snippet)
+}
+
+// Writes a cluster_N.txt file per cluster under the preamble of conf, with
+// the centroids and the list of cluster ids. The slot bits of the spec
+// should not exceed config.SLOT_BITS(), or values are clamped on loading.
+func (s *Synthetic) WriteTxt(conf *config.Config) {
+	clusters := make([]txtCluster, s.Spec.Clusters)
+
+	for i := 0; i < s.Spec.Clusters; i++ {
+		docs := make([]txtDoc, 0, s.sizes[i])
+		for sc, subcluster := range s.Cluster(uint(i)) {
+			for _, d := range subcluster {
+				docs = append(docs, txtDoc{line: d.txt(), emb: d.Emb, subcluster: sc})
+			}
+		}
+		writeClusterTxt(conf.TxtCorpus(i), docs)
+		clusters[i].centroid = centroid(docs)
+
+		if i%1000 == 0 {
+			fmt.Printf("Wrote cluster %d\n", i)
+		}
+	}
+
+	ids := s.ClusterIds()
+	writeCentroids(conf.Centroids(), ids, clusters, s.Spec.Dim)
+
+	writeClusterIds(conf.ClusterIdsFile(), ids)
+
+	fmt.Printf("Wrote %d docs in %d clusters to %s\n", s.NumDocs(), s.Spec.Clusters, conf.PREAMBLE())
+}
+
+// The embeddings, as ReadEmbeddingsTxt would read them back
+func (s *Synthetic) Embeddings() *Corpus {
+	c := new(Corpus)
+	c.params = Params{
+		EmbeddingSlots: s.Spec.Dim,
+		SlotBits:       s.Spec.SlotBits,
+	}
+	c.params.checkParams()
+
+	c.embeddings = make([]int8, 0, s.NumDocs()*s.Spec.Dim)
+	c.embeddingsClusterMap = make(map[uint]clusterSpan)
+
+	for _, cluster := range s.ClusterIds() {
+		embs := make([]int8, 0, uint64(s.sizes[cluster])*s.Spec.Dim)
+		for _, subcluster := range s.Cluster(cluster) {
+			for _, d := range subcluster {
+				embs = append(embs, d.Emb...)
+			}
+		}
+		c.addEmbeddingsCluster(cluster, embs)
+		c.params.NumDocs += uint64(s.sizes[cluster])
+	}
+	return c
+}
+
+// The urls, compressed with the codec of conf, as ReadUrlsTxt would read
+// them back
+func (s *Synthetic) Urls(conf *config.Config) *Corpus {
+	c := new(Corpus)
+	c.params.checkParams()
+	c.setUrlCodec(conf)
+
+	c.urls = make([][]byte, 0)
+	c.urlClusterMap = make(map[uint][]Subcluster)
+
+	for _, cluster := range s.ClusterIds() {
+		urls := make([][]Doc, 0)
+		for _, subcluster := range s.Cluster(cluster) {
+			docs := make([]Doc, len(subcluster))
+			for i, d := range subcluster {
+				docs[i] = d.Doc
+			}
+			urls = append(urls, docs)
+		}
+		c.addUrlCluster(cluster, urls)
+	}
+	c.finishUrls()
+	return c
+}
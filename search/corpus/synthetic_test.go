@@ -0,0 +1,131 @@
+package corpus_test
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"search/config"
+	"search/corpus"
+	"search/corpus/corpustest"
+)
+
+func TestSyntheticRoundTrip(t *testing.T) {
+	spec := corpustest.SmallSpec()
+	spec.EmptyFrac = 0.25
+	f := corpustest.New(t, spec)
+
+	emb := corpus.ReadEmbeddingsTxt(0, f.Conf.NUM_CLUSTERS(), f.Conf)
+	urls := corpus.ReadUrlsTxt(0, f.Conf.NUM_CLUSTERS(), f.Conf)
+
+	if emb.GetNumDocs() != f.Synthetic.NumDocs() || f.Embeddings.GetNumDocs() != f.Synthetic.NumDocs() {
+		t.Fatalf("read %d docs, generated %d in memory, want %d",
+			emb.GetNumDocs(), f.Embeddings.GetNumDocs(), f.Synthetic.NumDocs())
+	}
+	if !reflect.DeepEqual(emb.Clusters(), f.Embeddings.Clusters()) {
+		t.Fatalf("clusters %v, want %v", emb.Clusters(), f.Embeddings.Clusters())
+	}
+	if urls.GetUrlBytes() != f.Urls.GetUrlBytes() {
+		t.Fatalf("url bytes %d, want %d", urls.GetUrlBytes(), f.Urls.GetUrlBytes())
+	}
+
+	for _, cluster := range emb.Clusters() {
+		n := emb.NumDocsInCluster(cluster)
+		if n != f.Embeddings.NumDocsInCluster(cluster) || int(n) != f.Synthetic.NumDocsInCluster(cluster) {
+			t.Fatalf("cluster %d: %d docs, want %d", cluster, n, f.Synthetic.NumDocsInCluster(cluster))
+		}
+
+		slots := emb.GetEmbeddingSlots()
+		for j := uint64(0); j < n; j++ {
+			got := emb.GetEmbedding(uint64(emb.ClusterToIndex(cluster)) + j*slots)
+			want := f.Embeddings.GetEmbedding(uint64(f.Embeddings.ClusterToIndex(cluster)) + j*slots)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("cluster %d, doc %d: embedding %v, want %v", cluster, j, got, want)
+			}
+		}
+
+		if urls.NumSubclustersInCluster(cluster) != f.Urls.NumSubclustersInCluster(cluster) {
+			t.Fatalf("cluster %d: %d subclusters, want %d", cluster,
+				urls.NumSubclustersInCluster(cluster), f.Urls.NumSubclustersInCluster(cluster))
+		}
+		if n > 0 && !reflect.DeepEqual(urls.GetUrlsInCluster(uint64(cluster)), f.Urls.GetUrlsInCluster(uint64(cluster))) {
+			t.Fatalf("cluster %d: urls differ", cluster)
+		}
+	}
+}
+
+func TestSyntheticSizes(t *testing.T) {
+	spec := corpus.DefaultSyntheticSpec(config.MakeConfig(""))
+
+	spec.Sizes = corpus.SIZES_FIXED
+	s := corpus.NewSynthetic(spec)
+	for _, cluster := range s.ClusterIds() {
+		if s.NumDocsInCluster(cluster) != spec.MeanDocs {
+			t.Fatalf("fixed: cluster %d has %d docs", cluster, s.NumDocsInCluster(cluster))
+		}
+	}
+
+	spec.Sizes = corpus.SIZES_UNIFORM
+	s = corpus.NewSynthetic(spec)
+	for _, cluster := range s.ClusterIds() {
+		if n := s.NumDocsInCluster(cluster); n < 0 || n > 2*spec.MeanDocs {
+			t.Fatalf("uniform: cluster %d has %d docs", cluster, n)
+		}
+	}
+
+	spec.Sizes = corpus.SIZES_ZIPF
+	spec.EmptyFrac = 0.1
+	s = corpus.NewSynthetic(spec)
+	sizes := make([]int, 0)
+	empty := 0
+	for _, cluster := range s.ClusterIds() {
+		sizes = append(sizes, s.NumDocsInCluster(cluster))
+		if s.NumDocsInCluster(cluster) == 0 {
+			empty += 1
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+	if sizes[0] < 10*spec.MeanDocs {
+		t.Fatalf("zipf: largest cluster has %d docs, mean %d", sizes[0], spec.MeanDocs)
+	}
+	if empty < 10 {
+		t.Fatalf("%d empty clusters, want at least 10", empty)
+	}
+}
+
+func TestSyntheticDocs(t *testing.T) {
+	spec := corpus.DefaultSyntheticSpec(config.MakeConfig(""))
+	spec.Clusters = 10
+	spec.MinUrlLen = 40
+	spec.MaxUrlLen = 700 // some spill into overflow records
+	s := corpus.NewSynthetic(spec)
+
+	seen := make(map[string]bool)
+	for _, cluster := range s.ClusterIds() {
+		subclusters := s.Cluster(cluster)
+		if !reflect.DeepEqual(subclusters, s.Cluster(cluster)) {
+			t.Fatalf("cluster %d is not deterministic", cluster)
+		}
+
+		for i, sc := range subclusters {
+			if len(sc) > spec.SubclusterDocs || (i < len(subclusters)-1 && len(sc) != spec.SubclusterDocs) {
+				t.Fatalf("cluster %d, subcluster %d has %d docs", cluster, i, len(sc))
+			}
+			for _, d := range sc {
+				if len(d.Doc.Url) < spec.MinUrlLen || len(d.Doc.Url) > spec.MaxUrlLen {
+					t.Fatalf("url of %d bytes: %s", len(d.Doc.Url), d.Doc.Url)
+				}
+				if seen[d.Doc.Url] {
+					t.Fatalf("url %s generated twice", d.Doc.Url)
+				}
+				seen[d.Doc.Url] = true
+
+				for _, v := range d.Emb {
+					if v < -(1<<(spec.SlotBits-1)) || v >= 1<<(spec.SlotBits-1) {
+						t.Fatalf("value %d out of range", v)
+					}
+				}
+			}
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package corpus
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
 	"encoding/csv"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
@@ -14,17 +16,18 @@ import (
 
 const (
 	SUBCLUSTER_DELIM = "-------------------------"
-	URL_DELIM        = " "
+	DOC_FIELD_DELIM  = " | "
 
-	MAX_URL_LEN             = 500
+	MAX_URL_LEN             = 500 // longer urls spill into overflow records
+	MAX_TXT_LINE            = 16 * 1024 * 1024
 	DISALLOW_EMPTY_CLUSTERS = false
 )
 
-func Compress(s string) []byte {
+func Compress(b []byte) []byte {
 	var buf bytes.Buffer
 	zw, err := zlib.NewWriterLevel(&buf, zlib.BestCompression)
 
-	_, err2 := zw.Write([]byte(s))
+	_, err2 := zw.Write(b)
 	if err != nil || err2 != nil {
 		fmt.Printf("%s %s\n", err, err2)
 		panic("Error with zlib")
@@ -34,27 +37,47 @@ func Compress(s string) []byte {
 	return buf.Bytes()
 }
 
-func Decompress(b []byte) (string, error) {
+func Decompress(b []byte) ([]byte, error) {
 	r := bytes.NewReader(b)
 	zr, err := zlib.NewReader(r)
 	if err != nil {
 		fmt.Println(err)
-		return "", err
+		return nil, err
 	}
 	defer zr.Close()
 
 	data, err := ioutil.ReadAll(zr)
 	if err != nil {
 		fmt.Println(err)
-		return "", err
+		return nil, err
 	}
 
-	if string(data) == "" {
-		panic("Gzip should not recover empty string")
-		return "", errors.New("Gzip returned empty string")
+	if len(data) == 0 {
+		return nil, errors.New("Gzip returned empty string")
 	}
 
-	return strings.TrimRight(string(data), "\x00"), nil
+	return data, nil
+}
+
+// As Decompress, failing if the data decompresses to more than max bytes
+func decompressAtMost(b []byte, max uint64) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(io.LimitReader(zr, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) > max {
+		return nil, errors.New("Decompressed data too large")
+	}
+	if len(data) == 0 {
+		return nil, errors.New("Gzip returned empty string")
+	}
+	return data, nil
 }
 
 func parseCsvHeader(f *os.File) (*csv.Reader, uint64, uint64, uint64) {
@@ -96,39 +119,42 @@ func parseDelimitersTxt(txt string) (int, int) {
 	return i1, i1 + 2 + i2
 }
 
+// Scans the lines of a corpus text file, which hold a whole embedding each
+// and so may be longer than bufio's default of 64 KB
+func newTxtScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), MAX_TXT_LINE)
+	return scanner
+}
+
 func parseEmbeddingsTxt(txt string) []string {
 	i1, i2 := parseDelimitersTxt(txt)
 	return strings.Split(txt[i1+2:i2-1], ",")
 }
 
-func parseUrlTxt(txt string) string {
+// Parses "url", "url | title" or "url | title | snippet" following the
+// embedding of a line
+func parseDocTxt(txt string) Doc {
 	_, i := parseDelimitersTxt(txt)
-	return strings.Trim(txt[i+2:], " ")
+	return parseDocFields(txt[i+2:])
 }
 
-func GetIthUrl(strs string, num uint64) string {
-	for i := uint64(0); i < num; i++ {
-		index := strings.Index(strs, URL_DELIM)
-		if index == -1 {
-			fmt.Println(strs)
-			fmt.Printf("Only matched %d delimiters -- wanted %d\n", i, num)
-			panic("Should not happen")
-		}
-		strs = strs[index+1:]
+func parseDocFields(txt string) Doc {
+	fields := strings.SplitN(txt, DOC_FIELD_DELIM, 3)
+	for j := range fields {
+		fields[j] = strings.Trim(fields[j], " ")
 	}
 
-	index := strings.Index(strs, URL_DELIM)
-	if index == -1 {
-		return strs
+	for len(fields) < 3 {
+		fields = append(fields, "")
 	}
-
-	return strs[:index]
+	return NewDoc(fields[0], fields[1], fields[2])
 }
 
-func CountUrls(s string) int {
-	index := strings.Index(s, URL_DELIM)
-	if index == -1 {
-		return 1
+func GetIthUrl(docs []Doc, num uint64) Doc {
+	if num >= uint64(len(docs)) {
+		fmt.Printf("Only recovered %d docs -- wanted doc %d\n", len(docs), num)
+		panic("Should not happen")
 	}
-	return 1 + CountUrls(s[index+1:])
+	return docs[num]
 }
@@ -5,7 +5,6 @@ import (
 	"search/config"
 	"search/corpus"
 	"search/packing"
-	"search/utils"
 
 	"github.com/henrycg/simplepir/lwe"
 	"github.com/henrycg/simplepir/matrix"
@@ -13,29 +12,34 @@ import (
 	"github.com/henrycg/simplepir/rand"
 )
 
-func BuildUrlsDatabase(c *corpus.Corpus, seed *rand.PRGKey, hintSz uint64) (*pir.Database[matrix.Elem32], SubclusterMap) {
-	d := uint64(8) // 一个byte中的bit数
-	l := uint64(c.GetUrlBytes())
-	logQ := uint64(32)
+// Server work per DB cell is weighed against this many bytes of query and
+// answer traffic when picking the shape of a DB.
+const NETWORK_BYTE_COST = 16
 
-	if hintSz*250 > l {
-		fmt.Printf("Increasing L from %d to %d\n", l, hintSz*250)
-		l = hintSz * 250
-	} else {
-		fmt.Printf("Hint size is %d MB\n", l/250)
+func packingCosts(logQ uint64) packing.Costs {
+	elemBytes := float64(logQ / 8)
+	return packing.Costs{
+		Cell:   1,
+		Column: NETWORK_BYTE_COST * elemBytes,
+		Row:    NETWORK_BYTE_COST * elemBytes,
 	}
+}
 
-	// 将url字符串打包进database columns
-	chunks, actualSz := packing.BuildUrlChunks(c)
-	cols, colSzs := packing.PackChunks(chunks, l)
-
-	m := uint64(len(cols))
-	l = utils.Max(colSzs)
-	fmt.Printf("DB size is %d -- best possible would be %d\n", l*m, actualSz)
+// Describes the DB shape that the given column sizes lead to
+func packingReport(strategy string, colSzs []uint64, slotsPerCol, logQ, p uint64) *packing.Report {
+	n := uint64(0)
+	if params := lwe.NewParamsFixedP(logQ, uint64(len(colSzs))*slotsPerCol, p); params != nil {
+		n = params.N
+	}
+	return packing.NewReport(strategy, colSzs, slotsPerCol, logQ/8, n)
+}
 
-	// 获取 SimplePIR Params
-	p := lwe.NewParamsFixedP(logQ, m, 256)
-	if p == nil || p.Logq != 32 {
+func BuildUrlsDatabase(c *corpus.Corpus, seed *rand.PRGKey, conf *config.Config) (*pir.Database[matrix.Elem32], SubclusterMap) {
+	// 将url字符串打包进database columns，并获取 SimplePIR Params
+	plan := PlanUrls(c, conf.PACKING_STRATEGY(), conf)
+	cols, l, m, p := plan.Cols, plan.L, plan.M, plan.Params
+	d := plan.RecordLen // 一个byte中的bit数
+	if p.Logq != URL_LOGQ {
 		panic("Failure in picking SimplePIR DB parameters")
 	}
 
@@ -74,43 +78,43 @@ func BuildUrlsDatabase(c *corpus.Corpus, seed *rand.PRGKey, hintSz uint64) (*pir
 	return db, indexMap
 }
 
-func BuildEmbeddingsDatabase(c *corpus.Corpus, seed *rand.PRGKey, hintSz uint64, conf *config.Config) (*pir.Database[matrix.Elem64], ClusterMap) {
-	l := hintSz * 125
-	logQ := uint64(64)
+func BuildEmbeddingsDatabase(c *corpus.Corpus, seed *rand.PRGKey, conf *config.Config) (*pir.Database[matrix.Elem64], ClusterMap) {
+	logQ := uint64(EMBEDDINGS_LOGQ)
 
 	fmt.Printf("Building db with %d embedding\n", c.GetNumDocs())
 
-	// 将聚类打包进 database columns
-	chunks, actualSz := packing.BuildEmbChunks(c)
-	cols, colSzs := packing.PackChunks(chunks, l)
-
-	m := uint64(len(cols)) * c.GetEmbeddingSlots()
-	l = utils.Max(colSzs)
-	fmt.Printf("DB size is %d -- best possible would be %d\n", l*m, actualSz)
-
-	// 获取SimplePIR params
-	recordLen := conf.SIMPLEPIR_EMBEDDINGS_RECORD_LENGTH()
-	p := lwe.NewParamsFixedP(logQ, m, (1 << recordLen))
-	if (p == nil) || (p.P < uint64(1<<c.GetSlotBits())) || (p.Logq != 64) {
+	// 将聚类打包进 database columns，并获取SimplePIR params
+	plan := PlanEmbeddings(c, conf.PACKING_STRATEGY(), conf)
+	cols, l, m, p := plan.Cols, plan.L, plan.M, plan.Params
+	recordLen := plan.RecordLen
+	if (p.P < uint64(1<<c.GetSlotBits())) || (p.Logq != logQ) {
 		fmt.Printf("P = %d; LogQ = %d\n", p.P, p.Logq)
 		panic("Failure in picking SimplePIR DB parameters")
 	}
 
-	// 将嵌入储存到 database，便将聚类保存到一列中
+	// 将嵌入储存到 database，便将聚类的每一部分保存到一列中
 	vals := make([]uint64, l*m)
-	indexMap := make(map[uint]uint64)
+	indexMap := make(map[uint][]ClusterRange)
 	slots := c.GetEmbeddingSlots()
 
+	for _, part := range plan.Parts {
+		indexMap[part.Cluster] = append(indexMap[part.Cluster], ClusterRange{})
+	}
+
 	for colIndex, colContents := range cols {
 		rowIndex := uint64(0)
-		for _, clusterIndex := range colContents {
-			if _, ok := indexMap[clusterIndex]; ok {
+		for _, partIndex := range colContents {
+			part := plan.Parts[partIndex]
+			if indexMap[part.Cluster][part.Part].Size > 0 {
 				panic("Key should not yet exist")
 			}
 
-			indexMap[clusterIndex] = DBIndex(rowIndex, slots*uint64(colIndex), m)
-			sz := c.NumDocsInCluster(clusterIndex)
-			start := uint64(c.ClusterToIndex(clusterIndex))
+			indexMap[part.Cluster][part.Part] = ClusterRange{
+				Index: DBIndex(rowIndex, slots*uint64(colIndex), m),
+				Size:  part.Size,
+			}
+			sz := part.Size
+			start := uint64(c.ClusterToIndex(part.Cluster)) + part.Start*slots
 
 			for x := uint64(0); x < sz; x++ {
 				arr := c.GetEmbedding(start)
@@ -125,7 +129,7 @@ func BuildEmbeddingsDatabase(c *corpus.Corpus, seed *rand.PRGKey, hintSz uint64,
 			}
 		}
 	}
-	db := pir.NewDatabaseFixedParams[matrix.Elem64](l*m, uint64(recordLen), vals, p)
+	db := pir.NewDatabaseFixedParams[matrix.Elem64](l*m, recordLen, vals, p)
 	fmt.Printf("DB dimensions: %d by %d\n", db.Info.L, db.Info.M)
 
 	if db.Info.L != l {
@@ -5,7 +5,14 @@ import (
 	"search/corpus"
 )
 
-type ClusterMap map[uint]uint64
+// Rows [row, row+Size) starting at DB index Index, holding one part of a
+// cluster. Clusters too large for one column are split into several parts.
+type ClusterRange struct {
+	Index uint64
+	Size  uint64
+}
+
+type ClusterMap map[uint][]ClusterRange
 type SubclusterMap map[uint][]corpus.Subcluster
 
 func Decompose(index, M uint64) (uint64, uint64) {
@@ -18,13 +25,25 @@ func DBIndex(row, col, M uint64) uint64 {
 	return row*M + col
 }
 
-func (m ClusterMap) ClusterToIndex(cluster uint) uint64 {
-	i, ok := m[cluster]
+func (m ClusterMap) ClusterToRanges(cluster uint) []ClusterRange {
+	r, ok := m[cluster]
 	if !ok {
 		fmt.Printf("Looked up cluster %d\n", cluster)
 		panic("Cluster does not exist")
 	}
-	return i
+	return r
+}
+
+// Number of parts of the most split cluster. Every embeddings query covers
+// this many parts, so that queries do not reveal which cluster they are for.
+func (m ClusterMap) MaxParts() int {
+	max := 1
+	for _, r := range m {
+		if len(r) > max {
+			max = len(r)
+		}
+	}
+	return max
 }
 
 func (m SubclusterMap) SubclusterToIndex(clusterIndex, docIndex uint64) (uint64, uint64, uint64) {
@@ -102,14 +121,20 @@ func mergeIndex(index, M, addtl_M uint64, shift_col bool) uint64 {
 
 func MergeClusterMap(origMap ClusterMap, newMap ClusterMap, origM uint64, newM uint64) {
 	for k, v := range origMap {
-		origMap[k] = mergeIndex(v, origM, newM, false)
+		for i, r := range v {
+			origMap[k][i].Index = mergeIndex(r.Index, origM, newM, false)
+		}
 	}
 
 	for k, v := range newMap {
 		if _, ok := origMap[k]; ok {
 			panic("Key should not be present")
 		}
-		origMap[k] = mergeIndex(v, newM, origM, true)
+
+		origMap[k] = make([]ClusterRange, len(v))
+		for i, r := range v {
+			origMap[k][i] = ClusterRange{Index: mergeIndex(r.Index, newM, origM, true), Size: r.Size}
+		}
 	}
 }
 
@@ -0,0 +1,238 @@
+package database
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"math/rand"
+
+	"search/config"
+	"search/corpus"
+	"search/utils"
+
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// Lets clients check answers to queries on a DB. A correct answer to a
+// query q is D*q mod P, so it must satisfy w^T (D*q) = (w^T D) q mod P for
+// each of CHECK_VECTORS weight vectors w drawn from Seed; Columns holds
+// w^T D for each. A server answering for different data, or a corrupted
+// answer, fails the check unless the error happens to be orthogonal to
+// every w. As P is a power of two, an error of P/2 in one row is orthogonal
+// to a random w whenever its weight in that row is even, so one vector
+// catches it only half the time: CHECK_VECTORS vectors miss it with
+// probability 2^-CHECK_VECTORS.
+//
+// A server that knows w can forge answers that pass, so checks are made by
+// whoever builds the DB from the corpus, with a secret seed, and handed to
+// clients out of band -- never to the servers. Servers publish only the
+// Merkle root of their DB (DBRoot), and clients refuse a server whose root
+// is not the Root of their checks.
+type AnswerCheck struct {
+	Seed    int64
+	P       uint64
+	Rows    uint64
+	Columns [][]uint64 // by weight vector
+	Root    []byte
+
+	weights [][]uint64
+}
+
+const CHECK_VECTORS = 40
+
+func NewAnswerCheck[T matrix.Elem](db *pir.Database[T], seed int64) *AnswerCheck {
+	if db.Info.Ne != 1 {
+		panic("Not supported. DB records should fit in one element.")
+	}
+
+	a := new(AnswerCheck)
+	a.Seed = seed
+	a.P = db.Info.P()
+	a.Rows = db.Data.Rows()
+	a.Columns = make([][]uint64, CHECK_VECTORS)
+	for k := range a.Columns {
+		a.Columns[k] = make([]uint64, db.Data.Cols())
+	}
+
+	w := a.getWeights()
+	for i := uint64(0); i < a.Rows; i++ {
+		for j := uint64(0); j < db.Data.Cols(); j++ {
+			v := uint64(db.Data.Get(i, j)) % a.P
+			for k, cols := range a.Columns {
+				cols[j] = (cols[j] + w[k][i]*v) % a.P
+			}
+		}
+	}
+
+	a.Root = DBRoot(db)
+	return a
+}
+
+// Merkle root over the columns of the DB, as published by servers in the
+// hint. It matches the Root of the checks made for the same DB.
+func DBRoot[T matrix.Elem](db *pir.Database[T]) []byte {
+	p := db.Info.P()
+	leaves := make([]hash.Hash, db.Data.Cols())
+	for j := range leaves {
+		leaves[j] = sha256.New()
+		leaves[j].Write([]byte{0})
+	}
+
+	buf := make([]byte, 8)
+	for i := uint64(0); i < db.Data.Rows(); i++ {
+		for j := range leaves {
+			binary.LittleEndian.PutUint64(buf, uint64(db.Data.Get(i, uint64(j)))%p)
+			leaves[j].Write(buf)
+		}
+	}
+	return merkleRoot(sumLeaves(leaves))
+}
+
+func sumLeaves(leaves []hash.Hash) [][]byte {
+	hashes := make([][]byte, len(leaves))
+	for j, h := range leaves {
+		hashes[j] = h.Sum(nil)
+	}
+	return hashes
+}
+
+// A seed that servers cannot guess
+func RandomCheckSeed() int64 {
+	var seed int64
+	if err := binary.Read(crand.Reader, binary.LittleEndian, &seed); err != nil {
+		panic(err)
+	}
+	return seed
+}
+
+func (a *AnswerCheck) WriteFile(file string) {
+	f := utils.CreateFile(file)
+	defer f.Close()
+	if err := gob.NewEncoder(f).Encode(a); err != nil {
+		fmt.Println(err)
+		panic("Error writing answer check")
+	}
+}
+
+func ReadAnswerCheck(file string) *AnswerCheck {
+	f := utils.OpenFile(file)
+	defer f.Close()
+	a := new(AnswerCheck)
+	if err := gob.NewDecoder(f).Decode(a); err != nil {
+		fmt.Println(err)
+		fmt.Println(file)
+		panic("Error reading answer check")
+	}
+	if len(a.Columns) != CHECK_VECTORS {
+		fmt.Printf("%d weight vectors vs. %d\n", len(a.Columns), CHECK_VECTORS)
+		fmt.Println(file)
+		panic("Answer check made by another version -- run answer-checks again")
+	}
+	return a
+}
+
+// Each weight vector is drawn from its own seed, expanded from Seed
+func (a *AnswerCheck) getWeights() [][]uint64 {
+	if a.weights == nil {
+		a.weights = make([][]uint64, CHECK_VECTORS)
+		for k := range a.weights {
+			r := rand.New(rand.NewSource(a.vectorSeed(k)))
+			a.weights[k] = make([]uint64, a.Rows)
+			for i := range a.weights[k] {
+				a.weights[k][i] = r.Uint64() % a.P
+			}
+		}
+	}
+	return a.weights
+}
+
+func (a *AnswerCheck) vectorSeed(k int) int64 {
+	buf := binary.LittleEndian.AppendUint64(nil, uint64(a.Seed))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(k))
+	h := sha256.Sum256(buf)
+	return int64(binary.LittleEndian.Uint64(h[:8]))
+}
+
+// Checks decrypted answer vals against the query holding q[k] in column
+// firstCol+k, and zeros elsewhere
+func (a *AnswerCheck) Check(vals []uint64, firstCol uint64, q []int64) bool {
+	if uint64(len(vals)) != a.Rows || firstCol+uint64(len(q)) > uint64(len(a.Columns[0])) {
+		return false
+	}
+
+	for k, w := range a.getWeights() {
+		got := uint64(0)
+		for i, v := range vals {
+			got = (got + w[i]*(v%a.P)) % a.P
+		}
+
+		want := uint64(0)
+		for j, x := range q {
+			want = (want + a.Columns[k][firstCol+uint64(j)]*a.mod(x)) % a.P
+		}
+		if got != want {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *AnswerCheck) mod(x int64) uint64 {
+	m := x % int64(a.P)
+	if m < 0 {
+		m += int64(a.P)
+	}
+	return uint64(m)
+}
+
+func (a *AnswerCheck) Commitment() string {
+	return fmt.Sprintf("%x", a.Root)
+}
+
+// Hashes pairs of nodes up to the root, carrying an odd node up as is.
+// Leaves and inner nodes are hashed with distinct prefixes.
+func merkleRoot(level [][]byte) []byte {
+	if len(level) == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{1})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// Builds the DBs of the emb and urls corpora as the servers do, and writes
+// answer checks for them, with secret seeds, for clients to check answers
+// against
+func WriteAnswerChecks(emb, urls *corpus.Corpus, conf *config.Config) {
+	embDb, _ := BuildEmbeddingsDatabase(emb, nil, conf)
+	embCheck := NewAnswerCheck(embDb, RandomCheckSeed())
+	embCheck.WriteFile(conf.EmbeddingsCheckFile())
+	fmt.Printf("Embeddings DB commitment: %s\n", embCheck.Commitment())
+
+	urlDb, _ := BuildUrlsDatabase(urls, nil, conf)
+	urlCheck := NewAnswerCheck(urlDb, RandomCheckSeed())
+	urlCheck.WriteFile(conf.UrlsCheckFile())
+	fmt.Printf("URL DB commitment: %s\n", urlCheck.Commitment())
+
+	fmt.Printf("Wrote answer checks to %s and %s -- hand them to clients only\n",
+		conf.EmbeddingsCheckFile(), conf.UrlsCheckFile())
+}
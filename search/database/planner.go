@@ -0,0 +1,330 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"search/config"
+	"search/corpus"
+	"search/packing"
+	"search/utils"
+	"sort"
+
+	"github.com/henrycg/simplepir/lwe"
+)
+
+// Shape and parameters chosen for a SimplePIR database
+type Plan struct {
+	L         uint64
+	M         uint64
+	LogQ      uint64
+	RecordLen uint64 // bits per DB entry; the plaintext modulus is 1 << RecordLen
+	Params    *lwe.Params
+
+	Cols        [][]uint
+	Parts       []packing.ClusterPart // embeddings only: the cluster part in each chunk
+	NumParts    uint64                // queries needed to cover the most split cluster
+	Report      *packing.Report
+	ServerBytes uint64
+	Feasible    bool // whether the plan meets the targets
+}
+
+// The modulus q of each DB is fixed by its element type, Elem64 for the
+// embeddings and Elem32 for the urls, so the planner does not search over it
+const (
+	EMBEDDINGS_LOGQ = 64
+	URL_LOGQ        = 32
+)
+
+// How far from the square shape the planner looks, as a factor on the
+// column height
+const PLAN_SPREAD = 8
+
+type planInput struct {
+	name        string
+	chunks      []packing.Chunk
+	slotsPerCol uint64
+	logQ        uint64 // fixed by the element type of the DB
+	recordLen   uint64
+	numParts    uint64
+	strategy    string
+	targets     config.PlanTargets
+}
+
+// Smallest plaintext modulus, in bits, that holds the inner product of a
+// query with any embedding without wrapping around.
+func embeddingsRecordLen(c *corpus.Corpus) uint64 {
+	maxInnerProd := 2 * (uint64(1) << (2*c.GetSlotBits() - 2)) * c.GetEmbeddingSlots()
+	return uint64(bits.Len64(maxInnerProd - 1))
+}
+
+// Plaintext modulus of the embeddings DB of c, which scores are reduced by
+func EmbeddingsModulus(c *corpus.Corpus) uint64 {
+	return uint64(1) << embeddingsRecordLen(c)
+}
+
+// Tallest column the hint target allows, or 0 if there is no hint target
+func hintRows(logQ, recordLen uint64, t config.PlanTargets) uint64 {
+	if t.MaxHintMB <= 0 {
+		return 0
+	}
+
+	p := lwe.NewParamsFixedP(logQ, 1, 1<<recordLen)
+	if p == nil {
+		fmt.Printf("No SimplePIR parameters support logQ = %d with record length %d\n", logQ, recordLen)
+		panic("Failure in picking SimplePIR DB parameters")
+	}
+	return uint64(t.MaxHintMB*1024*1024) / (p.N * (logQ / 8))
+}
+
+// Clusters taller than the split threshold (by default, the tallest column
+// the hint target allows) are split across several columns.
+func PlanEmbeddings(c *corpus.Corpus, strategy string, conf *config.Config) *Plan {
+	logQ := uint64(EMBEDDINGS_LOGQ)
+	recordLen := embeddingsRecordLen(c)
+	targets := conf.EMBEDDINGS_PLAN_TARGETS()
+
+	maxRows := conf.EMBEDDINGS_SPLIT_ROWS()
+	if maxRows == 0 {
+		maxRows = hintRows(logQ, recordLen, targets)
+	}
+
+	chunks, parts, _ := packing.BuildEmbChunks(c, maxRows)
+	numParts := uint64(1)
+	for _, part := range parts {
+		if uint64(part.Part+1) > numParts {
+			numParts = uint64(part.Part + 1)
+		}
+	}
+	if numParts > 1 {
+		fmt.Printf("Split clusters of more than %d docs: each query covers %d parts\n", maxRows, numParts)
+	}
+
+	plan := makePlan(planInput{
+		name:        "Embeddings DB",
+		chunks:      chunks,
+		slotsPerCol: c.GetEmbeddingSlots(),
+		logQ:        logQ,
+		recordLen:   recordLen,
+		numParts:    numParts,
+		strategy:    strategy,
+		targets:     targets,
+	})
+	plan.Parts = parts
+
+	return plan
+}
+
+func PlanUrls(c *corpus.Corpus, strategy string, conf *config.Config) *Plan {
+	chunks, _ := packing.BuildUrlChunks(c)
+	return makePlan(planInput{
+		name:        "URL DB",
+		chunks:      chunks,
+		slotsPerCol: 1,
+		logQ:        URL_LOGQ,
+		recordLen:   8, // one byte per entry
+		numParts:    1,
+		strategy:    strategy,
+		targets:     conf.URL_PLAN_TARGETS(),
+	})
+}
+
+// How far the plan exceeds the targets, summed over all targets
+func (p *Plan) excess(t config.PlanTargets) float64 {
+	over := func(v, limit float64) float64 {
+		if limit <= 0 || v <= limit {
+			return 0
+		}
+		return v/limit - 1
+	}
+
+	return over(utils.BytesToMB(p.Report.HintBytes), t.MaxHintMB) +
+		over(utils.BytesToKB(p.QueryBytes()), t.MaxQueryKB) +
+		over(utils.BytesToKB(p.AnswerBytes()), t.MaxAnswerKB) +
+		over(utils.BytesToMB(p.ServerBytes), t.MaxServerMB)
+}
+
+// Upload per query, covering every part of a cluster
+func (p *Plan) QueryBytes() uint64 {
+	return p.NumParts * p.Report.QueryBytes
+}
+
+// Download per query, covering every part of a cluster
+func (p *Plan) AnswerBytes() uint64 {
+	return p.NumParts * p.Report.AnswerBytes
+}
+
+// Per-query communication, which the planner minimizes
+func (p *Plan) commBytes() uint64 {
+	return p.QueryBytes() + p.AnswerBytes()
+}
+
+// Packs the chunks for a range of column heights, and picks the shape with
+// the least per-query communication that meets the targets. If no shape
+// meets them, picks the one that exceeds them the least.
+func makePlan(in planInput) *Plan {
+	if len(in.chunks) == 0 {
+		panic("No chunks given")
+	}
+
+	elemBytes := in.logQ / 8
+	total := uint64(0)
+	maxChunk := uint64(1)
+	for _, ch := range in.chunks {
+		total += ch.Size()
+		if ch.Size() > maxChunk {
+			maxChunk = ch.Size()
+		}
+	}
+
+	// Tallest column the hint target allows
+	hintCap := hintRows(in.logQ, in.recordLen, in.targets)
+	if hintCap == 0 {
+		hintCap = total
+	}
+	if hintCap < maxChunk {
+		hintCap = maxChunk
+	}
+
+	// The min-cost strategy picks its own column count, so only bound it
+	capacities := []uint64{hintCap}
+	if in.strategy != config.PACKING_MIN_COST {
+		capacities = append(capacities, candidateCapacities(in, total, maxChunk)...)
+	}
+
+	fmt.Printf("Planning %s: %d chunks, %d values, logQ = %d (fixed by the element type), record length = %d bits\n",
+		in.name, len(in.chunks), total*in.slotsPerCol, in.logQ, in.recordLen)
+
+	candidates := make([]*Plan, 0)
+	seen := make(map[[2]uint64]bool)
+	tried := make(map[uint64]bool)
+
+	for _, capacity := range capacities {
+		if tried[capacity] {
+			continue
+		}
+		tried[capacity] = true
+		cols, colSzs := packing.Pack(in.chunks, capacity, in.strategy, in.slotsPerCol, packingCosts(in.logQ))
+
+		p := new(Plan)
+		p.NumParts = in.numParts
+		p.Cols = cols
+		p.LogQ = in.logQ
+		p.RecordLen = in.recordLen
+		p.Report = packingReport(in.strategy, colSzs, in.slotsPerCol, in.logQ, 1<<in.recordLen)
+		p.L, p.M = p.Report.L, p.Report.M
+
+		shape := [2]uint64{p.L, p.M}
+		if seen[shape] {
+			continue
+		}
+		seen[shape] = true
+
+		// Too many columns for this plaintext modulus
+		p.Params = lwe.NewParamsFixedP(in.logQ, p.M, 1<<in.recordLen)
+		if p.Params == nil {
+			continue
+		}
+
+		p.ServerBytes = (p.L*p.M + p.L*p.Params.N) * elemBytes
+		p.Feasible = (p.excess(in.targets) == 0)
+		candidates = append(candidates, p)
+	}
+
+	if len(candidates) == 0 {
+		fmt.Printf("No SimplePIR parameters support %s with record length %d\n", in.name, in.recordLen)
+		panic("Failure in picking SimplePIR DB parameters")
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].L < candidates[j].L
+	})
+
+	best := candidates[0]
+	for _, p := range candidates[1:] {
+		e, bestE := p.excess(in.targets), best.excess(in.targets)
+		if e < bestE ||
+			(e == bestE && (p.commBytes() < best.commBytes() ||
+				(p.commBytes() == best.commBytes() && p.Report.HintBytes < best.Report.HintBytes))) {
+			best = p
+		}
+	}
+
+	printCandidates(candidates, best)
+	best.Explain(in.name, in.targets)
+	return best
+}
+
+// Column heights that the planner tries, within a factor PLAN_SPREAD of the
+// square shape that minimizes communication, along with the heights that
+// just meet the query and answer targets. Packing the DB at every height
+// up to its size takes too long for the URL DB.
+func candidateCapacities(in planInput, total, maxChunk uint64) []uint64 {
+	clamp := func(c float64) uint64 {
+		return uint64(math.Max(float64(maxChunk), math.Min(float64(total), math.Ceil(c))))
+	}
+
+	// A column of height c gives an answer of c elements and a query of
+	// total/c columns of slotsPerCol elements each
+	square := math.Sqrt(float64(total * in.slotsPerCol))
+	out := make([]uint64, 0)
+	for c := float64(clamp(square / PLAN_SPREAD)); c < float64(clamp(square*PLAN_SPREAD)); c *= 1.25 {
+		out = append(out, clamp(c))
+	}
+	out = append(out, clamp(square*PLAN_SPREAD))
+
+	elems := func(kb float64) float64 {
+		return kb * 1024 / float64(in.logQ/8*in.numParts)
+	}
+	if t := in.targets.MaxQueryKB; t > 0 {
+		cols := math.Max(1, math.Floor(elems(t)/float64(in.slotsPerCol)))
+		out = append(out, clamp(float64(total)/cols), clamp(1.25*float64(total)/cols))
+	}
+	if t := in.targets.MaxAnswerKB; t > 0 {
+		out = append(out, clamp(elems(t)))
+	}
+	return out
+}
+
+// Shows the tradeoff between the shapes considered: taller columns shrink
+// the query but grow the answer and the hint.
+func printCandidates(candidates []*Plan, best *Plan) {
+	fmt.Printf("  %8s %8s %12s %12s %10s %12s %5s\n",
+		"L", "M", "Query (KB)", "Answer (KB)", "Hint (MB)", "Server (MB)", "Fits")
+	for _, p := range candidates {
+		mark := " "
+		if p == best {
+			mark = "*"
+		}
+		fmt.Printf("%s %8d %8d %12.2f %12.2f %10.2f %12.2f %5t\n",
+			mark, p.L, p.M,
+			utils.BytesToKB(p.QueryBytes()),
+			utils.BytesToKB(p.AnswerBytes()),
+			utils.BytesToMB(p.Report.HintBytes),
+			utils.BytesToMB(p.ServerBytes),
+			p.Feasible)
+	}
+}
+
+func (p *Plan) Explain(name string, t config.PlanTargets) {
+	limit := func(v float64) string {
+		if v <= 0 {
+			return "no limit"
+		}
+		return fmt.Sprintf("limit %.2f", v)
+	}
+
+	fmt.Printf("%s: %d by %d, logQ = %d (fixed), p = 2^%d, n = %d\n",
+		name, p.L, p.M, p.LogQ, p.RecordLen, p.Params.N)
+	fmt.Printf("\tHint:   %10.2f MB (%s)\n", utils.BytesToMB(p.Report.HintBytes), limit(t.MaxHintMB))
+	fmt.Printf("\tQuery:  %10.2f KB (%s)\n", utils.BytesToKB(p.QueryBytes()), limit(t.MaxQueryKB))
+	fmt.Printf("\tAnswer: %10.2f KB (%s)\n", utils.BytesToKB(p.AnswerBytes()), limit(t.MaxAnswerKB))
+	fmt.Printf("\tServer: %10.2f MB (%s)\n", utils.BytesToMB(p.ServerBytes), limit(t.MaxServerMB))
+	fmt.Printf("\tWasted cells: %d of %d\n", p.Report.WastedCells, p.L*p.M)
+	if p.NumParts > 1 {
+		fmt.Printf("\tEach query covers %d column ranges\n", p.NumParts)
+	}
+	if !p.Feasible {
+		fmt.Println("\tWARNING: no shape meets the targets -- picked the closest one")
+	}
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"fmt"
+	"search/config"
+	"search/corpus"
+	"search/packing"
+	"search/utils"
+	"sort"
+)
+
+type codecStats struct {
+	codec    string
+	storedSz uint64
+	urlBytes uint64
+	dictSz   uint64
+	l        uint64
+	m        uint64
+	hintSz   float64
+}
+
+// Reads the URL corpus once with each codec, and compares the size of the
+// resulting URL database.
+func CodecReport(clustersPerServer int, conf *config.Config) {
+	codecs := []string{config.URL_CODEC_NONE, config.URL_CODEC_ZLIB, config.URL_CODEC_ZSTD, config.URL_CODEC_ZSTD_DICT}
+	stats := make([]codecStats, len(codecs))
+
+	orig := conf.URL_CODEC()
+	defer conf.SetUrlCodec(orig)
+
+	for i, codec := range codecs {
+		fmt.Printf("Compressing urls with %s\n", codec)
+		conf.SetUrlCodec(codec)
+		c := corpus.ReadUrls(0, clustersPerServer, conf)
+
+		_, storedSz := packing.BuildUrlChunks(c)
+		report := PlanUrls(c, conf.PACKING_STRATEGY(), conf).Report
+
+		stats[i] = codecStats{
+			codec:    codec,
+			storedSz: storedSz,
+			urlBytes: c.GetUrlBytes(),
+			dictSz:   uint64(len(c.GetUrlDict())),
+			l:        report.L,
+			m:        report.M,
+			hintSz:   utils.BytesToMB(report.HintBytes),
+		}
+	}
+
+	fmt.Printf("\n%-10s %12s %10s %10s %8s %8s %10s %10s\n",
+		"Codec", "Stored (MB)", "UrlBytes", "Dict (KB)", "L", "M", "DB (MB)", "Hint (MB)")
+	for _, s := range stats {
+		fmt.Printf("%-10s %12.2f %10d %10.2f %8d %8d %10.2f %10.2f\n",
+			s.codec,
+			utils.BytesToMB(s.storedSz),
+			s.urlBytes,
+			utils.BytesToKB(s.dictSz),
+			s.l,
+			s.m,
+			utils.BytesToMB(s.l*s.m),
+			s.hintSz+utils.BytesToMB(s.dictSz))
+	}
+}
+
+// Packs both databases with every strategy, and compares the resulting
+// DB shapes.
+func PackingReport(conf *config.Config) {
+	embReports := make([]*packing.Report, 0)
+	urlReports := make([]*packing.Report, 0)
+
+	emb := corpus.ReadEmbeddings(0, conf.EMBEDDINGS_CLUSTERS_PER_SERVER(), conf)
+	for _, strategy := range packing.Strategies {
+		report := PlanEmbeddings(emb, strategy, conf).Report
+		embReports = append(embReports, report)
+	}
+
+	urls := corpus.ReadUrls(0, conf.URL_CLUSTERS_PER_SERVER(), conf)
+	for _, strategy := range packing.Strategies {
+		report := PlanUrls(urls, strategy, conf).Report
+		urlReports = append(urlReports, report)
+	}
+
+	printPackingTable("Embeddings DB", embReports)
+	printPackingTable("URL DB", urlReports)
+}
+
+func printPackingTable(name string, reports []*packing.Report) {
+	fmt.Printf("\n%s\n", name)
+	fmt.Printf("%-10s %8s %8s %8s %10s %10s %12s %12s %10s\n",
+		"Strategy", "Cols", "L", "M", "Wasted", "Wasted %", "Query (KB)", "Answer (KB)", "Hint (MB)")
+	for _, r := range reports {
+		fmt.Printf("%-10s %8d %8d %8d %10d %10.1f %12.2f %12.2f %10.2f\n",
+			r.Strategy, r.NumCols, r.L, r.M, r.WastedCells,
+			100*float64(r.WastedCells)/float64(r.L*r.M),
+			utils.BytesToKB(r.QueryBytes),
+			utils.BytesToKB(r.AnswerBytes),
+			utils.BytesToMB(r.HintBytes))
+	}
+}
+
+// Prints the distribution of cluster sizes, and the embeddings DB shape it
+// leads to. Returns nil if the corpus holds no docs.
+func ClusterSizeReport(c *corpus.Corpus, conf *config.Config) *Plan {
+	clusters := c.Clusters()
+	if len(clusters) == 0 || c.GetNumDocs() == 0 {
+		fmt.Printf("\n%d clusters and no docs\n", len(clusters))
+		return nil
+	}
+	sizes := make([]uint64, len(clusters))
+	for i, cluster := range clusters {
+		sizes[i] = c.NumDocsInCluster(cluster)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+
+	empty := 0
+	for _, sz := range sizes {
+		if sz == 0 {
+			empty += 1
+		}
+	}
+	pct := func(p float64) uint64 {
+		return sizes[int(p*float64(len(sizes)-1))]
+	}
+
+	fmt.Printf("\n%d clusters of %d docs (%d empty)\n", len(sizes), c.GetNumDocs(), empty)
+	fmt.Printf("\tMean %.1f; min %d; median %d; p90 %d; p99 %d; max %d\n",
+		float64(c.GetNumDocs())/float64(len(sizes)),
+		sizes[0], pct(0.5), pct(0.9), pct(0.99), sizes[len(sizes)-1])
+
+	// Histogram in powers of two
+	fmt.Printf("\t%12s %10s\n", "Docs", "Clusters")
+	for lo := uint64(1); lo <= sizes[len(sizes)-1]; lo *= 2 {
+		count := 0
+		for _, sz := range sizes {
+			if sz >= lo && sz < 2*lo {
+				count += 1
+			}
+		}
+		fmt.Printf("\t%5d-%-6d %10d\n", lo, 2*lo-1, count)
+	}
+
+	return PlanEmbeddings(c, conf.PACKING_STRATEGY(), conf)
+}
@@ -24,24 +24,26 @@ def find_nearest_clusters(cluster_index, query, num_clusters):
             #print("dist: %d id: %d" % (results[0][0][i], results[1][0][i]))
         return 0
 
-def find_nearest_clusters_from_file(centroids, query_embed, num_clusters):
+def find_nearest_clusters_from_file(centroids, query_embed, num_clusters, num_probe=NUM_CLUSTERS):
     query_float = numpy.array(query_embed).astype('float32')
     distances = numpy.asarray(numpy.matmul(centroids, numpy.transpose(numpy.asmatrix(query_float))))
-    res = numpy.argpartition(distances, -NUM_CLUSTERS, axis=0)
-    res = sorted(res[-NUM_CLUSTERS:], key=lambda i: distances[i], reverse=True)
-    topk = res[-NUM_CLUSTERS:]
+    k = min(len(centroids), num_probe)
+    res = numpy.argpartition(distances, -k, axis=0)
+    res = sorted(res[-k:], key=lambda i: distances[i], reverse=True)
+    topk = [int(i) for i in res if i < num_clusters][:num_probe]
 
-    if topk[0] < num_clusters:
-        return topk[0]
-    return 0
+    if len(topk) == 0:
+        return [0]
+    return topk
 
 def main():
-    if len(sys.argv) != 3:
-        raise ValueError("Usage: %s preamble num_clusters" % sys.argv[0])
+    if len(sys.argv) != 3 and len(sys.argv) != 4:
+        raise ValueError("Usage: %s preamble num_clusters [num_probe]" % sys.argv[0])
 
     #start1 = time.time()
     preamble = sys.argv[1]
     num_clusters = int(sys.argv[2])
+    num_probe = int(sys.argv[3]) if len(sys.argv) == 4 else NUM_CLUSTERS
 
     # clusterfile = CENTROIDS_FILE % preamble
     # f1 = open(clusterfile, "rb")
@@ -49,8 +51,12 @@ def main():
     # f1.close()
 
     # Alternative (with file instead of FAISS)
+    # Centroids recomputed by the Go rebalancer live in the reduced space of
+    # the stored embeddings, and are matched against the reduced query
     centroids = numpy.loadtxt(CENTROIDS_FILE % preamble)
-    centroids = numpy.round(centroids * (1 << prec))
+    reduced_centroids = (centroids.shape[1] == new_dimension)
+    if not reduced_centroids:
+        centroids = numpy.round(centroids * (1 << prec))
 
     components = numpy.load(PCA_COMPONENTS_FILE % preamble)
 
@@ -71,14 +77,17 @@ def main():
         #end2 = time.time()
         #print("Embedding: ", end2-start2)
 
+        out = numpy.clip(numpy.round(numpy.matmul(v, components)/10), -16, 15).astype('int')
+
         # result = find_nearest_clusters(index, [v], num_clusters)
-        result = find_nearest_clusters_from_file(centroids, [v], num_clusters)
+        if reduced_centroids:
+            result = find_nearest_clusters_from_file(centroids, [out], num_clusters, num_probe)
+        else:
+            result = find_nearest_clusters_from_file(centroids, [v], num_clusters, num_probe)
 
         #end3 = time.time()
         #print("Find closest cluster: ", end3-end2)
-
-        out = numpy.clip(numpy.round(numpy.matmul(v, components)/10), -16, 15).astype('int')
-        sys.stdout.write(json.dumps({"Cluster_index": int(result), "Emb": out.tolist()}))
+        sys.stdout.write(json.dumps({"Cluster_index": result[0], "Cluster_indices": result, "Emb": out.tolist()}))
         sys.stdout.flush()
         #end4 = time.time()
         #print("PCA: ", end4-end3)
@@ -1,6 +1,7 @@
 package embeddings
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
@@ -11,6 +12,12 @@ import (
 )
 
 func SetupEmbeddingProcess(numClusters int, conf *config.Config) (io.WriteCloser, io.ReadCloser) {
+	return SetupEmbeddingProcessProbing(numClusters, 1, conf)
+}
+
+// Starts an embedding process that returns the numProbe nearest clusters
+// of each query, nearest first
+func SetupEmbeddingProcessProbing(numClusters, numProbe int, conf *config.Config) (io.WriteCloser, io.ReadCloser) {
 	preamble := conf.PREAMBLE()
 	if preamble == "/data/pdos/web-search/" {
 		preamble += "cluster_centroids/"
@@ -18,7 +25,7 @@ func SetupEmbeddingProcess(numClusters int, conf *config.Config) (io.WriteCloser
 
 	toRun := "embeddings/embed_text.py"
 
-	cmd := exec.Command("python3", toRun, preamble, strconv.Itoa(numClusters))
+	cmd := exec.Command("python3", toRun, preamble, strconv.Itoa(numClusters), strconv.Itoa(numProbe))
 	fmt.Println(cmd.String())
 	stdin, err1 := cmd.StdinPipe()
 	if err1 != nil {
@@ -39,6 +46,33 @@ func SetupEmbeddingProcess(numClusters int, conf *config.Config) (io.WriteCloser
 	return stdin, stdout
 }
 
+// Embeds a query with the process started by SetupEmbeddingProcess, and
+// returns the nearest cluster and the quantized embedding.
+func EmbedQuery(in io.Writer, out io.Reader, text string) (uint64, []int8) {
+	clusters, emb := EmbedQueryClusters(in, out, text)
+	return clusters[0], emb
+}
+
+// As EmbedQuery, but returns all the clusters the process was set up to
+// probe, nearest first
+func EmbedQueryClusters(in io.Writer, out io.Reader, text string) ([]uint64, []int8) {
+	var query struct {
+		Cluster_index   uint64
+		Cluster_indices []uint64
+		Emb             []int8
+	}
+
+	io.WriteString(in, text+"\n")
+	if err := json.NewDecoder(out).Decode(&query); err != nil {
+		panic(err)
+	}
+
+	if len(query.Cluster_indices) == 0 {
+		return []uint64{query.Cluster_index}, query.Emb
+	}
+	return query.Cluster_indices, query.Emb
+}
+
 func RandomEmbedding(length, mod uint64) []int8 {
 	vals := make([]int8, length)
 
@@ -0,0 +1,203 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"search/corpus"
+	"search/database"
+	"search/embeddings"
+	"search/framework"
+)
+
+// Embeds a query as the client does: returns the cluster to probe and the
+// quantized embedding
+type EmbedFunc func(text string) (uint64, []int8)
+
+// Runs the private search for an embedded query over a cluster, returning
+// the results by chunk, as protocol.Client.SearchClusters does
+type ClusterSearchFunc func(cluster uint64, emb []int8) ([][][]framework.Answer, error)
+
+// A result, identified by its normalized url
+type Hit struct {
+	Id      string
+	Url     string
+	Score   int
+	Cluster uint
+}
+
+// Searches a corpus in the clear, to measure what the private search loses
+type Searcher struct {
+	emb    *corpus.Corpus
+	urls   *corpus.Corpus
+	urlMap database.SubclusterMap
+	mod    uint64 // plaintext modulus of the embeddings DB
+
+	centroids [][]float64 // by cluster id, as corpus.ReadCentroids reads them
+}
+
+// The centroids are needed only to search the nearest clusters, and may be
+// nil otherwise
+func NewSearcher(emb, urls *corpus.Corpus, centroids [][]float64) *Searcher {
+	s := new(Searcher)
+	s.emb = emb
+	s.urls = urls
+	s.centroids = centroids
+	s.urlMap = database.SubclusterMap(urls.UrlSubclusters())
+	s.mod = database.EmbeddingsModulus(emb)
+	return s
+}
+
+// One more than the largest cluster id, as the embedder expects
+func (s *Searcher) ClusterIdBound() int {
+	bound := 0
+	for _, cluster := range s.emb.Clusters() {
+		if int(cluster)+1 > bound {
+			bound = int(cluster) + 1
+		}
+	}
+	return bound
+}
+
+// The score that the client decodes from a PIR answer: the inner product,
+// reduced mod the plaintext modulus of the DB
+func (s *Searcher) score(query []int8, cluster uint, doc uint64) int {
+	index := uint64(s.emb.ClusterToIndex(cluster)) + doc*s.emb.GetEmbeddingSlots()
+	return reduceScore(embeddings.InnerProduct(query, s.emb.GetEmbedding(index)), s.mod)
+}
+
+func reduceScore(score int, mod uint64) int {
+	m := int64(mod)
+	return embeddings.SmoothResult(uint64((int64(score)%m+m)%m), mod)
+}
+
+// Clusters in decreasing order of inner product of their centroid with the
+// query, as the embedder routes queries. Clusters without a centroid come
+// last.
+func (s *Searcher) nearestClusters(query []int8) []uint {
+	if s.centroids == nil {
+		panic("No centroids to find the nearest clusters by")
+	}
+
+	clusters := s.emb.Clusters()
+	dot := make(map[uint]float64, len(clusters))
+	for _, cluster := range clusters {
+		if int(cluster) >= len(s.centroids) {
+			dot[cluster] = math.Inf(-1)
+			continue
+		}
+		for i, v := range query {
+			dot[cluster] += float64(v) * s.centroids[cluster][i]
+		}
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return dot[clusters[i]] > dot[clusters[j]]
+	})
+	return clusters
+}
+
+// The k best docs by inner product with the query, among the probe
+// clusters nearest to it (or all clusters if probe is 0), as a non-private
+// search would return them.
+func (s *Searcher) Exact(query []int8, k, probe int) []Hit {
+	clusters := s.emb.Clusters()
+	if probe > 0 && probe < len(clusters) {
+		clusters = s.nearestClusters(query)[:probe]
+	}
+
+	type candidate struct {
+		cluster uint
+		doc     uint64
+		score   int
+	}
+	candidates := make([]candidate, 0)
+	for _, cluster := range clusters {
+		n := s.emb.NumDocsInCluster(cluster)
+		for j := uint64(0); j < n; j++ {
+			candidates = append(candidates, candidate{cluster, j, s.score(query, cluster, j)})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if a.cluster != b.cluster {
+			return a.cluster < b.cluster
+		}
+		return a.doc < b.doc
+	})
+
+	hits := make([]Hit, 0, k)
+	seen := make(map[string]bool)
+	docs := make(map[uint][]corpus.Doc)
+	for _, cand := range candidates {
+		if len(hits) >= k {
+			break
+		}
+		if _, ok := docs[cand.cluster]; !ok {
+			docs[cand.cluster] = s.urls.GetUrlsInCluster(uint64(cand.cluster))
+		}
+
+		d := docs[cand.cluster][cand.doc]
+		id := corpus.NormalizeUrl(d.Url)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		hits = append(hits, Hit{Id: id, Url: d.Url, Score: cand.score, Cluster: cand.cluster})
+	}
+	return hits
+}
+
+// Compares the results of the private search with the exact search for
+// each query. The exact top k docs count as relevant for recall and nDCG,
+// and the exact top doc for MRR. Queries whose search fails are skipped.
+func (s *Searcher) Baseline(queries []Query, embed EmbedFunc, search ClusterSearchFunc, k, probe int) *Metrics {
+	m := new(Metrics)
+	routed, failed := 0, 0
+
+	fmt.Printf("%-12s %8s %8s %8s %8s\n", "Query", "Cluster", "Recall", "RR", "nDCG")
+	for _, q := range queries {
+		cluster, emb := embed(q.Text)
+		results, err := search(cluster, emb)
+		if err != nil {
+			fmt.Printf("%-12s %8d search failed: %v\n", q.Id, cluster, err)
+			failed += 1
+			continue
+		}
+		exact := s.Exact(emb, k, probe)
+		private := rankPrivate(results, 1, math.MaxInt, k)
+
+		rel := make(Relevance)
+		top := make(Relevance)
+		for _, h := range exact {
+			rel[h.Id] = 1
+		}
+		if len(exact) > 0 {
+			top[exact[0].Id] = 1
+			if exact[0].Cluster == uint(cluster) {
+				routed += 1
+			}
+		}
+
+		recall := RecallAtK(private, rel, k)
+		rr := ReciprocalRank(private, top, k)
+		ndcg := NDCGAtK(private, rel, k)
+		m.addScores(recall, rr, ndcg)
+		fmt.Printf("%-12s %8d %8.4f %8.4f %8.4f\n", q.Id, cluster, recall, rr, ndcg)
+	}
+
+	fmt.Println()
+	printMetricsHeader("Private vs. exact", k)
+	m.print("")
+	if failed > 0 {
+		fmt.Printf("Skipped %d queries whose search failed\n", failed)
+	}
+	fmt.Printf("The exact top doc was in the probed cluster for %d of %d queries\n", routed, m.Queries)
+	if probe > 0 {
+		fmt.Printf("(exact search over the %d nearest clusters)\n", probe)
+	}
+	return m
+}
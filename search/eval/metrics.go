@@ -0,0 +1,111 @@
+package eval
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Graded relevance of docs to a query, keyed by doc id. Missing docs are
+// not relevant.
+type Relevance map[string]int
+
+func (rel Relevance) numRelevant() int {
+	n := 0
+	for _, r := range rel {
+		if r > 0 {
+			n += 1
+		}
+	}
+	return n
+}
+
+// Fraction of the relevant docs found in the first k results
+func RecallAtK(ranked []string, rel Relevance, k int) float64 {
+	n := rel.numRelevant()
+	if n == 0 {
+		return 0
+	}
+
+	found := 0
+	for i := 0; i < k && i < len(ranked); i++ {
+		if rel[ranked[i]] > 0 {
+			found += 1
+		}
+	}
+	return float64(found) / float64(n)
+}
+
+// One over the rank of the first relevant doc in the first k results
+func ReciprocalRank(ranked []string, rel Relevance, k int) float64 {
+	for i := 0; i < k && i < len(ranked); i++ {
+		if rel[ranked[i]] > 0 {
+			return 1 / float64(i+1)
+		}
+	}
+	return 0
+}
+
+// Normalized discounted cumulative gain of the first k results, with gains
+// of 2^rel - 1
+func NDCGAtK(ranked []string, rel Relevance, k int) float64 {
+	dcg := 0.0
+	for i := 0; i < k && i < len(ranked); i++ {
+		dcg += gain(rel[ranked[i]], i)
+	}
+
+	ideal := make([]int, 0, len(rel))
+	for _, r := range rel {
+		if r > 0 {
+			ideal = append(ideal, r)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ideal)))
+
+	idcg := 0.0
+	for i := 0; i < k && i < len(ideal); i++ {
+		idcg += gain(ideal[i], i)
+	}
+
+	if idcg == 0 {
+		return 0
+	}
+	return dcg / idcg
+}
+
+func gain(rel, rank int) float64 {
+	if rel <= 0 {
+		return 0
+	}
+	return (math.Pow(2, float64(rel)) - 1) / math.Log2(float64(rank+2))
+}
+
+// Metrics averaged over a set of queries
+type Metrics struct {
+	Queries int
+	Recall  float64
+	MRR     float64
+	NDCG    float64
+}
+
+func (m *Metrics) Add(ranked []string, rel Relevance, k int) {
+	m.addScores(RecallAtK(ranked, rel, k), ReciprocalRank(ranked, rel, k), NDCGAtK(ranked, rel, k))
+}
+
+func (m *Metrics) addScores(recall, rr, ndcg float64) {
+	// Running means
+	m.Queries += 1
+	n := float64(m.Queries)
+	m.Recall += (recall - m.Recall) / n
+	m.MRR += (rr - m.MRR) / n
+	m.NDCG += (ndcg - m.NDCG) / n
+}
+
+func printMetricsHeader(name string, k int) {
+	fmt.Printf("%-24s %8s %10s %10s %10s\n",
+		name, "Queries", fmt.Sprintf("Recall@%d", k), fmt.Sprintf("MRR@%d", k), fmt.Sprintf("nDCG@%d", k))
+}
+
+func (m *Metrics) print(name string) {
+	fmt.Printf("%-24s %8d %10.4f %10.4f %10.4f\n", name, m.Queries, m.Recall, m.MRR, m.NDCG)
+}
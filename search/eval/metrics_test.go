@@ -0,0 +1,97 @@
+package eval
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"search/framework"
+)
+
+func TestRecallAtK(t *testing.T) {
+	rel := Relevance{"a": 1, "b": 2, "c": 0}
+	tests := []struct {
+		name   string
+		ranked []string
+		rel    Relevance
+		k      int
+		want   float64
+	}{
+		{"all found", []string{"b", "a"}, rel, 2, 1},
+		{"cut at k", []string{"x", "a", "b"}, rel, 2, 0.5},
+		{"zero grade is not relevant", []string{"c", "x"}, rel, 2, 0},
+		{"fewer results than k", []string{"a"}, rel, 10, 0.5},
+		{"no relevant docs", []string{"a"}, Relevance{}, 1, 0},
+		{"no results", nil, rel, 5, 0},
+	}
+
+	for _, test := range tests {
+		if got := RecallAtK(test.ranked, test.rel, test.k); got != test.want {
+			t.Errorf("%s: recall %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNDCGAtK(t *testing.T) {
+	rel := Relevance{"a": 1, "b": 2}
+	// Gains of 2^rel - 1, discounted by log2(rank + 1)
+	ideal := 3 + 1/math.Log2(3)
+	tests := []struct {
+		name   string
+		ranked []string
+		k      int
+		want   float64
+	}{
+		{"ideal order", []string{"b", "a"}, 2, 1},
+		{"swapped", []string{"a", "b"}, 2, (1 + 3/math.Log2(3)) / ideal},
+		{"one miss first", []string{"x", "b"}, 2, (3 / math.Log2(3)) / ideal},
+		{"cut at k", []string{"a", "b"}, 1, 1.0 / 3},
+		{"none relevant", []string{"x", "y"}, 2, 0},
+	}
+
+	for _, test := range tests {
+		if got := NDCGAtK(test.ranked, rel, test.k); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: nDCG %v, want %v", test.name, got, test.want)
+		}
+	}
+	if got := NDCGAtK([]string{"a"}, Relevance{}, 1); got != 0 {
+		t.Errorf("no judgments: nDCG %v", got)
+	}
+}
+
+func TestReduceScore(t *testing.T) {
+	tests := []struct {
+		score int
+		mod   uint64
+		want  int
+	}{
+		{5, 16, 5},
+		{-5, 16, -5},
+		{9, 16, -7}, // wraps around, as PIR answers do
+		{-9, 16, 7},
+		{8, 16, 8},
+	}
+
+	for _, test := range tests {
+		if got := reduceScore(test.score, test.mod); got != test.want {
+			t.Errorf("reduceScore(%d, %d) = %d, want %d", test.score, test.mod, got, test.want)
+		}
+	}
+}
+
+// A failed search is left out of the metrics, rather than scored as empty
+func TestPrivateSkipsFailures(t *testing.T) {
+	queries := []Query{{"q1", "found"}, {"q2", "fails"}}
+	qrels := Qrels{"q1": {"a.example": 1}, "q2": {"a.example": 1}}
+	search := func(text string) ([][][]framework.Answer, error) {
+		if text == "fails" {
+			return nil, errors.New("connection reset")
+		}
+		return [][][]framework.Answer{{{{Url: "https://a.example", Score: 1}}}}, nil
+	}
+
+	m := Private(queries, qrels, search, 10, 1, 1)[0][0]
+	if m.Queries != 1 || m.Recall != 1 {
+		t.Fatalf("scored %d queries with recall %v, want 1 with recall 1", m.Queries, m.Recall)
+	}
+}
@@ -0,0 +1,96 @@
+package eval
+
+import (
+	"fmt"
+	"sort"
+
+	"search/corpus"
+	"search/framework"
+)
+
+// Runs a private search for a query, returning the results by probed
+// cluster, then by fetched URL chunk, as protocol.Client.SearchClusters does
+type PrivateSearchFunc func(text string) ([][][]framework.Answer, error)
+
+// The results of the first probe clusters and of the first chunks chunks
+// fetched from each, by decreasing score, without repeating a page
+func rankPrivate(results [][][]framework.Answer, probe, chunks, k int) []string {
+	merged := make([]framework.Answer, 0)
+	for i := 0; i < probe && i < len(results); i++ {
+		for j := 0; j < chunks && j < len(results[i]); j++ {
+			merged = append(merged, results[i][j]...)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Score > merged[j].Score
+	})
+
+	ranked := make([]string, 0, k)
+	seen := make(map[string]bool)
+	for _, a := range merged {
+		if len(ranked) >= k {
+			break
+		}
+		id := corpus.NormalizeUrl(a.Url)
+		if !seen[id] {
+			seen[id] = true
+			ranked = append(ranked, id)
+		}
+	}
+	return ranked
+}
+
+// Scores the private search against the judgments, for every number of
+// probed clusters up to maxProbe and of URL chunks fetched per cluster up to
+// maxChunks. Returns the metrics indexed by [probe-1][chunks-1]. Queries
+// without judgments, and queries whose search fails, are skipped.
+func Private(queries []Query, qrels Qrels, search PrivateSearchFunc, k, maxProbe, maxChunks int) [][]*Metrics {
+	metrics := make([][]*Metrics, maxProbe)
+	for p := range metrics {
+		metrics[p] = make([]*Metrics, maxChunks)
+		for ch := range metrics[p] {
+			metrics[p][ch] = new(Metrics)
+		}
+	}
+
+	skipped, failed := 0, 0
+	for n, q := range queries {
+		rel, ok := qrels[q.Id]
+		if !ok {
+			skipped += 1
+			continue
+		}
+
+		results, err := search(q.Text)
+		if err != nil {
+			fmt.Printf("Search for query %s failed: %v\n", q.Id, err)
+			failed += 1
+			continue
+		}
+		for p := 1; p <= maxProbe; p++ {
+			for ch := 1; ch <= maxChunks; ch++ {
+				metrics[p-1][ch-1].Add(rankPrivate(results, p, ch, k), rel, k)
+			}
+		}
+
+		if (n+1)%100 == 0 {
+			fmt.Printf("Evaluated %d queries\n", n+1)
+		}
+	}
+
+	fmt.Println()
+	if skipped > 0 {
+		fmt.Printf("Skipped %d queries without judgments\n", skipped)
+	}
+	if failed > 0 {
+		fmt.Printf("Skipped %d queries whose search failed\n", failed)
+	}
+	printMetricsHeader("Clusters x chunks", k)
+	for p := 1; p <= maxProbe; p++ {
+		for ch := 1; ch <= maxChunks; ch++ {
+			// Each probe is one embeddings query, and each chunk one URL query
+			metrics[p-1][ch-1].print(fmt.Sprintf("%d x %d (%d PIR queries)", p, ch, p*(1+ch)))
+		}
+	}
+	return metrics
+}
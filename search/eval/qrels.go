@@ -0,0 +1,73 @@
+package eval
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"search/corpus"
+	"search/utils"
+)
+
+// Relevance judgments, keyed by query id
+type Qrels map[string]Relevance
+
+// Reads relevance judgments in the TREC qrels format ("qid iter docid rel"
+// per line), which the MS MARCO qrels also follow, or as "qid docid rel".
+// Results are identified by their normalized url, so doc ids are mapped to
+// urls with docUrls; ids missing from docUrls are taken to be urls.
+func ReadQrels(file string, docUrls map[string]string) Qrels {
+	f := utils.OpenFile(file)
+	defer f.Close()
+
+	qrels := make(Qrels)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	unmapped := 0
+
+	for scanner.Scan() {
+		line += 1
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 && len(fields) != 4 {
+			fmt.Printf("Line %d of %s: %s\n", line, file, scanner.Text())
+			panic("Expected \"qid iter docid rel\" or \"qid docid rel\"")
+		}
+
+		qid, docId := fields[0], fields[len(fields)-2]
+		rel, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil {
+			fmt.Printf("Line %d of %s: %s\n", line, file, err)
+			panic("Bad relevance")
+		}
+
+		docUrl, ok := docUrls[docId]
+		if !ok {
+			docUrl = docId
+			unmapped += 1
+		}
+
+		if _, ok := qrels[qid]; !ok {
+			qrels[qid] = make(Relevance)
+		}
+		id := corpus.NormalizeUrl(docUrl)
+		if rel > qrels[qid][id] {
+			qrels[qid][id] = rel
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Println(err)
+		fmt.Println(file)
+		panic("Error reading file")
+	}
+
+	fmt.Printf("Read judgments for %d queries\n", len(qrels))
+	if unmapped > 0 {
+		fmt.Printf("\t%d judged doc ids are not in the corpus, and were taken as urls\n", unmapped)
+	}
+	return qrels
+}
@@ -0,0 +1,31 @@
+package eval
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadQrels(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "qrels.txt")
+	contents := "q1 0 d1 1\n" +
+		"q1 0 d2 0\n" + // not relevant
+		"\n" +
+		"q2 https://www.Example.com/page/ 2\n" +
+		"q2 0 d1 3\n" +
+		"q1 0 d1 0\n" // a lower grade for the same doc is ignored
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	docUrls := map[string]string{"d1": "http://site.example/one", "d2": "http://site.example/two"}
+	got := ReadQrels(file, docUrls)
+	want := Qrels{
+		"q1": {"site.example/one": 1},
+		"q2": {"example.com/page": 2, "site.example/one": 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("qrels %v, want %v", got, want)
+	}
+}
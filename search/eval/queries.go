@@ -0,0 +1,50 @@
+package eval
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"search/utils"
+)
+
+type Query struct {
+	Id   string
+	Text string
+}
+
+// Reads queries in the MS MARCO format ("qid<TAB>text" per line), or one
+// query per line, in which case the ids are the line numbers.
+func ReadQueries(file string) []Query {
+	f := utils.OpenFile(file)
+	defer f.Close()
+
+	queries := make([]Query, 0)
+	scanner := bufio.NewScanner(f)
+	line := 0
+
+	for scanner.Scan() {
+		line += 1
+		txt := strings.TrimSpace(scanner.Text())
+		if len(txt) == 0 {
+			continue
+		}
+
+		q := Query{Id: strconv.Itoa(line), Text: txt}
+		if fields := strings.SplitN(txt, "\t", 2); len(fields) == 2 {
+			q.Id = strings.TrimSpace(fields[0])
+			q.Text = strings.TrimSpace(fields[1])
+		}
+		queries = append(queries, q)
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Println(err)
+		fmt.Println(file)
+		panic("Error reading file")
+	}
+
+	fmt.Printf("Read %d queries\n", len(queries))
+	return queries
+}
@@ -1,6 +1,8 @@
 package framework
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -12,8 +14,10 @@ type Request struct {
 }
 
 type Answer struct {
-	Score int    `json:"score"`
-	Url   string `json:"url"`
+	Score   int    `json:"score"`
+	Url     string `json:"url"`
+	Title   string `json:"title"`
+	Snippet string `json:"snippet"`
 }
 
 type Responce struct {
@@ -22,7 +26,20 @@ type Responce struct {
 	Data []Answer `json:"data"`
 }
 
-func Setup(ch chan []Answer, done chan string) {
+// A search for the searcher to run. It should give up once Ctx is done,
+// i.e. once the user is gone.
+type Query struct {
+	Text  string
+	Ctx   context.Context
+	Reply chan Result // buffered, so that the searcher never waits on it
+}
+
+type Result struct {
+	Answers []Answer
+	Err     error
+}
+
+func Setup(queries chan Query) {
 	r := gin.Default()
 	r.LoadHTMLGlob("templates/*")
 
@@ -43,11 +60,26 @@ func Setup(ch chan []Answer, done chan string) {
 			})
 			return
 		}
-		done <- request.Text
-		data := <-ch
+		q := Query{Text: request.Text, Ctx: c.Request.Context(), Reply: make(chan Result, 1)}
+		var result Result
+		select {
+		case queries <- q:
+			result = <-q.Reply
+		case <-q.Ctx.Done():
+			return
+		}
+		if result.Err != nil {
+			responce.Code = http.StatusBadGateway
+			if errors.Is(result.Err, context.DeadlineExceeded) {
+				responce.Code = http.StatusGatewayTimeout
+			}
+			responce.Msg = "查询失败: " + result.Err.Error()
+			c.JSON(responce.Code, responce)
+			return
+		}
 		responce.Code = http.StatusOK
 		responce.Msg = "查询成功"
-		responce.Data = data
+		responce.Data = result.Answers
 		c.JSON(http.StatusOK, responce)
 		return
 	})
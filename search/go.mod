@@ -4,8 +4,10 @@ go 1.20
 
 require (
 	github.com/ahenzinger/underhood v0.0.0-20230922182337-f053a81c6385
+	github.com/cloudflare/circl v1.3.7
 	github.com/fatih/color v1.15.0
 	github.com/henrycg/simplepir v0.0.0-20230920020624-026ee7bd6783
+	github.com/klauspost/compress v1.17.9
 )
 
 require (
@@ -26,9 +28,9 @@ require (
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	github.com/ugorji/go/codec v1.2.11 // indirect
 	golang.org/x/arch v0.3.0 // indirect
-	golang.org/x/crypto v0.9.0 // indirect
+	golang.org/x/crypto v0.17.0 // indirect
 	golang.org/x/net v0.10.0 // indirect
-	golang.org/x/text v0.9.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/protobuf v1.30.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -37,5 +39,5 @@ require (
 	github.com/gin-gonic/gin v1.9.1
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	golang.org/x/sys v0.8.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
 )
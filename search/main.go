@@ -1,96 +1,453 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"math"
 	"os"
+	"os/signal"
 	"search/config"
+	"search/corpus"
+	"search/database"
+	"search/embeddings"
+	"search/eval"
 	"search/framework"
 	"search/protocol"
+	"search/tokens"
 	"search/utils"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Where the corpus is stored
 // var preamble = flag.String("preamble", "/home/ubuntu", "Preamble")
 
 func printUsage() {
-	fmt.Println("Usage:\n\"go run . all-servers\" or\n\"go run . client coordinator-ip\" or\n\"go run . coordinator numEmbServers numUrlServers ip1 ip2 ...\" or\n\"go run . emb-server index\" or\n\"go run . url-server index\" or\n\"go run . client-latency coordinator-ip\" or\n\"go run . client-tput-embed coordinator-ip\" or\n\"go run . client-tput-url coordinator-ip\" or\n\"go run . client-tput-offline coordinator-ip\"")
+	fmt.Println("Usage:\n\"go run . all-servers\" or\n\"go run . client coordinator-ip\" or\n\"go run . coordinator numEmbServers numUrlServers ip1 ip2 ...\" or\n\"go run . emb-server index\" or\n\"go run . url-server index\" or\n\"go run . token-issuer\" or\n\"go run . codec-report\" or\n\"go run . corpus-check [report.json]\" or\n\"go run . packing-report\" or\n\"go run . answer-checks\" or\n\"go run . plan\" or\n\"go run . eval queries.tsv qrels.txt [probe chunks]\" or\n\"go run . eval-baseline queries.tsv [k probe]\" or\n\"go run . gen-corpus [-sizes zipf -empty 0 -subcluster-docs 20 -slot-bits 5 -min-url-len 30 -max-url-len 80 -seed 1] [clusters meanDocs]\" or\n\"go run . rebalance out-preamble [maxDocs minDocs]\" or\n\"go run . client-latency coordinator-ip\" or\n\"go run . client-tput-embed coordinator-ip\" or\n\"go run . client-tput-url coordinator-ip\" or\n\"go run . client-tput-offline coordinator-ip\"")
+}
+
+type shutdowner interface {
+	Shutdown(timeout time.Duration) bool
+}
+
+// Waits for SIGINT or SIGTERM, or for "quit" on stdin unless daemon, then
+// shuts the servers down, letting the calls in flight finish for up to
+// drain. Exits with an error if some did not.
+func waitToShutDown(daemon bool, drain time.Duration, servers ...shutdowner) {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	if !daemon {
+		fmt.Println("Input 'quit' to quit")
+		go func() {
+			in := bufio.NewScanner(os.Stdin)
+			for in.Scan() {
+				if strings.TrimSpace(in.Text()) == "quit" {
+					quit <- syscall.SIGTERM
+					return
+				}
+			}
+		}()
+	}
+	<-quit
+	signal.Stop(quit)
+
+	fmt.Printf("Shutting down, waiting up to %v for calls in flight\n", drain)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	drained := true
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s shutdowner) {
+			defer wg.Done()
+			if !s.Shutdown(drain) {
+				mu.Lock()
+				drained = false
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	if !drained {
+		fmt.Println("Calls still in flight were dropped")
+		os.Exit(1)
+	}
+	fmt.Println("Shut down")
+}
+
+// Overrides the default targets with any limits given on the command line
+func planTargets(t config.PlanTargets, hintMB, queryKB, answerKB, serverMB float64) config.PlanTargets {
+	if hintMB > 0 {
+		t.MaxHintMB = hintMB
+	}
+	if queryKB > 0 {
+		t.MaxQueryKB = queryKB
+	}
+	if answerKB > 0 {
+		t.MaxAnswerKB = answerKB
+	}
+	if serverMB > 0 {
+		t.MaxServerMB = serverMB
+	}
+	return t
+}
+
+// The admin port given on the command line, or the role's own if none was
+func orDefault(port, roleDefault int) int {
+	if port < 0 {
+		return roleDefault
+	}
+	return port
+}
+
+// Rebalances the text corpus of conf into a new preamble, and compares the
+// cluster sizes and DB shape before and after
+func rebalance(args []string, conf *config.Config) {
+	out := conf.WithPreamble(args[0] + "/data")
+
+	before := corpus.ReadEmbeddingsTxt(0, conf.NUM_CLUSTERS(), conf)
+	beforePlan := database.ClusterSizeReport(before, conf)
+	if beforePlan == nil {
+		fmt.Println("Nothing to rebalance")
+		return
+	}
+
+	mean := float64(before.GetNumDocs()) / float64(conf.NUM_CLUSTERS())
+	maxDocs := uint64(conf.REBALANCE_MAX_FACTOR() * mean)
+	minDocs := uint64(math.Ceil(conf.REBALANCE_MIN_FACTOR() * mean))
+	if len(args) == 3 {
+		var err1, err2 error
+		maxDocs, err1 = strconv.ParseUint(args[1], 10, 64)
+		minDocs, err2 = strconv.ParseUint(args[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			printUsage()
+			return
+		}
+	}
+	fmt.Printf("Splitting clusters of more than %d docs, merging clusters of less than %d docs\n", maxDocs, minDocs)
+
+	corpus.RebalanceTxt(conf, out, maxDocs, minDocs)
+
+	after := corpus.ReadEmbeddingsTxt(0, out.NUM_CLUSTERS(), out)
+	afterPlan := database.ClusterSizeReport(after, out)
+
+	fmt.Printf("\nEmbeddings DB went from %d by %d to %d by %d\n",
+		beforePlan.L, beforePlan.M, afterPlan.L, afterPlan.M)
+	fmt.Printf("Per-query communication went from %.2f KB to %.2f KB\n",
+		utils.BytesToKB(beforePlan.QueryBytes()+beforePlan.AnswerBytes()),
+		utils.BytesToKB(afterPlan.QueryBytes()+afterPlan.AnswerBytes()))
+}
+
+// Compares the private search against the local servers with an exact
+// search over the plaintext corpus, embedding the queries as the client does
+func evalBaseline(args []string, conf *config.Config) {
+	k := protocol.NUM_RESULTS
+	probe := 0
+	if len(args) == 3 {
+		var err1, err2 error
+		k, err1 = strconv.Atoi(args[1])
+		probe, err2 = strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			printUsage()
+			return
+		}
+	}
+
+	queries := eval.ReadQueries(args[0])
+	var centroids [][]float64
+	if probe > 0 {
+		centroids = corpus.ReadCentroids(conf)
+	}
+	s := eval.NewSearcher(corpus.ReadEmbeddings(0, conf.NUM_CLUSTERS(), conf), corpus.ReadUrls(0, conf.NUM_CLUSTERS(), conf), centroids)
+
+	embAddr := utils.LocalAddr(utils.EmbServerPort)
+	urlAddr := utils.LocalAddr(utils.UrlServerPort)
+	c := protocol.NewClient()
+	c.SetRequestPolicy(conf.REQUEST_POLICY())
+	c.SetTimeouts(conf.TIMEOUTS())
+	if _, _, err := c.FetchHint(embAddr, urlAddr); err != nil {
+		fmt.Println(err)
+		panic("Could not set up the client")
+	}
+
+	in, out := embeddings.SetupEmbeddingProcess(s.ClusterIdBound(), conf)
+	defer in.Close()
+	defer out.Close()
+
+	s.Baseline(queries, func(text string) (uint64, []int8) {
+		return embeddings.EmbedQuery(in, out, text)
+	}, func(cluster uint64, emb []int8) ([][][]framework.Answer, error) {
+		return c.SearchClusters([]uint64{cluster}, emb, embAddr, urlAddr)
+	}, k, probe)
+}
+
+// Runs the private search for each query against the local servers, and
+// scores it against relevance judgments for up to probe clusters per query
+// and up to chunks URL chunks per cluster
+func evalPrivate(args []string, conf *config.Config) {
+	probe, chunks := 1, 1
+	if len(args) == 4 {
+		var err1, err2 error
+		probe, err1 = strconv.Atoi(args[2])
+		chunks, err2 = strconv.Atoi(args[3])
+		if err1 != nil || err2 != nil || probe < 1 || chunks < 1 {
+			printUsage()
+			return
+		}
+	}
+
+	queries := eval.ReadQueries(args[0])
+	qrels := eval.ReadQrels(args[1], corpus.ReadDocUrlsTxt(conf))
+
+	embAddr := utils.LocalAddr(utils.EmbServerPort)
+	urlAddr := utils.LocalAddr(utils.UrlServerPort)
+	// Every search probes as many clusters and fetches as many chunks as the
+	// largest setting scored
+	conf.SetRequestPolicy(config.RequestPolicy{EmbQueries: probe, UrlQueries: probe * chunks})
+	c := protocol.NewClient()
+	c.SetRequestPolicy(conf.REQUEST_POLICY())
+	c.SetTimeouts(conf.TIMEOUTS())
+	if _, _, err := c.FetchHint(embAddr, urlAddr); err != nil {
+		fmt.Println(err)
+		panic("Could not set up the client")
+	}
+
+	in, out := embeddings.SetupEmbeddingProcessProbing(c.ClusterIdBound(), probe, conf)
+	defer in.Close()
+	defer out.Close()
+
+	eval.Private(queries, qrels, func(text string) ([][][]framework.Answer, error) {
+		clusters, emb := embeddings.EmbedQueryClusters(in, out, text)
+		return c.SearchClusters(clusters, emb, embAddr, urlAddr)
+	}, protocol.NUM_RESULTS, probe, chunks)
+}
+
+// Writes a synthetic corpus under the preamble of conf, with embeddings of
+// dimension conf.EMBEDDINGS_DIM()
+func genCorpus(args []string, conf *config.Config) {
+	spec := corpus.DefaultSyntheticSpec(conf)
+
+	fs := flag.NewFlagSet("gen-corpus", flag.ExitOnError)
+	fs.StringVar(&spec.Sizes, "sizes", spec.Sizes, "Docs per cluster: fixed, uniform or zipf")
+	fs.Float64Var(&spec.EmptyFrac, "empty", spec.EmptyFrac, "Fraction of the clusters left empty")
+	fs.IntVar(&spec.SubclusterDocs, "subcluster-docs", spec.SubclusterDocs, "Docs per URL subcluster (0 for one per cluster)")
+	fs.Uint64Var(&spec.SlotBits, "slot-bits", spec.SlotBits, "Bits per embedding slot")
+	fs.IntVar(&spec.MinUrlLen, "min-url-len", spec.MinUrlLen, "Min url length")
+	fs.IntVar(&spec.MaxUrlLen, "max-url-len", spec.MaxUrlLen, "Max url length")
+	fs.Int64Var(&spec.Seed, "seed", spec.Seed, "Random seed")
+	fs.Parse(args)
+
+	if fs.NArg() == 2 {
+		var err1, err2 error
+		spec.Clusters, err1 = strconv.Atoi(fs.Arg(0))
+		spec.MeanDocs, err2 = strconv.Atoi(fs.Arg(1))
+		if err1 != nil || err2 != nil {
+			printUsage()
+			return
+		}
+	} else if fs.NArg() != 0 {
+		printUsage()
+		return
+	}
+	if spec.SlotBits > config.SLOT_BITS() {
+		fmt.Printf("Values of more than %d bits would be clamped on loading\n", config.SLOT_BITS())
+	}
+
+	corpus.NewSynthetic(spec).WriteTxt(conf)
+	fmt.Printf("Load it with -format txt -clusters %s", conf.ClusterIdsFile())
+	if conf.EMBEDDINGS_DIM() != config.MakeConfig("").EMBEDDINGS_DIM() {
+		fmt.Printf(" -dim %d", conf.EMBEDDINGS_DIM())
+	}
+	fmt.Println()
 }
 
 func main() {
 	preamble := flag.String("preamble", "/home/lianzheng", "Preamble")
+	format := flag.String("format", config.CORPUS_FORMAT_AUTO, "Corpus format: txt, npy or csv (default: detect)")
+	codec := flag.String("codec", config.URL_CODEC_ZLIB, "URL codec: none, zlib, zstd or zstd-dict")
+	packingStrategy := flag.String("packing", config.PACKING_FIRST_FIT, "Packing strategy: ffd, bfd or min-cost")
+	embHintMB := flag.Float64("emb-hint-mb", 0, "Max embeddings hint in MB (default: config)")
+	urlHintMB := flag.Float64("url-hint-mb", 0, "Max URL hint in MB (default: config)")
+	maxQueryKB := flag.Float64("max-query-kb", 0, "Max upload per query and DB in KB (default: no limit)")
+	maxAnswerKB := flag.Float64("max-answer-kb", 0, "Max download per query and DB in KB (default: no limit)")
+	maxServerMB := flag.Float64("max-server-mb", 0, "Max server memory per DB in MB (default: no limit)")
+	dim := flag.Uint64("dim", 0, "Embedding dimension of the corpus (default: 192)")
+	splitRows := flag.Uint64("split-rows", 0, "Split clusters of more embeddings than this across DB columns (default: from hint target)")
+	clusterIds := flag.String("clusters", "", "File listing the cluster ids to serve (default: all clusters)")
+	dedup := flag.String("dedup", "", "Drop duplicate docs on load: comma-separated url, normalized-url, embedding (default: none)")
+	dedupScope := flag.String("dedup-scope", config.DEDUP_SCOPE_CLUSTER, "Look for duplicates within each cluster or across the corpus")
+	embQueries := flag.Int("emb-queries", 1, "Embeddings queries sent per search, padded with dummies")
+	urlQueries := flag.Int("url-queries", 1, "URL queries sent per search, padded with dummies")
+	coverPerHour := flag.Float64("cover-per-hour", 0, "Mean dummy searches per hour sent by an idle client (default: none)")
+	coverMBPerHour := flag.Float64("cover-mb-per-hour", 0, "Max traffic of dummy searches per hour in MB (default: no limit)")
+	maxQps := flag.Float64("max-qps", 0, "Max calls per second that a server answers (default: no limit)")
+	maxConnQps := flag.Float64("max-conn-qps", 0, "Max calls per second that a server answers on one connection (default: no limit)")
+	burst := flag.Int("burst", 1, "Calls that a server lets through at once above its rates")
+	maxConcurrent := flag.Int("max-concurrent", 0, "Max answers that a server computes at once (default: no limit)")
+	maxWait := flag.Float64("max-wait", 10, "Seconds that a call waits for its turn before a server refuses it")
+	useTokens := flag.Bool("tokens", false, "Servers answer only calls paid for with tokens from the token issuer")
+	tokenIssuer := flag.String("token-issuer", "", "Address of the token issuer, which clients get tokens from and servers record spent tokens at (default: the coordinator)")
+	dialTimeout := flag.Float64("dial-timeout", config.DefaultTimeouts().DialSec, "Seconds that a client waits to connect to a server (0: no limit)")
+	readTimeout := flag.Float64("read-timeout", config.DefaultTimeouts().ReadSec, "Seconds that a call waits for data from a server (0: no limit)")
+	searchTimeout := flag.Float64("search-timeout", config.DefaultTimeouts().SearchSec, "Seconds that a search may take in all (0: no limit)")
+	maxIdleConns := flag.Int("max-idle-conns", 0, "Idle connections that a client keeps open to each server (default: a connection per call)")
+	idleConnTimeout := flag.Float64("idle-conn-timeout", config.DefaultConnPool().IdleSec, "Seconds that a client keeps a connection idle (0: no limit)")
+	keepAlive := flag.Float64("keep-alive", config.DefaultConnPool().KeepAliveSec, "Seconds between TCP keep-alive probes on client connections (0: OS default)")
+	replicaDown := flag.Float64("replica-down", config.DefaultConnPool().DownSec, "Seconds that a client passes over a server replica that failed")
+	embReplicas := flag.String("emb-replicas", "", "Comma-separated addresses of embedding server replicas (default: the coordinator)")
+	urlReplicas := flag.String("url-replicas", "", "Comma-separated addresses of URL server replicas (default: the coordinator)")
+	daemon := flag.Bool("daemon", false, "Servers run until SIGINT or SIGTERM, without reading 'quit' from stdin")
+	drainTimeout := flag.Float64("drain-timeout", 30, "Seconds that a server shutting down waits for calls in flight")
+	adminPort := flag.Int("admin-port", -1, fmt.Sprintf("Port of the servers' /healthz, /readyz and /status HTTP endpoints (default: %d for embedding servers and all-servers, %d for URL servers; 0: none)", utils.EmbAdminPort, utils.UrlAdminPort))
+	integrity := flag.Bool("integrity", false, "Clients check answers against the DB authenticators written by answer-checks")
 	flag.Parse()
 	coordinatorIP := "0.0.0.0"
-	if len(os.Args) < 2 {
+	args := flag.Args()
+	if len(args) < 1 {
 		return
 	}
 
 	conf := config.MakeConfig(*preamble + "/data")
+	conf.SetCorpusFormat(*format)
+	conf.SetUrlCodec(*codec)
+	conf.SetPackingStrategy(*packingStrategy)
+	conf.SetEmbeddingsPlanTargets(planTargets(conf.EMBEDDINGS_PLAN_TARGETS(), *embHintMB, *maxQueryKB, *maxAnswerKB, *maxServerMB))
+	conf.SetEmbeddingsDim(*dim)
+	conf.SetEmbeddingsSplitRows(*splitRows)
+	conf.SetUrlPlanTargets(planTargets(conf.URL_PLAN_TARGETS(), *urlHintMB, *maxQueryKB, *maxAnswerKB, *maxServerMB))
+	if *clusterIds != "" {
+		conf.SetClusterIds(corpus.ReadClusterIds(*clusterIds))
+	}
+	if *dedup != "" {
+		conf.SetDedup(strings.Split(*dedup, ","))
+	}
+	conf.SetDedupScope(*dedupScope)
+	conf.SetIntegrityChecks(*integrity)
+	conf.SetRequestPolicy(config.RequestPolicy{EmbQueries: *embQueries, UrlQueries: *urlQueries})
+	conf.SetCoverTraffic(config.CoverTraffic{PerHour: *coverPerHour, MaxMBPerHour: *coverMBPerHour})
+	conf.SetServerLimits(config.ServerLimits{PerSec: *maxQps, ConnPerSec: *maxConnQps, Burst: *burst,
+		MaxConcurrent: *maxConcurrent, MaxWaitSec: *maxWait})
+	conf.SetTokens(*useTokens)
+	conf.SetTokenIssuer(*tokenIssuer)
+	conf.SetTimeouts(config.Timeouts{DialSec: *dialTimeout, ReadSec: *readTimeout, SearchSec: *searchTimeout})
+	conf.SetConnPool(config.ConnPool{MaxIdle: *maxIdleConns, IdleSec: *idleConnTimeout, KeepAliveSec: *keepAlive,
+		DownSec: *replicaDown})
 
-	if os.Args[1] == "preprocess-all" {
-		protocol.NewEmbeddingServers(conf.EMBEDDINGS_CLUSTERS_PER_SERVER(), conf.DEFAULT_EMBEDDINGS_HINT_SZ(), true, false, false, conf)
-		protocol.NewUrlServers(conf.URL_CLUSTERS_PER_SERVER(), conf.DEFAULT_URL_HINT_SZ(), true, false, false, conf)
-	} else if os.Args[1] == "emb-server" {
-		_, embAddrs, _ := protocol.NewEmbeddingServers(conf.EMBEDDINGS_CLUSTERS_PER_SERVER(), conf.DEFAULT_EMBEDDINGS_HINT_SZ(), true, false, true, conf)
+	drain := utils.Seconds(*drainTimeout)
+	if args[0] != "test" && conf.TOKEN_ISSUER() == "" {
+		conf.SetTokenIssuer(utils.RemoteAddr(coordinatorIP, utils.TokenIssuerPort))
+	}
+	if args[0] == "preprocess-all" {
+		protocol.NewEmbeddingServers(conf.EMBEDDINGS_CLUSTERS_PER_SERVER(), true, false, false, conf)
+		protocol.NewUrlServers(conf.URL_CLUSTERS_PER_SERVER(), true, false, false, conf)
+	} else if args[0] == "codec-report" {
+		database.CodecReport(conf.URL_CLUSTERS_PER_SERVER(), conf)
+	} else if args[0] == "corpus-check" {
+		report := corpus.CheckCorpusTxt(conf)
+		report.Print()
+		if len(args) >= 2 {
+			report.WriteJson(args[1])
+			fmt.Printf("Wrote report to %s\n", args[1])
+		}
+		if !report.Ok() {
+			os.Exit(1)
+		}
+	} else if args[0] == "eval" {
+		if len(args) != 3 && len(args) != 5 {
+			printUsage()
+			return
+		}
+		evalPrivate(args[1:], conf)
+	} else if args[0] == "eval-baseline" {
+		if len(args) != 2 && len(args) != 4 {
+			printUsage()
+			return
+		}
+		evalBaseline(args[1:], conf)
+	} else if args[0] == "gen-corpus" {
+		genCorpus(args[1:], conf)
+	} else if args[0] == "plan" {
+		database.PlanEmbeddings(corpus.ReadEmbeddings(0, conf.EMBEDDINGS_CLUSTERS_PER_SERVER(), conf), conf.PACKING_STRATEGY(), conf)
+		database.PlanUrls(corpus.ReadUrls(0, conf.URL_CLUSTERS_PER_SERVER(), conf), conf.PACKING_STRATEGY(), conf)
+	} else if args[0] == "rebalance" {
+		if len(args) != 2 && len(args) != 4 {
+			printUsage()
+			return
+		}
+		rebalance(args[1:], conf)
+	} else if args[0] == "answer-checks" {
+		database.WriteAnswerChecks(corpus.ReadEmbeddings(0, conf.EMBEDDINGS_CLUSTERS_PER_SERVER(), conf),
+			corpus.ReadUrls(0, conf.URL_CLUSTERS_PER_SERVER(), conf), conf)
+	} else if args[0] == "packing-report" {
+		database.PackingReport(conf)
+	} else if args[0] == "emb-server" {
+		admin := protocol.NewAdmin("embeddings")
+		admin.Serve(orDefault(*adminPort, utils.EmbAdminPort))
+		embServer, embAddrs, _ := protocol.NewEmbeddingServers(conf.EMBEDDINGS_CLUSTERS_PER_SERVER(), true, false, true, conf)
 		fmt.Println("Set up embedding server")
 		fmt.Println(embAddrs)
+		admin.Add("embeddings", embServer)
+		waitToShutDown(*daemon, drain, embServer)
 
-		fmt.Println("Input 'quit' to quit")
-		for {
-			text := utils.ReadLineFromStdin()
-			fmt.Printf("\n\n")
-			if strings.TrimSpace(text) == "quit" {
-				break
-			}
-		}
-
-	} else if os.Args[1] == "url-server" {
-		_, urlAddrs, _ := protocol.NewUrlServers(conf.URL_CLUSTERS_PER_SERVER(), conf.DEFAULT_URL_HINT_SZ(), true, false, true, conf)
+	} else if args[0] == "url-server" {
+		admin := protocol.NewAdmin("urls")
+		admin.Serve(orDefault(*adminPort, utils.UrlAdminPort))
+		urlServer, urlAddrs, _ := protocol.NewUrlServers(conf.URL_CLUSTERS_PER_SERVER(), true, false, true, conf)
 		fmt.Println("Set up url server")
 		fmt.Println(urlAddrs)
+		admin.Add("urls", urlServer)
+		waitToShutDown(*daemon, drain, urlServer)
 
-		fmt.Println("Input 'quit' to quit")
-		for {
-			text := utils.ReadLineFromStdin()
-			fmt.Printf("\n\n")
-			if strings.TrimSpace(text) == "quit" {
-				break
-			}
-		}
+	} else if args[0] == "token-issuer" {
+		key := tokens.ReadOrCreateKey(conf.TokenKeyFile(), conf.TokenPublicKeyFile())
+		issuer := protocol.NewIssuer(key, conf.TOKENS_PER_BATCH(), tokens.NewSpentSet(conf.TokenSpentFile()))
+		go issuer.Serve(utils.TokenIssuerPort)
+		fmt.Printf("Issuing tokens; servers started with -tokens check them against %s\n", conf.TokenPublicKeyFile())
+		waitToShutDown(*daemon, drain, issuer)
 
-	} else if os.Args[1] == "all-servers" {
-		_, embAddrs, _ := protocol.NewEmbeddingServers(conf.EMBEDDINGS_CLUSTERS_PER_SERVER(), conf.DEFAULT_EMBEDDINGS_HINT_SZ(), true, false, true, conf)
+	} else if args[0] == "all-servers" {
+		admin := protocol.NewAdmin("embeddings", "urls")
+		admin.Serve(orDefault(*adminPort, utils.EmbAdminPort))
+		embServer, embAddrs, _ := protocol.NewEmbeddingServers(conf.EMBEDDINGS_CLUSTERS_PER_SERVER(), true, false, true, conf)
 		fmt.Println("Set up embedding server")
 		fmt.Println(embAddrs)
-		_, urlAddrs, _ := protocol.NewUrlServers(conf.URL_CLUSTERS_PER_SERVER(), conf.DEFAULT_URL_HINT_SZ(), true, false, true, conf)
+		admin.Add("embeddings", embServer)
+		urlServer, urlAddrs, _ := protocol.NewUrlServers(conf.URL_CLUSTERS_PER_SERVER(), true, false, true, conf)
 		fmt.Println("Set up url server")
 		fmt.Println(urlAddrs)
+		admin.Add("urls", urlServer)
 		fmt.Println("Ready to start answering queries")
-		fmt.Println("Input 'quit' to quit")
-		for {
-			text := utils.ReadLineFromStdin()
-			fmt.Printf("\n\n")
-			if strings.TrimSpace(text) == "quit" {
-				break
-			}
-		}
-		// } else if os.Args[1] == "client" {
-		// 	if len(os.Args) >= 3 {
-		// 		coordinatorIP = os.Args[2]
+		waitToShutDown(*daemon, drain, embServer, urlServer)
+		// } else if args[0] == "client" {
+		// 	if len(args) >= 2 {
+		// 		coordinatorIP = args[1]
 		// 	}
 
 		// 	protocol.RunClient(utils.RemoteAddr(coordinatorIP, utils.EmbServerPort), utils.RemoteAddr(coordinatorIP, utils.UrlServerPort), conf)
 
-	} else if os.Args[1] == "test" {
+	} else if args[0] == "test" {
 		// protocol.Testbackend()
-		if len(os.Args) >= 3 {
-			coordinatorIP = os.Args[2]
+		if len(args) >= 2 {
+			coordinatorIP = args[1]
+		}
+		if conf.TOKEN_ISSUER() == "" {
+			conf.SetTokenIssuer(utils.RemoteAddr(coordinatorIP, utils.TokenIssuerPort))
+		}
+		embAddrs := utils.RemoteAddr(coordinatorIP, utils.EmbServerPort)
+		if *embReplicas != "" {
+			embAddrs = *embReplicas
+		}
+		urlAddrs := utils.RemoteAddr(coordinatorIP, utils.UrlServerPort)
+		if *urlReplicas != "" {
+			urlAddrs = *urlReplicas
 		}
-		ch := make(chan []framework.Answer)
-		done := make(chan string)
-		go protocol.RunClient(utils.RemoteAddr(coordinatorIP, utils.EmbServerPort), utils.RemoteAddr(coordinatorIP, utils.UrlServerPort), ch, done, conf)
-		framework.Setup(ch, done)
+		queries := make(chan framework.Query)
+		go protocol.RunClient(embAddrs, urlAddrs, queries, conf)
+		framework.Setup(queries)
 		// in, out := embeddings.SetupEmbeddingProcess(1280, conf)
 		// var query struct {
 		// 	Cluster_index uint64
@@ -11,6 +11,10 @@ type Chunk struct {
 	index uint64
 }
 
+func (c Chunk) Size() uint64 {
+	return c.size
+}
+
 type chunkSorter struct {
 	chunks []Chunk
 }
@@ -57,18 +61,48 @@ func BuildUrlChunks(corpus *corpus.Corpus) ([]Chunk, uint64) {
 	return chunks, actual_sz
 }
 
-func BuildEmbChunks(corpus *corpus.Corpus) ([]Chunk, uint64) {
-	chunks := make([]Chunk, corpus.NumClusters())
+// Rows [Start, Start+Size) of a cluster, stored contiguously in one column
+type ClusterPart struct {
+	Cluster uint
+	Part    int // position of this part within the cluster
+	Start   uint64
+	Size    uint64
+}
+
+// Builds one chunk per cluster, splitting clusters of more than maxRows docs
+// into parts of at most maxRows docs (no splitting if maxRows is 0). Each
+// chunk's index refers to the returned parts.
+func BuildEmbChunks(corpus *corpus.Corpus, maxRows uint64) ([]Chunk, []ClusterPart, uint64) {
+	chunks := make([]Chunk, 0, corpus.NumClusters())
+	parts := make([]ClusterPart, 0, corpus.NumClusters())
 
 	clusters := corpus.Clusters()
-	for i, cluster := range clusters {
-		chunks[i].index = uint64(cluster)
-		chunks[i].size = corpus.NumDocsInCluster(cluster)
+	for _, cluster := range clusters {
+		sz := corpus.NumDocsInCluster(cluster)
+		numParts := uint64(1)
+		if maxRows > 0 && sz > maxRows {
+			numParts = (sz + maxRows - 1) / maxRows
+		}
+
+		// Spread the docs evenly over the parts
+		start := uint64(0)
+		for i := uint64(0); i < numParts; i++ {
+			partSz := sz / numParts
+			if i < sz%numParts {
+				partSz += 1
+			}
+
+			chunks = append(chunks, Chunk{size: partSz, index: uint64(len(parts))})
+			parts = append(parts, ClusterPart{Cluster: cluster, Part: int(i), Start: start, Size: partSz})
+			start += partSz
+		}
 	}
 
-	return chunks, corpus.GetNumDocs() * corpus.GetEmbeddingSlots()
+	return chunks, parts, corpus.GetNumDocs() * corpus.GetEmbeddingSlots()
 }
 
+// First-fit decreasing: places each chunk, largest first, in the first
+// column with room for it.
 func PackChunks(chunks []Chunk, maxCapacity uint64) ([][]uint, []uint64) {
 	N := uint64(len(chunks))
 	if N == 0 {
@@ -88,7 +122,7 @@ func PackChunks(chunks []Chunk, maxCapacity uint64) ([][]uint, []uint64) {
 	for i := uint64(1); i < N; i++ {
 		fit := false
 		for j := 0; j < len(cols); j++ {
-			if col_szs[j]+chunks[i].size < maxCapacity {
+			if col_szs[j]+chunks[i].size <= maxCapacity {
 				col_szs[j] += chunks[i].size
 				cols[j] = append(cols[j], uint(chunks[i].index))
 				fit = true
@@ -0,0 +1,68 @@
+package packing
+
+import (
+	"fmt"
+	"search/utils"
+)
+
+// Shape and estimated costs of the SimplePIR database built from a packing
+type Report struct {
+	Strategy      string
+	NumCols       uint64
+	L             uint64
+	M             uint64
+	UsedCells     uint64
+	WastedCells   uint64
+	FillHistogram [10]uint64 // number of columns by fill, in 10% buckets
+
+	QueryBytes  uint64
+	AnswerBytes uint64
+	HintBytes   uint64
+}
+
+// Each packed column spans slotsPerCol DB columns. The SimplePIR
+// parameters have elements of elemBytes bytes and secret dimension n.
+func NewReport(strategy string, col_szs []uint64, slotsPerCol, elemBytes, n uint64) *Report {
+	r := new(Report)
+	r.Strategy = strategy
+	r.NumCols = uint64(len(col_szs))
+	r.L = utils.Max(col_szs)
+	r.M = r.NumCols * slotsPerCol
+
+	for _, sz := range col_szs {
+		r.UsedCells += sz * slotsPerCol
+
+		bucket := 9
+		if r.L > 0 {
+			bucket = int(10 * sz / r.L)
+		}
+		if bucket > 9 {
+			bucket = 9
+		}
+		r.FillHistogram[bucket] += 1
+	}
+	r.WastedCells = r.L*r.M - r.UsedCells
+
+	r.QueryBytes = r.M * elemBytes
+	r.AnswerBytes = r.L * elemBytes
+	r.HintBytes = r.L * n * elemBytes
+
+	return r
+}
+
+func (r *Report) Print() {
+	total := r.L * r.M
+	wasted := 0.0
+	if total > 0 {
+		wasted = 100 * float64(r.WastedCells) / float64(total)
+	}
+
+	fmt.Printf("Packing with %s: %d columns; DB is %d by %d\n", r.Strategy, r.NumCols, r.L, r.M)
+	fmt.Printf("\tCells: %d used, %d wasted (%.1f%%)\n", r.UsedCells, r.WastedCells, wasted)
+	fmt.Printf("\tColumn fill:")
+	for i, v := range r.FillHistogram {
+		fmt.Printf(" %d-%d%%: %d;", 10*i, 10*(i+1), v)
+	}
+	fmt.Printf("\n\tQuery: %.2f KB; Answer: %.2f KB; Hint: %.2f MB\n",
+		utils.BytesToKB(r.QueryBytes), utils.BytesToKB(r.AnswerBytes), utils.BytesToMB(r.HintBytes))
+}
@@ -0,0 +1,160 @@
+package packing
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"search/config"
+	"search/utils"
+)
+
+// Relative weights of the per-query costs that depend on the DB shape
+type Costs struct {
+	Cell   float64 // server work per DB cell
+	Column float64 // upload per DB column
+	Row    float64 // download per DB row
+}
+
+// Packs the chunks with the named strategy. Each column holds at most
+// maxCapacity values, unless a single chunk is larger.
+func Pack(chunks []Chunk, maxCapacity uint64, strategy string, slotsPerCol uint64, costs Costs) ([][]uint, []uint64) {
+	switch strategy {
+	case config.PACKING_FIRST_FIT:
+		return PackChunks(chunks, maxCapacity)
+	case config.PACKING_BEST_FIT:
+		return PackChunksBestFit(chunks, maxCapacity)
+	case config.PACKING_MIN_COST:
+		return PackChunksMinCost(chunks, maxCapacity, slotsPerCol, costs)
+	}
+
+	panic("Unknown packing strategy: " + strategy)
+}
+
+var Strategies = []string{config.PACKING_FIRST_FIT, config.PACKING_BEST_FIT, config.PACKING_MIN_COST}
+
+// Best-fit decreasing: places each chunk, largest first, in the fullest
+// column with room for it.
+func PackChunksBestFit(chunks []Chunk, maxCapacity uint64) ([][]uint, []uint64) {
+	N := uint64(len(chunks))
+	if N == 0 {
+		panic("No chunks given")
+	}
+
+	ReverseSort(chunks)
+	if chunks[0].size > maxCapacity {
+		maxCapacity = chunks[0].size
+	}
+
+	cols := make([][]uint, 0)
+	col_szs := make([]uint64, 0)
+
+	for i := uint64(0); i < N; i++ {
+		best := -1
+		for j := 0; j < len(cols); j++ {
+			if col_szs[j]+chunks[i].size > maxCapacity {
+				continue
+			}
+			if best == -1 || col_szs[j] > col_szs[best] {
+				best = j
+			}
+		}
+
+		if best == -1 {
+			cols = append(cols, []uint{})
+			col_szs = append(col_szs, 0)
+			best = len(cols) - 1
+		}
+
+		col_szs[best] += chunks[i].size
+		cols[best] = append(cols[best], uint(chunks[i].index))
+	}
+
+	return cols, col_szs
+}
+
+type column struct {
+	index int
+	size  uint64
+}
+
+type columnHeap []column
+
+func (h columnHeap) Len() int            { return len(h) }
+func (h columnHeap) Less(i, j int) bool  { return h[i].size < h[j].size }
+func (h columnHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *columnHeap) Push(x interface{}) { *h = append(*h, x.(column)) }
+func (h *columnHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// Packs the chunks, largest first, into exactly numCols columns, always
+// placing the next chunk in the emptiest column. Expects sorted chunks.
+func packIntoColumns(chunks []Chunk, numCols int) ([][]uint, []uint64) {
+	cols := make([][]uint, numCols)
+	col_szs := make([]uint64, numCols)
+
+	h := make(columnHeap, numCols)
+	for j := range h {
+		h[j] = column{index: j}
+	}
+
+	for _, ch := range chunks {
+		col := &h[0]
+		col.size += ch.size
+		cols[col.index] = append(cols[col.index], uint(ch.index))
+		col_szs[col.index] = col.size
+		heap.Fix(&h, 0)
+	}
+
+	return cols, col_szs
+}
+
+func shapeCost(l, m uint64, costs Costs) float64 {
+	return costs.Cell*float64(l*m) + costs.Column*float64(m) + costs.Row*float64(l)
+}
+
+// Picks the number of columns that minimizes the cost of the resulting DB
+// shape, among those keeping columns within maxCapacity (when possible).
+func PackChunksMinCost(chunks []Chunk, maxCapacity, slotsPerCol uint64, costs Costs) ([][]uint, []uint64) {
+	N := len(chunks)
+	if N == 0 {
+		panic("No chunks given")
+	}
+
+	ReverseSort(chunks)
+	if chunks[0].size > maxCapacity {
+		maxCapacity = chunks[0].size
+	}
+
+	// Try a geometric grid of column counts
+	candidates := make([]int, 0)
+	for k := 1.0; int(k) <= N; k = math.Max(k+1, k*1.05) {
+		candidates = append(candidates, int(k))
+	}
+	if candidates[len(candidates)-1] != N {
+		candidates = append(candidates, N)
+	}
+
+	var bestCols [][]uint
+	var bestSzs []uint64
+	bestCost := math.Inf(1)
+	bestFits := false
+
+	for _, k := range candidates {
+		cols, col_szs := packIntoColumns(chunks, k)
+		l := utils.Max(col_szs)
+		fits := (l <= maxCapacity)
+		cost := shapeCost(l, uint64(k)*slotsPerCol, costs)
+
+		if (fits && !bestFits) || (fits == bestFits && cost < bestCost) {
+			bestCols, bestSzs, bestCost, bestFits = cols, col_szs, cost, fits
+		}
+	}
+
+	fmt.Printf("Packed into %d columns of height %d\n", len(bestCols), utils.Max(bestSzs))
+	return bestCols, bestSzs
+}
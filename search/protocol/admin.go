@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"search/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reports over HTTP on the servers of a process, for load balancers and
+// operators: whether it is alive, whether its servers are ready to answer,
+// and what they serve
+type Admin struct {
+	start time.Time
+	roles []string // the servers that the process sets up
+
+	mu      sync.Mutex
+	servers map[string]*Server // by role, once set up
+}
+
+type ServerStatus struct {
+	Role       string `json:"role"`
+	Ready      bool   `json:"ready"`
+	Draining   bool   `json:"draining"`
+	Version    string `json:"version,omitempty"`
+	Embeddings string `json:"embeddings,omitempty"` // DB parameters
+	Urls       string `json:"urls,omitempty"`
+}
+
+type MemoryStatus struct {
+	AllocMB float64 `json:"alloc_mb"`
+	HeapMB  float64 `json:"heap_mb"`
+	SysMB   float64 `json:"sys_mb"`
+}
+
+type AdminStatus struct {
+	Ready     bool           `json:"ready"`
+	UptimeSec float64        `json:"uptime_sec"`
+	Memory    MemoryStatus   `json:"memory"`
+	Servers   []ServerStatus `json:"servers"`
+}
+
+// The process is ready once a server of each role is set up and ready
+func NewAdmin(roles ...string) *Admin {
+	return &Admin{start: time.Now(), roles: roles, servers: make(map[string]*Server)}
+}
+
+func (a *Admin) Add(role string, s *Server) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.servers[role] = s
+}
+
+// Whether the server has its DB loaded and its hint server initialized,
+// and is not shutting down
+func (s *Server) Ready() bool {
+	if s.hint == nil || s.draining.Load() {
+		return false
+	}
+	if s.hint.ServeEmbeddings && (s.embeddingsServer == nil || s.embHintServer == nil) {
+		return false
+	}
+	if s.hint.ServeUrls && (s.urlsServer == nil || s.urlHintServer == nil) {
+		return false
+	}
+	return s.hint.ServeEmbeddings || s.hint.ServeUrls
+}
+
+func (a *Admin) Status() AdminStatus {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	out := AdminStatus{
+		Ready:     true,
+		UptimeSec: time.Since(a.start).Seconds(),
+		Memory: MemoryStatus{
+			AllocMB: utils.BytesToMB(mem.Alloc),
+			HeapMB:  utils.BytesToMB(mem.HeapInuse),
+			SysMB:   utils.BytesToMB(mem.Sys),
+		},
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, role := range a.roles {
+		status := ServerStatus{Role: role}
+		if s, ok := a.servers[role]; ok {
+			status.Ready = s.Ready()
+			status.Draining = s.draining.Load()
+			if s.hint != nil {
+				status.Version = s.hint.SnapshotVersion()
+				if s.hint.ServeEmbeddings && s.hint.EmbeddingsHint.Info.Params != nil {
+					status.Embeddings = utils.PrintParams(&s.hint.EmbeddingsHint.Info)
+				}
+				if s.hint.ServeUrls && s.hint.UrlsHint.Info.Params != nil {
+					status.Urls = utils.PrintParams(&s.hint.UrlsHint.Info)
+				}
+			}
+		}
+		out.Ready = out.Ready && status.Ready
+		out.Servers = append(out.Servers, status)
+	}
+	return out
+}
+
+// /healthz answers as long as the process runs, /readyz with 503 until
+// the process is ready, and /status with the whole AdminStatus
+func (a *Admin) Handler() http.Handler {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	r.GET("/readyz", func(c *gin.Context) {
+		status := a.Status()
+		code := http.StatusOK
+		if !status.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, gin.H{"ready": status.Ready, "servers": status.Servers})
+	})
+	r.GET("/status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, a.Status())
+	})
+	return r
+}
+
+// Serves the admin endpoints on port, unless it is 0. Panics if it cannot
+// listen there, rather than run a server that no probe can see.
+func (a *Admin) Serve(port int) {
+	if port == 0 {
+		return
+	}
+	l := utils.ListenTCP(port)
+	fmt.Printf("Admin endpoints on http://%s\n", l.Addr())
+	go func() {
+		if err := http.Serve(l, a.Handler()); err != nil {
+			fmt.Printf("Admin server error: %v\n", err)
+		}
+	}()
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"search/corpus/corpustest"
+	"search/utils"
+)
+
+// A server is ready once set up, and no longer once it shuts down
+func TestAdmin(t *testing.T) {
+	admin := NewAdmin("urls")
+	h := admin.Handler()
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	if w := get("/healthz"); w.Code != http.StatusOK {
+		t.Fatalf("healthz: %d", w.Code)
+	}
+	if w := get("/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz before the server is set up: %d", w.Code)
+	}
+
+	_, s := newTestServers(t, corpustest.Small(t))
+	admin.Add("urls", s)
+	hintServer := s.urlHintServer
+	s.urlHintServer = nil
+	if w := get("/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz before the hint server is set up: %d", w.Code)
+	}
+	s.urlHintServer = hintServer
+	if w := get("/readyz"); w.Code != http.StatusOK {
+		t.Fatalf("readyz once set up: %d", w.Code)
+	}
+
+	var status AdminStatus
+	if err := json.Unmarshal(get("/status").Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Ready || len(status.Servers) != 1 || status.Memory.SysMB <= 0 {
+		t.Fatalf("status: %+v", status)
+	}
+	if got := status.Servers[0]; got.Version != s.hint.SnapshotVersion() || got.Urls == "" || got.Embeddings != "" {
+		t.Fatalf("server status: %+v", got)
+	}
+
+	s.Shutdown(time.Second)
+	if w := get("/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz while shutting down: %d", w.Code)
+	}
+}
+
+// A server whose admin port is taken fails to start
+func TestAdminPortTaken(t *testing.T) {
+	l := utils.ListenTCP(0)
+	t.Cleanup(func() { l.Close() })
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("admin endpoints served on a port taken")
+		}
+	}()
+	NewAdmin("urls").Serve(l.Addr().(*net.TCPAddr).Port)
+}
@@ -1,16 +1,18 @@
 package protocol
 
 import (
+	"bytes"
+	"context"
 	"encoding/gob"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net/rpc"
 	"search/config"
 	"search/corpus"
 	"search/database"
 	"search/embeddings"
 	"search/framework"
+	"search/tokens"
 	"search/utils"
 	"strings"
 	"time"
@@ -21,40 +23,93 @@ import (
 	"github.com/henrycg/simplepir/pir"
 )
 
+// Number of results shown per query
+const NUM_RESULTS = 10
+
 type UnderhoodAnswer struct {
 	EmbAnswer underhood.HintAnswer
 	UrlAnswer underhood.HintAnswer
 }
 
 type QueryType interface {
-	bool | underhood.HintQuery | pir.Query[matrix.Elem64] | pir.Query[matrix.Elem32]
+	bool | tokens.Token | underhood.HintQuery | []pir.Query[matrix.Elem64] | pir.Query[matrix.Elem64] | pir.Query[matrix.Elem32]
 }
 
 type AnsType interface {
-	TiptoeHint | UnderhoodAnswer | pir.Answer[matrix.Elem64] | pir.Answer[matrix.Elem32]
+	bool | string | TiptoeHint | UnderhoodAnswer | []pir.Answer[matrix.Elem64] | pir.Answer[matrix.Elem64] | pir.Answer[matrix.Elem32]
 }
 
 type Client struct {
 	params corpus.Params
 
-	embClient  *underhood.Client[matrix.Elem64]
+	embClients []*underhood.Client[matrix.Elem64] // one per part of a split cluster
 	embInfo    *pir.DBInfo
 	embMap     database.ClusterMap
-	embIndices map[uint64]bool
+	embCheck   *database.AnswerCheck // nil without integrity checks
+
+	urlClient     *underhood.Client[matrix.Elem32]
+	urlInfo       *pir.DBInfo
+	urlMap        database.SubclusterMap
+	urlIndices    map[uint64]bool
+	urlCompressor corpus.Compressor
+	urlCheck      *database.AnswerCheck
+
+	policy config.RequestPolicy
+	sub    int // by how much hint queries are truncated for the URL server
 
-	urlClient  *underhood.Client[matrix.Elem32]
-	urlInfo    *pir.DBInfo
-	urlMap     database.SubclusterMap
-	urlIndices map[uint64]bool
+	// Traffic of an ApplyHint to each server, measured on the first round
+	embHintBytes uint64
+	urlHintBytes uint64
 
-	rpcClient *rpc.Client
+	tokenIssuer string
+	tokenBatch  int
+	wallet      *tokenWallet // nil if the servers do not require tokens
+
+	timeouts config.Timeouts
+	pool     *connPool
+	replicas map[string]*replicaSet // by the addresses listed
 }
 
 func NewClient() *Client {
 	c := new(Client)
+	c.policy = config.DefaultRequestPolicy()
+	c.timeouts = config.DefaultTimeouts()
+	c.pool = newConnPool(config.DefaultConnPool(), c.timeouts)
 	return c
 }
 
+func (c *Client) SetTimeouts(t config.Timeouts) {
+	c.timeouts = t
+	c.pool.timeouts = t
+}
+
+// Calls made with keepConn leave their connections in the pool, up to
+// p.MaxIdle per server
+func (c *Client) SetConnPool(p config.ConnPool) {
+	c.pool.close()
+	c.pool = newConnPool(p, c.timeouts)
+}
+
+// Checks every answer against the answer checks of each DB, made by
+// whoever built it. Either may be nil.
+func (c *Client) SetAnswerChecks(emb, url *database.AnswerCheck) {
+	c.embCheck = emb
+	c.urlCheck = url
+}
+
+// Closes the idle connections
+func (c *Client) Close() {
+	c.pool.close()
+}
+
+// Ends with parent, or once the search timeout is up
+func (c *Client) searchContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if c.timeouts.SearchSec == 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, utils.Seconds(c.timeouts.SearchSec))
+}
+
 func (c *Client) NumDocs() uint64 {
 	return c.params.NumDocs
 }
@@ -66,13 +121,49 @@ func (c *Client) NumClusters() int {
 	return len(c.urlMap)
 }
 
-func (c *Client) Setup(hint *TiptoeHint) {
+func (c *Client) HasCluster(i uint64) bool {
+	if len(c.embMap) > 0 {
+		_, ok := c.embMap[uint(i)]
+		return ok
+	}
+	_, ok := c.urlMap[uint(i)]
+	return ok
+}
+
+// One more than the largest cluster id. Cluster ids need not be
+// consecutive, so this can exceed NumClusters().
+func (c *Client) ClusterIdBound() int {
+	bound := uint(0)
+	for i := range c.embMap {
+		if i+1 > bound {
+			bound = i + 1
+		}
+	}
+	for i := range c.urlMap {
+		if i+1 > bound {
+			bound = i + 1
+		}
+	}
+	return int(bound)
+}
+
+// Fails with ErrUncheckedDB, leaving the client as it was, if a server does
+// not serve the DB that the answer checks were made for
+func (c *Client) Setup(hint *TiptoeHint) error {
 	if hint == nil {
 		panic("Hint is empty")
 	}
 	if hint.CParams.NumDocs == 0 {
 		panic("Corpus is empty")
 	}
+	if hint.ServeEmbeddings && c.embCheck != nil && !bytes.Equal(c.embCheck.Root, hint.EmbeddingsRoot) {
+		return fmt.Errorf("embeddings server serves DB commitment %x vs. %s: %w",
+			hint.EmbeddingsRoot, c.embCheck.Commitment(), ErrUncheckedDB)
+	}
+	if hint.ServeUrls && c.urlCheck != nil && !bytes.Equal(c.urlCheck.Root, hint.UrlsRoot) {
+		return fmt.Errorf("URL server serves DB commitment %x vs. %s: %w",
+			hint.UrlsRoot, c.urlCheck.Commitment(), ErrUncheckedDB)
+	}
 
 	c.params = hint.CParams
 	c.embInfo = &hint.EmbeddingsHint.Info
@@ -83,15 +174,17 @@ func (c *Client) Setup(hint *TiptoeHint) {
 			panic("Embeddings hint is empty")
 		}
 
-		c.embClient = utils.NewUnderhoodClient(&hint.EmbeddingsHint)
-
 		c.embMap = hint.EmbeddingsIndexMap
-		c.embIndices = make(map[uint64]bool)
-		for _, v := range c.embMap {
-			c.embIndices[v] = true
+		c.embClients = make([]*underhood.Client[matrix.Elem64], c.embMap.MaxParts())
+		for i := range c.embClients {
+			c.embClients[i] = utils.NewUnderhoodClient(&hint.EmbeddingsHint)
 		}
 
 		fmt.Printf("\tEmbeddings client: %s\n", utils.PrintParams(c.embInfo))
+
+		if c.embCheck != nil {
+			fmt.Printf("\tChecking embeddings answers against DB commitment %s\n", c.embCheck.Commitment())
+		}
 	}
 
 	if hint.ServeUrls {
@@ -102,6 +195,7 @@ func (c *Client) Setup(hint *TiptoeHint) {
 		c.urlClient = utils.NewUnderhoodClient(&hint.UrlsHint)
 
 		c.urlMap = hint.UrlsIndexMap
+		c.urlCompressor = hint.CParams.UrlDecompressor(hint.UrlsDict)
 		c.urlIndices = make(map[uint64]bool)
 		for _, vals := range c.urlMap {
 			for _, v := range vals {
@@ -110,6 +204,18 @@ func (c *Client) Setup(hint *TiptoeHint) {
 		}
 
 		fmt.Printf("\tURL client: %s\n", utils.PrintParams(c.urlInfo))
+
+		if c.urlCheck != nil {
+			fmt.Printf("\tChecking URL answers against DB commitment %s\n", c.urlCheck.Commitment())
+		}
+	}
+
+	if hint.TokenKey != nil {
+		if c.tokenIssuer == "" {
+			panic("Servers require tokens, but no token issuer is set")
+		}
+		c.wallet = &tokenWallet{pub: tokens.ParsePublicKey(hint.TokenKey), issuer: c.tokenIssuer, batch: c.tokenBatch, timeouts: c.timeouts}
+		fmt.Printf("\tPaying for calls with tokens from %s\n", c.tokenIssuer)
 	}
 
 	if hint.ServeUrls && hint.ServeEmbeddings &&
@@ -117,6 +223,7 @@ func (c *Client) Setup(hint *TiptoeHint) {
 		fmt.Printf("Both maps don't have the same length: %d %d\n", len(c.urlMap), len(c.embMap))
 		//    panic("Both maps don't have same length.")
 	}
+	return nil
 }
 
 func InitHint(embhint *TiptoeHint, urlhint *TiptoeHint) *TiptoeHint {
@@ -127,30 +234,47 @@ func InitHint(embhint *TiptoeHint, urlhint *TiptoeHint) *TiptoeHint {
 	hint.CParams.SlotBits = embhint.CParams.SlotBits
 	hint.EmbeddingsHint = embhint.EmbeddingsHint
 	hint.EmbeddingsIndexMap = embhint.EmbeddingsIndexMap
+	hint.EmbeddingsRoot = embhint.EmbeddingsRoot
 
 	hint.CParams.UrlBytes = urlhint.CParams.UrlBytes
 	hint.CParams.CompressUrl = urlhint.CParams.CompressUrl
+	hint.CParams.UrlCodec = urlhint.CParams.UrlCodec
 	hint.UrlsHint = urlhint.UrlsHint
 	hint.UrlsIndexMap = urlhint.UrlsIndexMap
+	hint.UrlsDict = urlhint.UrlsDict
+	hint.UrlsRoot = urlhint.UrlsRoot
+
+	hint.TokenKey = embhint.TokenKey
+	if !bytes.Equal(embhint.TokenKey, urlhint.TokenKey) {
+		panic("Servers trust different token issuers")
+	}
 
 	hint.ServeEmbeddings = true
 	hint.ServeUrls = true
 	return hint
 }
 
-func RunClient(EmbAddr string, UrlAddr string, ch chan []framework.Answer, done chan string, conf *config.Config) {
+// Answers the queries sent on queries, one at a time, each within the
+// search timeout and for as long as the query's context is not done.
+// EmbAddr and UrlAddr may each list replicas, comma-separated.
+func RunClient(EmbAddr string, UrlAddr string, queries chan framework.Query, conf *config.Config) {
 	fmt.Println("Setting up client...")
 
 	c := NewClient()
+	c.SetRequestPolicy(conf.REQUEST_POLICY())
+	c.SetTimeouts(conf.TIMEOUTS())
+	c.SetConnPool(conf.CONN_POOL())
+	c.SetTokenIssuer(conf.TOKEN_ISSUER(), conf.TOKENS_PER_BATCH())
+	if conf.INTEGRITY_CHECKS() {
+		c.SetAnswerChecks(database.ReadAnswerCheck(conf.EmbeddingsCheckFile()), database.ReadAnswerCheck(conf.UrlsCheckFile()))
+	}
+	defer c.Close()
 	fmt.Println("1.Getting metadata")
-	embhint := c.getHint(false, EmbAddr)
-	urlhint := c.getHint(false, UrlAddr)
-	sub := int(embhint.EmbeddingsHint.Info.Params.N - urlhint.UrlsHint.Info.Params.N)
-	// fmt.Println(embhint.EmbeddingsHint)
-	// fmt.Println(urlhint.UrlsHint)
-	hint := InitHint(embhint, urlhint)
-
-	c.Setup(hint)
+	hint, _, err := c.FetchHint(EmbAddr, UrlAddr)
+	if err != nil {
+		fmt.Println(err)
+		panic("Could not set up the client")
+	}
 	// logHintSize(hint)
 	gob.Register(corpus.Params{})
 	total := utils.MessageSizeMB(hint.CParams)
@@ -169,69 +293,162 @@ func RunClient(EmbAddr string, UrlAddr string, ch chan []framework.Answer, done
 		gob.Register(database.SubclusterMap{})
 		h := utils.MessageSizeMB(hint.UrlsHint)
 		m := utils.MessageSizeMB(hint.UrlsIndexMap)
-		total += (h + m)
+		d := utils.BytesToMB(uint64(len(hint.UrlsDict)))
+		total += (h + m + d)
 
 		fmt.Printf("\t\tUrls hint: %.2f MB\n", h)
 		fmt.Printf("\t\tUrls map: %.2f MB\n", m)
+		fmt.Printf("\t\tUrls dict: %.2f MB\n", d)
 	}
 	fmt.Printf("\tTotal metadata: %.2f MB\n", total)
 
-	in, out := embeddings.SetupEmbeddingProcess(c.NumClusters(), conf)
+	// Embeddings queries beyond the first probe the next nearest clusters
+	in, out := embeddings.SetupEmbeddingProcessProbing(c.ClusterIdBound(), c.policy.EmbQueries, conf)
 	defer in.Close()
 	defer out.Close()
 
+	cover := NewCoverTraffic(conf.COVER_TRAFFIC())
+	if cover.Enabled() {
+		fmt.Printf("Sending %.1f dummy searches per hour\n", conf.COVER_TRAFFIC().PerHour)
+	}
+
 	for {
 		fmt.Println("Running client preprocessing")
-		clientPreproc := c.preprocessRound(EmbAddr, UrlAddr, true, false, sub)
+		ctx, cancel := c.searchContext(context.Background())
+		clientPreproc, err := c.preprocessRound(ctx, EmbAddr, UrlAddr, true, true, c.sub)
+		cancel()
+		if err != nil {
+			// The search preprocesses its first query itself then
+			fmt.Printf("Preprocessing failed: %v\n", err)
+			c.refetchIfStale(err, EmbAddr, UrlAddr)
+		}
 		// fmt.Printf("Enter private search query: ")
 		fmt.Println("Wait for private search query...")
 		// text := utils.ReadLineFromStdin()
-		text := <-done
+		q, preprocessed := c.waitForQuery(queries, cover, EmbAddr, UrlAddr, err == nil)
 		fmt.Printf("\n\n")
-		if (strings.TrimSpace(text) == "") || (strings.TrimSpace(text) == "quit") {
+		if (strings.TrimSpace(q.Text) == "") || (strings.TrimSpace(q.Text) == "quit") {
 			break
 		}
-		ch <- c.runRound(in, out, text, EmbAddr, UrlAddr, true, false, clientPreproc)
+
+		ctx, cancel = c.searchContext(q.Ctx)
+		answers, err := c.runRound(ctx, in, out, q.Text, EmbAddr, UrlAddr, true, true, preprocessed, clientPreproc)
+		cancel()
+		if err != nil {
+			fmt.Printf("Search failed: %v\n", err)
+			c.refetchIfStale(err, EmbAddr, UrlAddr)
+		}
+		q.Reply <- framework.Result{Answers: answers, Err: err}
 	}
 
-	if c.rpcClient != nil {
-		c.rpcClient.Close()
+}
+
+// Fetches the hint again if err shows that every replica of a server has
+// moved to another DB snapshot
+func (c *Client) refetchIfStale(err error, EmbAddr, UrlAddr string) {
+	if !errors.Is(err, ErrStaleSnapshot) {
+		return
+	}
+	fmt.Println("Servers moved to another DB snapshot -- fetching the hint again")
+	if _, _, err := c.FetchHint(EmbAddr, UrlAddr); err != nil {
+		fmt.Printf("Fetching the hint failed: %v\n", err)
 	}
 }
 
-func (c *Client) preprocessRound(EmbAddr string, UrlAddr string, verbose, keepConn bool, sub int) float64 {
+// Gets the hints of the embeddings and URL servers and sets up the client.
+// Also returns by how much the embeddings hint queries must be truncated
+// for the URL server, as preprocessRound expects. Fails if a hint cannot be
+// fetched, or with ErrUncheckedDB if a server does not serve the DB that
+// the answer checks were made for. The client is left as it was then.
+func (c *Client) FetchHint(EmbAddr string, UrlAddr string) (*TiptoeHint, int, error) {
+	ctx := context.Background()
+
+	// Any snapshot is taken while the hints are fetched
+	embSet, urlSet := c.replicaSet(EmbAddr), c.replicaSet(UrlAddr)
+	embVersion, urlVersion := embSet.version, urlSet.version
+	embSet.reset()
+	urlSet.reset()
+	fail := func(err error) (*TiptoeHint, int, error) {
+		embSet.version, urlSet.version = embVersion, urlVersion
+		return nil, 0, err
+	}
+
+	embhint, err := c.getHint(ctx, false, EmbAddr)
+	if err != nil {
+		return fail(fmt.Errorf("getting the embeddings hint: %w", err))
+	}
+	urlhint, err := c.getHint(ctx, false, UrlAddr)
+	if err != nil {
+		return fail(fmt.Errorf("getting the URL hint: %w", err))
+	}
+	sub := int(embhint.EmbeddingsHint.Info.Params.N - urlhint.UrlsHint.Info.Params.N)
+	// fmt.Println(embhint.EmbeddingsHint)
+	// fmt.Println(urlhint.UrlsHint)
+	hint := InitHint(embhint, urlhint)
+
+	c.setSnapshot(ctx, EmbAddr, embhint)
+	c.setSnapshot(ctx, UrlAddr, urlhint)
+
+	if err := c.Setup(hint); err != nil {
+		return fail(err)
+	}
+	c.sub = sub
+	return hint, sub, nil
+}
+
+func (c *Client) preprocessRound(ctx context.Context, EmbAddr string, UrlAddr string, verbose, keepConn bool, sub int) (float64, error) {
 	// Perform preprocessing
 	start := time.Now()
 	ct := c.PreprocessQuery()
-	EmbofflineAns := c.applyHint(ct, keepConn, EmbAddr)
+	EmbofflineAns, err := c.applyHint(ctx, ct, keepConn, EmbAddr)
+	if err != nil {
+		return 0, err
+	}
+	if c.embHintBytes == 0 {
+		c.embHintBytes = utils.MessageSizeBytes(*ct) + utils.MessageSizeBytes(EmbofflineAns.EmbAnswer)
+	}
 
-	fmt.Println("Get Hint From Emb-Server Successfully")
+	if verbose {
+		fmt.Println("Get Hint From Emb-Server Successfully")
+	}
 
 	// toDrop := int(2048 - 1408)
 	*ct = (*ct)[:len(*ct)-sub]
 
-	UrlofflineAns := c.applyHint(ct, keepConn, UrlAddr)
+	UrlofflineAns, err := c.applyHint(ctx, ct, keepConn, UrlAddr)
+	if err != nil {
+		return 0, err
+	}
+	if c.urlHintBytes == 0 {
+		c.urlHintBytes = utils.MessageSizeBytes(*ct) + utils.MessageSizeBytes(UrlofflineAns.UrlAnswer)
+	}
 
-	fmt.Println("Get Hint From Url-Server Successfully")
+	if verbose {
+		fmt.Println("Get Hint From Url-Server Successfully")
+	}
 
 	var offlineAns = new(UnderhoodAnswer)
 	offlineAns.EmbAnswer = EmbofflineAns.EmbAnswer
 	offlineAns.UrlAnswer = UrlofflineAns.UrlAnswer
 	c.ProcessHintApply(offlineAns)
+	err = c.preprocessEmbParts(func(ct *underhood.HintQuery) (*UnderhoodAnswer, error) {
+		return c.applyHint(ctx, ct, keepConn, EmbAddr)
+	})
+	if err != nil {
+		return 0, err
+	}
 
 	clientPreproc := time.Since(start).Seconds()
 	if verbose {
 		fmt.Printf("\tPreprocessing complete -- %fs\n\n", clientPreproc)
 	}
-	return clientPreproc
+	return clientPreproc, nil
 }
 
-func (c *Client) runRound(in io.WriteCloser, out io.ReadCloser, text, EmbAddr string, UrlAddr string, verbose, keepConn bool, clientPreproc float64) []framework.Answer {
+// Runs a search for text. Unless preprocessed, the search preprocesses its
+// first query itself.
+func (c *Client) runRound(ctx context.Context, in io.WriteCloser, out io.ReadCloser, text, EmbAddr string, UrlAddr string, verbose, keepConn, preprocessed bool, clientPreproc float64) ([]framework.Answer, error) {
 	fmt.Printf("Executing query \"%s\"\n", text)
-	var query struct {
-		Cluster_index uint64
-		Emb           []int8
-	}
 
 	// Perform processing
 
@@ -260,93 +477,95 @@ func (c *Client) runRound(in io.WriteCloser, out io.ReadCloser, text, EmbAddr st
 		fmt.Println("2.Generating embeding of the query")
 	}
 
-	io.WriteString(in, text+"\n")
-	if err := json.NewDecoder(out).Decode(&query); err != nil {
-		panic(err)
-	}
+	clusters, emb := embeddings.EmbedQueryClusters(in, out, text)
+	clientSetup := time.Since(start).Seconds()
 
-	if query.Cluster_index >= uint64(c.NumClusters()) {
-		panic("Should not happen")
+	// The nearest centroid may belong to a cluster that was dropped. The
+	// queries are sent all the same, not to reveal it.
+	if !c.HasCluster(clusters[0]) {
+		fmt.Printf("Cluster %d is not served\n", clusters[0])
 	}
 
 	if verbose {
-		fmt.Printf("3.Building PIR query for cluster %d\n", query.Cluster_index)
+		fmt.Printf("3.Sending %d SimplePIR queries for clusters %v, then %d for URL chunks\n",
+			c.policy.EmbQueries, clusters, c.policy.UrlQueries)
+	}
+	results, EmbTime, UrlTime, err := c.search(ctx, clusters, emb, EmbAddr, UrlAddr, keepConn, preprocessed)
+	if err != nil {
+		return nil, err
 	}
-	embQuery := c.QueryEmbeddings(query.Emb, query.Cluster_index)
-	// p.clientSetup = time.Since(start).Seconds()
-	clientSetup := time.Since(start).Seconds()
 
-	// Send embeddings query to server
-	if verbose {
-		fmt.Println("4.Sending SimplePIR query to server")
+	result := MergeResults(results)
+	if len(result) == 0 {
+		fmt.Println("No results")
+	} else if verbose {
+		fmt.Println("Reconstructed PIR answers.")
+		fmt.Printf("\tThe top %d retrieved urls are:\n", NUM_RESULTS)
+		for j, d := range result {
+			fmt.Printf("\t% 3d) [score %s] %s %s\n", j+1,
+				color.YellowString(fmt.Sprintf("% 4d", d.Score)),
+				color.BlueString(d.Url), d.Title)
+		}
 	}
-	networkingStartEmb := time.Now()
-	embAns := c.getEmbeddingsAnswer(embQuery, keepConn, EmbAddr)
-	// p.t1, p.up1, p.down1 = logStats(c.params.NumDocs, networkingStart, embQuery, embAns)
-	EmbTime := time.Since(networkingStartEmb).Seconds()
 
-	// Recover document and URL chunk to query for
-	fmt.Println("5.Decrypting server answer")
-	embDec := c.ReconstructEmbeddingsWithinCluster(embAns, query.Cluster_index)
-	scores := embeddings.SmoothResults(embDec, c.embInfo.P())
-	indicesByScore := utils.SortByScores(scores)
-	docIndex := indicesByScore[0]
+	clientTotal := time.Since(start).Seconds()
+	fmt.Printf("\tAnswered in:\n\t\t%v (preproc)\n\t\t%v (client)\n\t\t%v (round 1)\n\t\t%v (round 2)\n\t\t%v (total)\n---\n",
+		clientPreproc, clientSetup, EmbTime, UrlTime, clientTotal)
 
-	if verbose {
-		fmt.Printf("\tDoc %d within cluster %d has the largest inner product with our query\n", docIndex, query.Cluster_index)
-		fmt.Printf("Building PIR query for url/title of doc %d in cluster %d\n", docIndex, query.Cluster_index)
-	}
-	// Build URL query
-	urlQuery, retrievedChunk := c.QueryUrls(query.Cluster_index, docIndex)
+	return result, nil
+}
 
-	// Send URL query to server
-	if verbose {
-		fmt.Printf("Sending PIR query to server for chunk %d\n", retrievedChunk)
-	}
-	networkingStartUrl := time.Now()
-	urlAns := c.getUrlsAnswer(urlQuery, keepConn, UrlAddr)
-	// p.t2, p.up2, p.down2 = logStats(c.params.NumDocs, networkingStart, urlQuery, urlAns)
-	UrlTime := time.Since(networkingStartUrl).Seconds()
+// Runs the private search for a query embedding over the clusters, nearest
+// first, with requests of the shape set by the request policy. Preprocesses
+// the secrets of every query first. Returns the results by cluster, then by
+// chunk; unserved and empty clusters have none.
+func (c *Client) SearchClusters(clusters []uint64, emb []int8, EmbAddr string, UrlAddr string) ([][][]framework.Answer, error) {
+	ctx, cancel := c.searchContext(context.Background())
+	defer cancel()
+	results, _, _, err := c.search(ctx, clusters, emb, EmbAddr, UrlAddr, false, false)
+	return results, err
+}
 
-	// Recover URLs of top 10 docs in chunk
-	urls := c.ReconstructUrls(urlAns, query.Cluster_index, docIndex)
-	if verbose {
-		fmt.Println("Reconstructed PIR answers.")
-		fmt.Printf("\tThe top 10 retrieved urls are:\n")
-	}
+// Picks the results shown for a query: the docs of the retrieved URL chunk,
+// by decreasing score, without repeating a page. The scores must have been
+// sorted by utils.SortByScores, which returned indicesByScore.
+func RankRetrievedChunk(scores []int, indicesByScore []uint64, urlMap database.SubclusterMap,
+	cluster, retrievedChunk uint64, urls []corpus.Doc, verbose bool) []framework.Answer {
 	j := 1
 	var result []framework.Answer
+	seen := make(map[string]bool) // the same page may be stored more than once
 	for at := 0; at < len(indicesByScore); at++ {
 		if scores[at] == 0 {
 			break
 		}
 
 		doc := indicesByScore[at]
-		_, chunk, index := c.urlMap.SubclusterToIndex(query.Cluster_index, doc)
+		_, chunk, index := urlMap.SubclusterToIndex(cluster, doc)
 
 		if chunk == retrievedChunk {
 			s := scores[at]
-			u := corpus.GetIthUrl(urls, index)
+			d := corpus.GetIthUrl(urls, index)
+			key := corpus.NormalizeUrl(d.Url)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
 			if verbose {
 				// fmt.Printf("\t% 3d) [score %s] %s\n", j,
 				// 	color.YellowString(fmt.Sprintf("% 4d", scores[at])),
 				// 	color.BlueString(corpus.GetIthUrl(urls, index)))
-				fmt.Printf("\t% 3d) [score %s] %s\n", j,
+				fmt.Printf("\t% 3d) [score %s] %s %s\n", j,
 					color.YellowString(fmt.Sprintf("% 4d", s)),
-					color.BlueString(u))
+					color.BlueString(d.Url), d.Title)
 			}
-			result = append(result, framework.Answer{Score: s, Url: u})
+			result = append(result, framework.Answer{Score: s, Url: d.Url, Title: d.Title, Snippet: d.Snippet})
 			j += 1
-			if j > 10 {
+			if j > NUM_RESULTS {
 				break
 			}
 		}
 	}
 
-	clientTotal := time.Since(start).Seconds()
-	fmt.Printf("\tAnswered in:\n\t\t%v (preproc)\n\t\t%v (client)\n\t\t%v (round 1)\n\t\t%v (round 2)\n\t\t%v (total)\n---\n",
-		clientPreproc, clientSetup, EmbTime, UrlTime, clientTotal)
-
 	return result
 }
 
@@ -355,10 +574,10 @@ func (c *Client) PreprocessQuery() *underhood.HintQuery {
 		panic("Not set up")
 	}
 
-	if c.embClient != nil {
-		hintQuery := c.embClient.HintQuery()
+	if len(c.embClients) > 0 {
+		hintQuery := c.embClients[0].HintQuery()
 		if c.urlClient != nil {
-			c.urlClient.CopySecret(c.embClient)
+			c.urlClient.CopySecret(c.embClients[0])
 		}
 		return hintQuery
 	} else if c.urlClient != nil {
@@ -369,9 +588,9 @@ func (c *Client) PreprocessQuery() *underhood.HintQuery {
 }
 
 func (c *Client) ProcessHintApply(ans *UnderhoodAnswer) {
-	if c.embClient != nil {
-		c.embClient.HintRecover(&ans.EmbAnswer)
-		c.embClient.PreprocessQueryLHE()
+	if len(c.embClients) > 0 {
+		c.embClients[0].HintRecover(&ans.EmbAnswer)
+		c.embClients[0].PreprocessQueryLHE()
 	}
 
 	if c.urlClient != nil {
@@ -380,29 +599,52 @@ func (c *Client) ProcessHintApply(ans *UnderhoodAnswer) {
 	}
 }
 
-func (c *Client) QueryEmbeddings(emb []int8, clusterIndex uint64) *pir.Query[matrix.Elem64] {
+// Each part of an embeddings query needs its own secret. Preprocesses the
+// secrets of all parts but the first, using apply to answer hint queries.
+func (c *Client) preprocessEmbParts(apply func(*underhood.HintQuery) (*UnderhoodAnswer, error)) error {
+	for i := 1; i < len(c.embClients); i++ {
+		ans, err := apply(c.embClients[i].HintQuery())
+		if err != nil {
+			return err
+		}
+		c.embClients[i].HintRecover(&ans.EmbAnswer)
+		c.embClients[i].PreprocessQueryLHE()
+	}
+	return nil
+}
+
+// Builds one query per part of the cluster, padded with queries for nothing
+// so that every query has as many parts as the most split cluster.
+func (c *Client) QueryEmbeddings(emb []int8, clusterIndex uint64) []pir.Query[matrix.Elem64] {
 	if c.params.NumDocs == 0 {
 		panic("Not set up")
 	}
 
-	dbIndex := c.embMap.ClusterToIndex(uint(clusterIndex))
+	ranges := c.embMap.ClusterToRanges(uint(clusterIndex))
 	m := c.embInfo.M
 	dim := uint64(len(emb))
 
 	if m%dim != 0 {
 		panic("Should not happen")
 	}
-	if dbIndex%dim != 0 {
-		panic("Should not happen")
-	}
 
-	_, colIndex := database.Decompose(dbIndex, m)
-	arr := matrix.Zeros[matrix.Elem64](m, 1)
-	for j := uint64(0); j < dim; j++ {
-		arr.AddAt(colIndex+j, 0, matrix.Elem64(emb[j]))
+	queries := make([]pir.Query[matrix.Elem64], len(c.embClients))
+	for i := range queries {
+		arr := matrix.Zeros[matrix.Elem64](m, 1)
+		if i < len(ranges) {
+			if ranges[i].Index%dim != 0 {
+				panic("Should not happen")
+			}
+
+			_, colIndex := database.Decompose(ranges[i].Index, m)
+			for j := uint64(0); j < dim; j++ {
+				arr.AddAt(colIndex+j, 0, matrix.Elem64(emb[j]))
+			}
+		}
+		queries[i] = *c.embClients[i].QueryLHE(arr)
 	}
 
-	return c.embClient.QueryLHE(arr)
+	return queries
 }
 
 func (c *Client) QueryUrls(clusterIndex, docIndex uint64) (*pir.Query[matrix.Elem32], uint64) {
@@ -415,49 +657,100 @@ func (c *Client) QueryUrls(clusterIndex, docIndex uint64) (*pir.Query[matrix.Ele
 	return c.urlClient.Query(dbIndex), chunkIndex
 }
 
-func (c *Client) getEmbeddingsAnswer(query *pir.Query[matrix.Elem64], keepConn bool, tcp string) *pir.Answer[matrix.Elem64] {
-	ans := pir.Answer[matrix.Elem64]{}
-	c.rpcClient = makeRPC[pir.Query[matrix.Elem64], pir.Answer[matrix.Elem64]](query, &ans, keepConn, tcp, "GetEmbeddingsAnswer", c.rpcClient)
-	return &ans
+func (c *Client) getEmbeddingsAnswer(ctx context.Context, queries []pir.Query[matrix.Elem64], keepConn bool, tcp string) ([]pir.Answer[matrix.Elem64], error) {
+	ans := []pir.Answer[matrix.Elem64]{}
+	err := makeRPC[[]pir.Query[matrix.Elem64], []pir.Answer[matrix.Elem64]](ctx, &queries, &ans, keepConn, true, tcp, "GetEmbeddingsAnswers", c)
+	return ans, err
 }
 
-func (c *Client) getUrlsAnswer(query *pir.Query[matrix.Elem32], keepConn bool, tcp string) *pir.Answer[matrix.Elem32] {
+func (c *Client) getUrlsAnswer(ctx context.Context, query *pir.Query[matrix.Elem32], keepConn bool, tcp string) (*pir.Answer[matrix.Elem32], error) {
 	ans := pir.Answer[matrix.Elem32]{}
-	c.rpcClient = makeRPC[pir.Query[matrix.Elem32], pir.Answer[matrix.Elem32]](query, &ans, keepConn, tcp, "GetUrlsAnswer", c.rpcClient)
-	return &ans
+	err := makeRPC[pir.Query[matrix.Elem32], pir.Answer[matrix.Elem32]](ctx, query, &ans, keepConn, true, tcp, "GetUrlsAnswer", c)
+	return &ans, err
 }
 
-func (c *Client) getHint(keepConn bool, tcp string) *TiptoeHint {
+func (c *Client) getHint(ctx context.Context, keepConn bool, tcp string) (*TiptoeHint, error) {
 	query := true
 	hint := TiptoeHint{}
-	c.rpcClient = makeRPC[bool, TiptoeHint](&query, &hint, keepConn, tcp, "GetHint", c.rpcClient)
-	return &hint
+	err := makeRPC[bool, TiptoeHint](ctx, &query, &hint, keepConn, false, tcp, "GetHint", c)
+	return &hint, err
 }
 
-func (c *Client) applyHint(ct *underhood.HintQuery, keepConn bool, tcp string) *UnderhoodAnswer {
+func (c *Client) applyHint(ctx context.Context, ct *underhood.HintQuery, keepConn bool, tcp string) (*UnderhoodAnswer, error) {
 	ans := UnderhoodAnswer{}
-	c.rpcClient = makeRPC[underhood.HintQuery, UnderhoodAnswer](ct, &ans, keepConn, tcp, "ApplyHint", c.rpcClient)
-	return &ans
+	err := makeRPC[underhood.HintQuery, UnderhoodAnswer](ctx, ct, &ans, keepConn, true, tcp, "ApplyHint", c)
+	return &ans, err
 }
 
-func (c *Client) ReconstructEmbeddingsWithinCluster(ans *pir.Answer[matrix.Elem64], clusterIndex uint64) []uint64 {
-	dbIndex := c.embMap.ClusterToIndex(uint(clusterIndex))
-	rowStart, colIndex := database.Decompose(dbIndex, c.embInfo.M)
-	rowEnd := database.FindEnd(c.embIndices, rowStart, colIndex, c.embInfo.M, c.embInfo.L, 0)
-
-	vals := c.embClient.RecoverLHE(ans)
+// Returns the inner products with every doc in the cluster, in order,
+// gathered from the answers to each part of the query.
+func (c *Client) ReconstructEmbeddingsWithinCluster(answers []pir.Answer[matrix.Elem64], clusterIndex uint64) []uint64 {
+	ranges := c.embMap.ClusterToRanges(uint(clusterIndex))
+	if len(answers) != len(c.embClients) {
+		panic("Wrong number of answers")
+	}
 
-	res := make([]uint64, rowEnd-rowStart)
-	at := 0
-	for j := rowStart; j < rowEnd; j++ {
-		res[at] = uint64(vals.Get(j, 0))
-		at += 1
+	res := make([]uint64, 0)
+	for i, r := range ranges {
+		rowStart, _ := database.Decompose(r.Index, c.embInfo.M)
+		vals := c.embClients[i].RecoverLHE(&answers[i])
+		for j := rowStart; j < rowStart+r.Size; j++ {
+			res = append(res, uint64(vals.Get(j, 0)))
+		}
 	}
 
 	return res
 }
 
-func (c *Client) ReconstructUrls(answer *pir.Answer[matrix.Elem32], clusterIndex, docIndex uint64) string {
+// Checks the answers to QueryEmbeddings(emb, clusterIndex) against the
+// answer checks, if any. Padding parts must decrypt to zeros.
+func (c *Client) CheckEmbeddingsAnswers(answers []pir.Answer[matrix.Elem64], emb []int8, clusterIndex uint64) bool {
+	if c.embCheck == nil {
+		return true
+	}
+	if len(answers) != len(c.embClients) {
+		return false
+	}
+
+	ranges := c.embMap.ClusterToRanges(uint(clusterIndex))
+	for i := range answers {
+		dec := c.embClients[i].RecoverLHE(&answers[i])
+		vals := make([]uint64, dec.Rows())
+		for j := range vals {
+			vals[j] = uint64(dec.Get(uint64(j), 0))
+		}
+
+		colIndex := uint64(0)
+		q := []int64{}
+		if i < len(ranges) {
+			_, colIndex = database.Decompose(ranges[i].Index, c.embInfo.M)
+			q = make([]int64, len(emb))
+			for j, v := range emb {
+				q[j] = int64(v)
+			}
+		}
+		if !c.embCheck.Check(vals, colIndex, q) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks the answer to QueryUrls(clusterIndex, docIndex) against the
+// answer checks, if any
+func (c *Client) CheckUrlsAnswer(answer *pir.Answer[matrix.Elem32], clusterIndex, docIndex uint64) bool {
+	if c.urlCheck == nil {
+		return true
+	}
+
+	dbIndex, _, _ := c.urlMap.SubclusterToIndex(clusterIndex, docIndex)
+	_, colIndex := database.Decompose(dbIndex, c.urlInfo.M)
+	return c.urlCheck.Check(c.urlClient.Recover(answer), colIndex, []int64{1})
+}
+
+// Decodes the URL chunk that the answer holds. Fails if the chunk is
+// corrupt, e.g. as the server tampered with it.
+func (c *Client) ReconstructUrls(answer *pir.Answer[matrix.Elem32], clusterIndex, docIndex uint64) ([]corpus.Doc, error) {
 	dbIndex, _, _ := c.urlMap.SubclusterToIndex(clusterIndex, docIndex)
 	rowStart, colIndex := database.Decompose(dbIndex, c.urlInfo.M)
 	rowEnd := database.FindEnd(c.urlIndices, rowStart, colIndex, c.urlInfo.M, c.urlInfo.L, c.params.UrlBytes)
@@ -469,30 +762,63 @@ func (c *Client) ReconstructUrls(answer *pir.Answer[matrix.Elem32], clusterIndex
 		out[i] = byte(e)
 	}
 
-	if c.params.CompressUrl {
-		res, err := corpus.Decompress(out)
-		for err != nil {
-			out = out[:len(out)-1]
-			if len(out) == 0 {
-				panic("Should not happen")
-			}
-			res, err = corpus.Decompress(out)
-		}
-		return strings.TrimRight(res, "\x00")
-	}
-
-	return strings.TrimRight(string(out), "\x00")
+	return corpus.DecodeSubcluster(out, c.urlCompressor)
 }
 
-func makeRPC[Q QueryType, A AnsType](query *Q, reply *A, keepConn bool, tcp, rpc string, client *rpc.Client) *rpc.Client {
-	if client == nil {
-		client = utils.DialTCP(tcp)
+// Calls one of the replicas listed in tcp, trying the others in turn if it
+// fails, on a connection from the pool of c. Pays for the call first if
+// pay, and leaves the connection in the pool if keepConn.
+func makeRPC[Q QueryType, A AnsType](ctx context.Context, query *Q, reply *A, keepConn, pay bool, tcp, rpc string, c *Client) error {
+	set := c.replicaSet(tcp)
+	var err error
+	stale := true // whether every replica serves another snapshot
+	for _, r := range set.order(time.Now()) {
+		err = callReplica(ctx, query, reply, keepConn, pay, set, r, rpc, c)
+		if err == nil || ctx.Err() != nil || !failover(err) {
+			return err
+		}
+		if err != errStaleReplica {
+			stale = false
+			r.downUntil = time.Now().Add(utils.Seconds(c.pool.conf.DownSec))
+		}
+		if len(set.replicas) > 1 {
+			fmt.Printf("Call to replica %s failed: %v\n", r.addr, err)
+		}
 	}
-	utils.CallTCP(client, "Server."+rpc, query, reply)
-	if !keepConn {
-		client.Close()
-		client = nil
+	if stale {
+		return fmt.Errorf("%s: %w", tcp, ErrStaleSnapshot)
 	}
+	return err
+}
+
+// A call that fails on an idle connection, which may have broken since, is
+// made again on a new one. The version of the replica is checked on each
+// new connection.
+func callReplica[Q QueryType, A AnsType](ctx context.Context, query *Q, reply *A, keepConn, pay bool, set *replicaSet, r *replica, rpc string, c *Client) error {
+	for {
+		conn, reused, err := c.pool.get(ctx, r.addr)
+		if err != nil {
+			return err
+		}
 
-	return client
+		if !reused {
+			err = c.checkVersion(ctx, conn, set, r)
+		}
+		if err == nil && pay {
+			err = c.payFor(ctx, conn)
+		}
+		if err == nil {
+			err = conn.Call(ctx, "Server."+rpc, query, reply)
+		}
+		if err == nil && keepConn {
+			c.pool.put(r.addr, conn)
+			return nil
+		}
+		conn.Close()
+
+		if err != nil && reused && conn.Broken() && ctx.Err() == nil {
+			continue
+		}
+		return err
+	}
 }
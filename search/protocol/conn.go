@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"context"
+
 	"github.com/ahenzinger/underhood/underhood"
 	"github.com/henrycg/simplepir/matrix"
 	"github.com/henrycg/simplepir/pir"
@@ -11,17 +13,44 @@ func (s *Server) GetHint(request bool, hint *TiptoeHint) error {
 	return nil
 }
 
+func (s *Server) GetVersion(request bool, version *string) error {
+	*version = s.hint.SnapshotVersion()
+	return nil
+}
+
 func (s *Server) GetEmbeddingsAnswer(query *pir.Query[matrix.Elem64], ans *pir.Answer[matrix.Elem64]) error {
 	*ans = *s.embeddingsServer.Answer(query)
 	return nil
 }
 
+// Answers each part of an embeddings query covering a split cluster
+func (s *Server) GetEmbeddingsAnswers(queries *[]pir.Query[matrix.Elem64], ans *[]pir.Answer[matrix.Elem64]) error {
+	return s.embeddingsAnswers(context.Background(), queries, ans)
+}
+
+// Stops between parts once ctx is done
+func (s *Server) embeddingsAnswers(ctx context.Context, queries *[]pir.Query[matrix.Elem64], ans *[]pir.Answer[matrix.Elem64]) error {
+	*ans = make([]pir.Answer[matrix.Elem64], len(*queries))
+	for i := range *queries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		(*ans)[i] = *s.embeddingsServer.Answer(&(*queries)[i])
+	}
+	return nil
+}
+
 func (s *Server) GetUrlsAnswer(query *pir.Query[matrix.Elem32], ans *pir.Answer[matrix.Elem32]) error {
 	*ans = *s.urlsServer.Answer(query)
 	return nil
 }
 
 func (s *Server) ApplyHint(ct *underhood.HintQuery, out *UnderhoodAnswer) error {
+	return s.applyHint(context.Background(), ct, out)
+}
+
+// Stops between the two DBs once ctx is done
+func (s *Server) applyHint(ctx context.Context, ct *underhood.HintQuery, out *UnderhoodAnswer) error {
 	if s.hint.ServeEmbeddings {
 		if s.embHintServer == nil {
 			s.preprocessEmbHint()
@@ -34,6 +63,9 @@ func (s *Server) ApplyHint(ct *underhood.HintQuery, out *UnderhoodAnswer) error
 		// }
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if s.hint.ServeUrls {
 		if s.urlHintServer == nil {
 			s.preprocessUrlHint()
@@ -45,6 +77,9 @@ func (s *Server) ApplyHint(ct *underhood.HintQuery, out *UnderhoodAnswer) error
 }
 
 func (s *Server) preprocessEmbHint() {
+	// Pin the snapshot while the hint matrix is whole
+	s.hint.Version = s.hint.digest()
+
 	// Decompose hint
 	s.embHintServer = underhood.NewServerHintOnly(&s.hint.EmbeddingsHint.Hint)
 
@@ -54,6 +89,9 @@ func (s *Server) preprocessEmbHint() {
 }
 
 func (s *Server) preprocessUrlHint() {
+	// Pin the snapshot while the hint matrix is whole
+	s.hint.Version = s.hint.digest()
+
 	// Decompose hint
 	s.urlHintServer = underhood.NewServerHintOnly(&s.hint.UrlsHint.Hint)
 
@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"search/config"
+	"search/framework"
+	"search/utils"
+)
+
+// Schedules the dummy searches of an idle client at exponential intervals,
+// i.e. as a Poisson process, within a budget of traffic per hour
+type CoverTraffic struct {
+	conf config.CoverTraffic
+	r    *rand.Rand
+
+	windowStart time.Time
+	spent       uint64 // bytes sent and received in the current hour
+}
+
+func NewCoverTraffic(conf config.CoverTraffic) *CoverTraffic {
+	t := new(CoverTraffic)
+	t.conf = conf
+	t.r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	return t
+}
+
+func (t *CoverTraffic) Enabled() bool {
+	return t != nil && t.conf.PerHour > 0
+}
+
+// Fires when the next dummy search is due. Never fires if disabled.
+func (t *CoverTraffic) Next() <-chan time.Time {
+	if !t.Enabled() {
+		return nil
+	}
+	return time.After(t.nextDelay())
+}
+
+func (t *CoverTraffic) nextDelay() time.Duration {
+	return time.Duration(t.r.ExpFloat64() / t.conf.PerHour * float64(time.Hour))
+}
+
+// Whether a dummy search of this many bytes fits the budget of the hour,
+// in which case it is counted against it
+func (t *CoverTraffic) Spend(bytes uint64) bool {
+	return t.spend(bytes, time.Now())
+}
+
+func (t *CoverTraffic) spend(bytes uint64, now time.Time) bool {
+	if now.Sub(t.windowStart) >= time.Hour {
+		t.windowStart = now
+		t.spent = 0
+	}
+
+	if t.conf.MaxMBPerHour > 0 && utils.BytesToMB(t.spent+bytes) > t.conf.MaxMBPerHour {
+		return false
+	}
+	t.spent += bytes
+	return true
+}
+
+// Estimates the traffic of a search under the request policy: an ApplyHint
+// round and a PIR query per query of the policy. Exact once a round has
+// been preprocessed, which measures the ApplyHint traffic.
+func (c *Client) SearchBytes() uint64 {
+	parts := uint64(len(c.embClients))
+	embQuery := parts * (c.embInfo.M + c.embInfo.L) * 8
+	urlQuery := (c.urlInfo.M + c.urlInfo.L) * 4
+	round := parts*c.embHintBytes + c.urlHintBytes
+
+	rounds := uint64(c.policy.EmbQueries + c.policy.UrlQueries)
+	return rounds*round + uint64(c.policy.EmbQueries)*embQuery + uint64(c.policy.UrlQueries)*urlQuery
+}
+
+// Sends a search for nothing, which the servers cannot tell apart from a
+// real one. As a real search does, it uses up the secrets of the last
+// preprocessRound, so the next query must be preprocessed again.
+func (c *Client) coverSearch(ctx context.Context, EmbAddr, UrlAddr string) error {
+	_, _, _, err := c.search(ctx, nil, nil, EmbAddr, UrlAddr, true, true)
+	return err
+}
+
+// Waits for the next query, sending dummy searches on the cover schedule
+// meanwhile. Each is followed by a preprocessRound, as a real search is in
+// RunClient, so that the next query is preprocessed. Also returns whether
+// it is, which it may not be if a call failed.
+func (c *Client) waitForQuery(queries chan framework.Query, cover *CoverTraffic, EmbAddr, UrlAddr string, preprocessed bool) (framework.Query, bool) {
+	for {
+		select {
+		case q := <-queries:
+			return q, preprocessed
+		case <-cover.Next():
+			if !cover.Spend(c.SearchBytes()) {
+				fmt.Println("Cover traffic budget used up for this hour -- dummy search skipped")
+				continue
+			}
+
+			ctx, cancel := c.searchContext(context.Background())
+			err := c.coverRound(ctx, EmbAddr, UrlAddr, preprocessed)
+			cancel()
+			preprocessed = err == nil
+			if err != nil {
+				fmt.Printf("Dummy search failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// A dummy search, then a preprocessRound for the next query
+func (c *Client) coverRound(ctx context.Context, EmbAddr, UrlAddr string, preprocessed bool) error {
+	if !preprocessed {
+		if _, err := c.preprocessRound(ctx, EmbAddr, UrlAddr, false, true, c.sub); err != nil {
+			return err
+		}
+	}
+	if err := c.coverSearch(ctx, EmbAddr, UrlAddr); err != nil {
+		return err
+	}
+	_, err := c.preprocessRound(ctx, EmbAddr, UrlAddr, false, true, c.sub)
+	return err
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"search/config"
+)
+
+func TestCoverTrafficSchedule(t *testing.T) {
+	if NewCoverTraffic(config.CoverTraffic{}).Next() != nil {
+		t.Fatal("disabled cover traffic should never fire")
+	}
+
+	cover := NewCoverTraffic(config.CoverTraffic{PerHour: 3600})
+	n := 20000
+	total := time.Duration(0)
+	for i := 0; i < n; i++ {
+		total += cover.nextDelay()
+	}
+	if mean := total.Seconds() / float64(n); math.Abs(mean-1) > 0.05 {
+		t.Fatalf("mean delay %.3fs, want 1s", mean)
+	}
+}
+
+func TestCoverTrafficBudget(t *testing.T) {
+	cover := NewCoverTraffic(config.CoverTraffic{PerHour: 60, MaxMBPerHour: 1})
+	start := time.Now()
+
+	if !cover.spend(600*1024, start) {
+		t.Fatal("search within budget refused")
+	}
+	if cover.spend(600*1024, start.Add(time.Minute)) {
+		t.Fatal("search over budget allowed")
+	}
+	if !cover.spend(600*1024, start.Add(time.Hour)) {
+		t.Fatal("budget should renew every hour")
+	}
+}
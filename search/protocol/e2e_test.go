@@ -0,0 +1,343 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	"search/config"
+	"search/corpus"
+	"search/corpus/corpustest"
+	"search/embeddings"
+	"search/framework"
+	"search/utils"
+)
+
+const e2eNumQueries = 6
+
+// Counts the connections it accepts, one per RPC of a client that does not
+// keep its connection open
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// Serves s on an ephemeral loopback port until the end of the test
+func serveCounting(t *testing.T, s *Server) *countingListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	cl := &countingListener{Listener: l}
+	go s.ServeListener(cl)
+	return cl
+}
+
+// An embeddings server and a URL server set up over the corpus of f, as
+// read from disk, as emb-server and url-server do
+func newTestServers(t *testing.T, f *corpustest.Fixture) (*Server, *Server) {
+	t.Helper()
+	embServer := Newserver()
+	embServer.PreprocessEmbeddingsFromCorpus(corpus.ReadEmbeddings(0, f.Conf.NUM_CLUSTERS(), f.Conf), f.Conf)
+	embServer.preprocessEmbHint()
+	urlServer := Newserver()
+	urlServer.PreprocessUrlsFromCorpus(corpus.ReadUrls(0, f.Conf.NUM_CLUSTERS(), f.Conf), f.Conf)
+	urlServer.preprocessUrlHint()
+	return embServer, urlServer
+}
+
+func serveLoopback(t *testing.T, s *Server) string {
+	return serveCounting(t, s).Addr().String()
+}
+
+// The i-th doc of a cluster, across its subclusters
+func syntheticDoc(syn *corpus.Synthetic, cluster uint, i int) corpus.SyntheticDoc {
+	for _, sc := range syn.Cluster(cluster) {
+		if i < len(sc) {
+			return sc[i]
+		}
+		i -= len(sc)
+	}
+	panic("No such doc")
+}
+
+// Stands in for embed_text.py: answers each query "cluster doc" with the
+// embedding of that doc of the synthetic corpus, routed to its cluster
+func fakeEmbedder(t *testing.T, syn *corpus.Synthetic) (io.WriteCloser, io.ReadCloser) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+
+	go func() {
+		defer outW.Close()
+		scanner := bufio.NewScanner(inR)
+		for scanner.Scan() {
+			var cluster uint
+			var doc int
+			fmt.Sscan(scanner.Text(), &cluster, &doc)
+
+			emb := make([]int8, syn.Spec.Dim)
+			if int(cluster) < syn.Spec.Clusters && doc < syn.NumDocsInCluster(cluster) {
+				emb = syntheticDoc(syn, cluster, doc).Emb
+			}
+
+			out := struct {
+				Cluster_index uint64
+				Emb           []int8
+			}{uint64(cluster), emb}
+			if err := json.NewEncoder(outW).Encode(&out); err != nil {
+				return
+			}
+		}
+	}()
+
+	t.Cleanup(func() { inW.Close() })
+	return inW, outR
+}
+
+// The results that the client should show for a query routed to a cluster,
+// computed in the clear: the docs in the subcluster of the top doc, by
+// decreasing score, stopping at the first zero score. Returns the expected
+// results for each subcluster holding a top doc, as ties may go either way.
+func plaintextResults(syn *corpus.Synthetic, cluster uint, query []int8) [][]framework.Answer {
+	type scored struct {
+		doc        corpus.SyntheticDoc
+		subcluster int
+		score      int
+	}
+
+	docs := make([]scored, 0)
+	for sc, subcluster := range syn.Cluster(cluster) {
+		for _, d := range subcluster {
+			docs = append(docs, scored{d, sc, embeddings.InnerProduct(query, d.Emb)})
+		}
+	}
+	sort.SliceStable(docs, func(i, j int) bool { return docs[i].score > docs[j].score })
+
+	out := make([][]framework.Answer, 0)
+	for _, top := range docs {
+		if top.score != docs[0].score {
+			break
+		}
+
+		results := make([]framework.Answer, 0)
+		for _, d := range docs {
+			if d.score == 0 {
+				break
+			}
+			if d.subcluster == top.subcluster {
+				results = append(results, framework.Answer{Score: d.score, Url: d.doc.Doc.Url, Title: d.doc.Doc.Title, Snippet: d.doc.Doc.Snippet})
+			}
+		}
+		out = append(out, sortAnswers(results))
+	}
+	return out
+}
+
+// Orders answers of equal score by url, as their order is arbitrary
+func sortAnswers(answers []framework.Answer) []framework.Answer {
+	sort.SliceStable(answers, func(i, j int) bool {
+		if answers[i].Score != answers[j].Score {
+			return answers[i].Score > answers[j].Score
+		}
+		return answers[i].Url < answers[j].Url
+	})
+	return answers
+}
+
+func matchesOneOf(got []framework.Answer, wants [][]framework.Answer) bool {
+	for _, want := range wants {
+		if reflect.DeepEqual(sortAnswers(got), want) {
+			return true
+		}
+	}
+	return false
+}
+
+func testEndToEnd(t *testing.T, codec string) {
+	spec := corpustest.SmallSpec()
+	// A subcluster holds at most NUM_RESULTS docs, so that no result is cut
+	spec.SubclusterDocs = NUM_RESULTS
+	f := corpustest.New(t, spec)
+	f.Conf.SetUrlCodec(codec)
+
+	embServer, urlServer := newTestServers(t, f)
+
+	embAddr := serveLoopback(t, embServer)
+	urlAddr := serveLoopback(t, urlServer)
+	in, out := fakeEmbedder(t, f.Synthetic)
+
+	c := NewClient()
+	hint, sub, err := c.FetchHint(embAddr, urlAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hint.ServeEmbeddings || !hint.ServeUrls {
+		t.Fatal("merged hint should serve both embeddings and urls")
+	}
+	if hint.CParams.UrlCodec != codec || !bytes.Equal(hint.UrlsDict, urlServer.hint.UrlsDict) {
+		t.Fatalf("merged hint has codec %q and a %d-byte dict", hint.CParams.UrlCodec, len(hint.UrlsDict))
+	}
+	if sub <= 0 {
+		t.Fatalf("URL hint queries should be shorter than embedding ones, truncated by %d", sub)
+	}
+
+	// Query a random doc of each non-empty cluster, each in its own round
+	ctx := context.Background()
+	queries := 0
+	for _, cluster := range f.Synthetic.ClusterIds() {
+		n := f.Synthetic.NumDocsInCluster(cluster)
+		if n == 0 {
+			continue
+		}
+		doc := int(utils.RandomIndex(n))
+
+		text := fmt.Sprintf("%d %d", cluster, doc)
+		preproc, err := c.preprocessRound(ctx, embAddr, urlAddr, false, false, sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.runRound(ctx, in, out, text, embAddr, urlAddr, false, false, true, preproc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		query := syntheticDoc(f.Synthetic, cluster, doc).Emb
+		wants := plaintextResults(f.Synthetic, cluster, query)
+		if !matchesOneOf(got, wants) {
+			t.Fatalf("query %q: got %v, want one of %v", text, got, wants)
+		}
+
+		queries += 1
+		if queries == e2eNumQueries {
+			break
+		}
+	}
+
+	// A query routed to an unserved cluster has no results
+	if got, err := c.runRound(ctx, in, out, fmt.Sprintf("%d 0", spec.Clusters), embAddr, urlAddr, false, false, false, 0); got != nil || err != nil {
+		t.Fatalf("unserved cluster: got %v, %v", got, err)
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	for _, codec := range []string{config.URL_CODEC_ZLIB, config.URL_CODEC_ZSTD_DICT} {
+		t.Run(codec, func(t *testing.T) {
+			testEndToEnd(t, codec)
+		})
+	}
+}
+
+// Searches of any shape, including over unserved and empty clusters, and
+// dummy searches send the same number of RPCs to each server
+func TestConstantShape(t *testing.T) {
+	spec := corpustest.SmallSpec()
+	spec.EmptyFrac = 0.25
+	f := corpustest.New(t, spec)
+
+	embServer, urlServer := newTestServers(t, f)
+
+	embL := serveCounting(t, embServer)
+	urlL := serveCounting(t, urlServer)
+	embAddr, urlAddr := embL.Addr().String(), urlL.Addr().String()
+
+	f.Conf.SetRequestPolicy(config.RequestPolicy{EmbQueries: 2, UrlQueries: 3})
+	c := NewClient()
+	c.SetRequestPolicy(f.Conf.REQUEST_POLICY())
+	if _, _, err := c.FetchHint(embAddr, urlAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	nonEmpty := make([]uint64, 0)
+	var empty []uint64
+	for _, cluster := range f.Synthetic.ClusterIds() {
+		if f.Synthetic.NumDocsInCluster(cluster) > 0 {
+			nonEmpty = append(nonEmpty, uint64(cluster))
+		} else if empty == nil {
+			empty = []uint64{uint64(cluster)}
+		}
+	}
+	if len(nonEmpty) < 3 || empty == nil {
+		t.Fatalf("%d non-empty clusters, empty cluster %v", len(nonEmpty), empty)
+	}
+	unserved := uint64(spec.Clusters)
+	emb := syntheticDoc(f.Synthetic, uint(nonEmpty[0]), 0).Emb
+
+	searches := map[string][]uint64{
+		"one cluster":    nonEmpty[:1],
+		"three clusters": nonEmpty[:3],
+		"unserved":       {unserved},
+		"empty":          empty,
+		"mixed":          {unserved, empty[0], nonEmpty[0]},
+	}
+
+	var wantEmb, wantUrl int64
+	for name, clusters := range searches {
+		embBefore, urlBefore := embL.accepted.Load(), urlL.accepted.Load()
+		results, err := c.SearchClusters(clusters, emb, embAddr, urlAddr)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		gotEmb, gotUrl := embL.accepted.Load()-embBefore, urlL.accepted.Load()-urlBefore
+
+		if wantEmb == 0 {
+			wantEmb, wantUrl = gotEmb, gotUrl
+			// An ApplyHint round per URL query, as there are more of these
+			// than embeddings queries, which share the first rounds
+			if want := int64(2 * c.policy.UrlQueries); gotUrl != want {
+				t.Fatalf("%s: %d RPCs to the URL server, want %d", name, gotUrl, want)
+			}
+		}
+		if gotEmb != wantEmb || gotUrl != wantUrl {
+			t.Fatalf("%s: %d RPCs to the embeddings server and %d to the URL server, want %d and %d",
+				name, gotEmb, gotUrl, wantEmb, wantUrl)
+		}
+
+		if len(results) != len(clusters) {
+			t.Fatalf("%s: results for %d clusters, want %d", name, len(results), len(clusters))
+		}
+		chunks := 0
+		for i, cluster := range clusters {
+			chunks += len(results[i])
+			if len(results[i]) > 0 && (cluster == unserved || f.Synthetic.NumDocsInCluster(uint(cluster)) == 0) {
+				t.Fatalf("%s: results for cluster %d", name, cluster)
+			}
+		}
+		if name == "one cluster" && chunks == 0 {
+			t.Fatalf("%s: no results", name)
+		}
+		if chunks > c.policy.UrlQueries {
+			t.Fatalf("%s: %d chunks fetched, with %d URL queries", name, chunks, c.policy.UrlQueries)
+		}
+	}
+
+	// So does a dummy search, with the preprocessRound that follows it
+	embBefore, urlBefore := embL.accepted.Load(), urlL.accepted.Load()
+	if err := c.coverRound(context.Background(), embAddr, urlAddr, true); err != nil {
+		t.Fatal(err)
+	}
+	if gotEmb, gotUrl := embL.accepted.Load()-embBefore, urlL.accepted.Load()-urlBefore; gotEmb != wantEmb || gotUrl != wantUrl {
+		t.Fatalf("dummy search: %d RPCs to the embeddings server and %d to the URL server, want %d and %d",
+			gotEmb, gotUrl, wantEmb, wantUrl)
+	}
+	if c.SearchBytes() == 0 || c.embHintBytes == 0 || c.urlHintBytes == 0 {
+		t.Fatal("traffic of a search not measured")
+	}
+}
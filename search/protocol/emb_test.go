@@ -6,6 +6,7 @@ import (
 	"runtime/pprof"
 	"search/config"
 	"search/corpus"
+	"search/corpus/corpustest"
 	"search/embeddings"
 	"search/utils"
 	"testing"
@@ -58,7 +59,9 @@ func testRecoverCluster(s *Server, corp *corpus.Corpus) {
 
 	var h TiptoeHint
 	s.GetHint(true, &h)
-	c.Setup(&h)
+	if err := c.Setup(&h); err != nil {
+		panic(err)
+	}
 	logHintSize(&h)
 
 	p := h.EmbeddingsHint.Info.P()
@@ -71,17 +74,22 @@ func testRecoverCluster(s *Server, corp *corpus.Corpus) {
 		uAns := applyHint(tserv, ct)
 		logOfflineStats(c.NumDocs(), offlineStart, ct, uAns)
 		c.ProcessHintApply(uAns)
+		c.preprocessEmbParts(func(ct *underhood.HintQuery) (*UnderhoodAnswer, error) {
+			return applyHint(tserv, ct), nil
+		})
 
 		i := utils.RandomIndex(c.NumClusters())
 		emb := embeddings.RandomEmbedding(c.params.EmbeddingSlots, (1 << (c.params.SlotBits - 1)))
 		query := c.QueryEmbeddings(emb, i)
 
 		start := time.Now()
-		var ans pir.Answer[matrix.Elem64]
-		s.GetEmbeddingsAnswer(query, &ans)
-		logStats(c.NumDocs(), start, query, &ans)
+		var ans []pir.Answer[matrix.Elem64]
+		s.GetEmbeddingsAnswers(&query, &ans)
+		for j := range query {
+			logStats(c.NumDocs(), start, &query[j], &ans[j])
+		}
 
-		dec := c.ReconstructEmbeddingsWithinCluster(&ans, i)
+		dec := c.ReconstructEmbeddingsWithinCluster(ans, i)
 		checkAnswers(dec, uint(i), p, emb, corp)
 	}
 }
@@ -89,15 +97,29 @@ func testRecoverCluster(s *Server, corp *corpus.Corpus) {
 func TestEmbeddingsRealData(t *testing.T) {
 	s = Newserver()
 	conf = config.MakeConfig("/home/lianzheng/data")
+	if !utils.FileExists(conf.TxtCorpus(0)) {
+		t.Skipf("%s does not exist", conf.TxtCorpus(0))
+	}
 	f, _ := os.Create("emb_test.prof")
 	pprof.StartCPUProfile(f)
 	defer pprof.StopCPUProfile()
 
 	corp := corpus.ReadEmbeddingsTxt(0, 10, conf)
-	s.PreprocessEmbeddingsFromCorpus(corp, 25 /* hint size in MB */, conf)
+	conf.SetEmbeddingsPlanTargets(config.PlanTargets{MaxHintMB: 25})
+	s.PreprocessEmbeddingsFromCorpus(corp, conf)
 	// k.Setup(1, 0, []string{serverTcp}, false, conf)
 
 	fmt.Printf("Running embedding queries (over %d-doc real corpus)\n", corp.GetNumDocs())
 
 	testRecoverCluster(s, corp)
 }
+
+func TestEmbeddingsSynthetic(t *testing.T) {
+	f := corpustest.Small(t)
+	s := Newserver()
+	s.PreprocessEmbeddingsFromCorpus(f.Embeddings, f.Conf)
+
+	fmt.Printf("Running embedding queries (over %d-doc synthetic corpus)\n", f.Embeddings.GetNumDocs())
+
+	testRecoverCluster(s, f.Embeddings)
+}
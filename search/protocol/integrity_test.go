@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"search/corpus"
+	"search/corpus/corpustest"
+	"search/database"
+
+	"github.com/henrycg/simplepir/matrix"
+)
+
+const tamperedRows = 8
+
+// Shifts the decrypted value of each of the first rows of ans in turn by
+// delta, and counts how many of the changes check rejects. A change goes
+// unnoticed only if it is orthogonal to every weight vector.
+func countRejected[T matrix.Elem](ans *matrix.Matrix[T], delta uint64, check func() bool) int {
+	rejected := 0
+	for row := uint64(0); row < tamperedRows && row < ans.Rows(); row++ {
+		v := ans.Get(row, 0)
+		ans.Set(row, 0, v+T(delta))
+		if !check() {
+			rejected += 1
+		}
+		ans.Set(row, 0, v)
+	}
+	return rejected
+}
+
+func TestIntegrityChecks(t *testing.T) {
+	f := corpustest.Small(t)
+	embCorpus := corpus.ReadEmbeddings(0, f.Conf.NUM_CLUSTERS(), f.Conf)
+	urlCorpus := corpus.ReadUrls(0, f.Conf.NUM_CLUSTERS(), f.Conf)
+	database.WriteAnswerChecks(embCorpus, urlCorpus, f.Conf)
+	embCheck := database.ReadAnswerCheck(f.Conf.EmbeddingsCheckFile())
+	urlCheck := database.ReadAnswerCheck(f.Conf.UrlsCheckFile())
+
+	embServer, urlServer := newTestServers(t, f)
+
+	embAddr := serveLoopback(t, embServer)
+	urlAddr := serveLoopback(t, urlServer)
+
+	// The checks are made apart from the servers, which publish only the
+	// roots of their DBs
+	if !bytes.Equal(embServer.hint.EmbeddingsRoot, embCheck.Root) || !bytes.Equal(urlServer.hint.UrlsRoot, urlCheck.Root) {
+		t.Fatal("servers serve other DBs than the checks were made for")
+	}
+
+	// A client refuses servers whose DBs are not those of its checks
+	wrong := NewClient()
+	wrong.SetAnswerChecks(urlCheck, urlCheck)
+	if _, _, err := wrong.FetchHint(embAddr, urlAddr); !errors.Is(err, ErrUncheckedDB) {
+		t.Fatalf("client accepted a server serving another DB: %v", err)
+	}
+
+	c := NewClient()
+	c.SetAnswerChecks(embCheck, urlCheck)
+	_, sub, err := c.FetchHint(embAddr, urlAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, cluster := range f.Synthetic.ClusterIds() {
+		if f.Synthetic.NumDocsInCluster(cluster) == 0 {
+			continue
+		}
+		i := uint64(cluster)
+		emb := syntheticDoc(f.Synthetic, cluster, 0).Emb
+
+		if _, err := c.preprocessRound(ctx, embAddr, urlAddr, false, false, sub); err != nil {
+			t.Fatal(err)
+		}
+		embAns, err := c.getEmbeddingsAnswer(ctx, c.QueryEmbeddings(emb, i), false, embAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check := func() bool { return c.CheckEmbeddingsAnswers(embAns, emb, i) }
+		if !check() {
+			t.Fatalf("cluster %d: honest embeddings answer rejected", cluster)
+		}
+		// A shift by P/2 is orthogonal to about half the weight vectors
+		for _, delta := range []uint64{c.embInfo.Params.Delta, c.embInfo.Params.Delta * (c.embInfo.P() / 2)} {
+			if n := countRejected(embAns[0].Answer, delta, check); n < tamperedRows {
+				t.Fatalf("cluster %d: %d of %d embeddings answers shifted by %d rejected", cluster, n, tamperedRows, delta)
+			}
+		}
+
+		if _, err := c.preprocessRound(ctx, embAddr, urlAddr, false, false, sub); err != nil {
+			t.Fatal(err)
+		}
+		urlQuery, _ := c.QueryUrls(i, 0)
+		urlAns, err := c.getUrlsAnswer(ctx, urlQuery, false, urlAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check = func() bool { return c.CheckUrlsAnswer(urlAns, i, 0) }
+		if !check() {
+			t.Fatalf("cluster %d: honest URL answer rejected", cluster)
+		}
+		for _, delta := range []uint64{c.urlInfo.Params.Delta, c.urlInfo.Params.Delta * (c.urlInfo.P() / 2)} {
+			if n := countRejected(urlAns.Answer, delta, check); n < tamperedRows {
+				t.Fatalf("cluster %d: %d of %d URL answers shifted by %d rejected", cluster, n, tamperedRows, delta)
+			}
+		}
+
+		// Unchecked, a corrupt URL answer fails to decode, without
+		// bringing the client down
+		if _, err := c.ReconstructUrls(urlAns, i, 0); err != nil {
+			t.Fatalf("cluster %d: honest URL answer: %v", cluster, err)
+		}
+		for row := uint64(0); row < urlAns.Answer.Rows(); row++ {
+			urlAns.Answer.Set(row, 0, urlAns.Answer.Get(row, 0)+matrix.Elem32(c.urlInfo.Params.Delta))
+		}
+		if _, err := c.ReconstructUrls(urlAns, i, 0); err == nil {
+			t.Fatalf("cluster %d: corrupt URL answer decoded", cluster)
+		}
+	}
+
+	// A search with an answer that fails its check fails, rather than
+	// leaving the answer out
+	forged := database.ReadAnswerCheck(f.Conf.UrlsCheckFile())
+	forged.Seed += 1
+	c = NewClient()
+	c.SetAnswerChecks(embCheck, forged)
+	if _, _, err := c.FetchHint(embAddr, urlAddr); err != nil {
+		t.Fatal(err)
+	}
+	cluster := f.Synthetic.ClusterIds()[0]
+	emb := syntheticDoc(f.Synthetic, cluster, 0).Emb
+	if _, err := c.SearchClusters([]uint64{uint64(cluster)}, emb, embAddr, urlAddr); !errors.Is(err, ErrTamperedAnswer) {
+		t.Fatalf("search with a failed check: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"time"
+
+	"search/config"
+	"search/tokens"
+	"search/utils"
+)
+
+// Signs batches of blinded tokens for clients. It does not check who asks:
+// it should run behind whatever decides how many tokens each user may get.
+// It also keeps the set of spent tokens for all the servers, so that a
+// token pays for one call in all, whichever server or replica takes it.
+type Issuer struct {
+	issuer *tokens.Issuer
+	batch  int
+	spent  *tokens.SpentSet
+	tokens *tokens.Verifier
+	tcp    *utils.TCPServer
+}
+
+func NewIssuer(key *rsa.PrivateKey, batch int, spent *tokens.SpentSet) *Issuer {
+	i := &Issuer{issuer: tokens.NewIssuer(key), batch: batch, spent: spent}
+	i.tokens = tokens.NewVerifier(&key.PublicKey, spent)
+	i.tcp = utils.NewTCPServer(i.serveConn)
+	return i
+}
+
+func (i *Issuer) Issue(blinded *[][]byte, sigs *[][]byte) error {
+	if len(*blinded) > i.batch {
+		return fmt.Errorf("at most %d tokens per call", i.batch)
+	}
+
+	*sigs = make([][]byte, len(*blinded))
+	for j, b := range *blinded {
+		sig, err := i.issuer.Sign(b)
+		if err != nil {
+			return err
+		}
+		(*sigs)[j] = sig
+	}
+	return nil
+}
+
+// Records a token that a server took as spent; fails with ErrSpent if it
+// was spent already
+func (i *Issuer) Spend(t *tokens.Token, ok *bool) error {
+	if err := i.tokens.Redeem(t); err != nil {
+		return err
+	}
+	*ok = true
+	return nil
+}
+
+func (i *Issuer) serveConn(conn net.Conn) {
+	rs := rpc.NewServer()
+	rs.Register(i)
+	rs.ServeConn(conn)
+}
+
+func (i *Issuer) Serve(port int) {
+	i.tcp.Serve(utils.ListenTCP(port))
+}
+
+func (i *Issuer) ServeListener(l net.Listener) {
+	i.tcp.Serve(l)
+}
+
+func (i *Issuer) Shutdown(timeout time.Duration) bool {
+	ok := i.tcp.Shutdown(timeout)
+	i.spent.Close()
+	return ok
+}
+
+// Connections that a server keeps open to the issuer
+const ISSUER_LEDGER_CONNS = 8
+
+// Records the tokens that a server takes at the issuer
+type issuerLedger struct {
+	addr  string
+	conns *connPool
+}
+
+func newIssuerLedger(addr string, timeouts config.Timeouts) *issuerLedger {
+	conf := config.DefaultConnPool()
+	conf.MaxIdle = ISSUER_LEDGER_CONNS
+	return &issuerLedger{addr: addr, conns: newConnPool(conf, timeouts)}
+}
+
+func (l *issuerLedger) Spend(t *tokens.Token) error {
+	ctx := context.Background()
+	conn, _, err := l.conns.get(ctx, l.addr)
+	if err != nil {
+		return err
+	}
+	defer l.conns.put(l.addr, conn)
+
+	ok := false
+	err = conn.Call(ctx, "Issuer.Spend", t, &ok)
+	// Errors come back from the issuer as plain strings
+	if err != nil && strings.HasSuffix(err.Error(), tokens.ErrSpent.Error()) {
+		return tokens.ErrSpent
+	}
+	return err
+}
+
+// Tokens that a client holds, got from the issuer a batch at a time
+type tokenWallet struct {
+	pub      *rsa.PublicKey
+	issuer   string
+	batch    int
+	timeouts config.Timeouts
+	tokens   []*tokens.Token
+}
+
+// Takes a live token; the expired ones are dropped
+func (w *tokenWallet) take(ctx context.Context) (*tokens.Token, error) {
+	now := tokens.EpochOf(time.Now())
+	for len(w.tokens) > 0 && !w.tokens[len(w.tokens)-1].Live(now) {
+		w.tokens = w.tokens[:len(w.tokens)-1]
+	}
+	if len(w.tokens) == 0 {
+		if err := w.refill(ctx); err != nil {
+			return nil, err
+		}
+	}
+	t := w.tokens[len(w.tokens)-1]
+	w.tokens = w.tokens[:len(w.tokens)-1]
+	return t, nil
+}
+
+func (w *tokenWallet) refill(ctx context.Context) error {
+	epoch := tokens.EpochOf(time.Now())
+	blinded := make([]*tokens.Blinded, w.batch)
+	msgs := make([][]byte, w.batch)
+	for i := range blinded {
+		blinded[i] = tokens.Blind(w.pub, epoch)
+		msgs[i] = blinded[i].Msg
+	}
+
+	client, err := utils.DialTCP(ctx, w.issuer, utils.Seconds(w.timeouts.DialSec), utils.Seconds(w.timeouts.ReadSec), 0)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	sigs := make([][]byte, 0)
+	if err := client.Call(ctx, "Issuer.Issue", &msgs, &sigs); err != nil {
+		return err
+	}
+	if len(sigs) != len(blinded) {
+		return fmt.Errorf("issuer %s signed %d tokens of %d", w.issuer, len(sigs), len(blinded))
+	}
+
+	// Tokens are kept only if the whole batch is signed with the key that
+	// the servers trust
+	batch := make([]*tokens.Token, len(blinded))
+	for i, b := range blinded {
+		if batch[i], err = b.Unblind(sigs[i]); err != nil {
+			return fmt.Errorf("issuer %s signed with another key than the servers trust: %w", w.issuer, err)
+		}
+	}
+	w.tokens = append(w.tokens, batch...)
+	return nil
+}
+
+// Where to get tokens from, if the servers require them. The batch size
+// should match the issuer's.
+func (c *Client) SetTokenIssuer(addr string, batch int) {
+	c.tokenIssuer = addr
+	c.tokenBatch = batch
+}
+
+// Redeems a token on conn, so as to pay for the next answer or hint
+// application on it, if the servers require tokens
+func (c *Client) payFor(ctx context.Context, conn *utils.Conn) error {
+	if c.wallet == nil {
+		return nil
+	}
+	t, err := c.wallet.take(ctx)
+	if err != nil {
+		return err
+	}
+
+	ok := false
+	return conn.Call(ctx, "Server.RedeemToken", t, &ok)
+}
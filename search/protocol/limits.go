@@ -0,0 +1,305 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"search/config"
+	"search/tokens"
+	"search/utils"
+
+	"github.com/ahenzinger/underhood/underhood"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+var ErrNoToken = errors.New("no token redeemed for this call")
+
+// A token bucket: lets through rate calls per second on average, and up to
+// burst calls at once
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Nil, which lets every call through, if the rate is zero
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Waits for the turn of a call. Returns false, without waiting, if the turn
+// is more than maxWait away, or as soon as ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, maxWait time.Duration) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+l.rate*now.Sub(l.last).Seconds())
+	l.last = now
+
+	l.tokens -= 1
+	if l.tokens >= 0 {
+		l.mu.Unlock()
+		return true
+	}
+
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	if delay > maxWait {
+		l.tokens += 1
+		l.mu.Unlock()
+		return false
+	}
+	l.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens += 1
+		l.mu.Unlock()
+		return false
+	}
+}
+
+type serverLimits struct {
+	conf   config.ServerLimits
+	global *rateLimiter
+	slots  chan struct{} // one per answer computed at once; nil for no cap
+}
+
+func newServerLimits(conf config.ServerLimits) *serverLimits {
+	l := &serverLimits{conf: conf, global: newRateLimiter(conf.PerSec, conf.Burst)}
+	if conf.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, conf.MaxConcurrent)
+	}
+	return l
+}
+
+func (l *serverLimits) maxWait() time.Duration {
+	return utils.Seconds(l.conf.MaxWaitSec)
+}
+
+// Waits for a free slot to compute an answer in, for up to maxWait, or
+// until ctx is done
+func (l *serverLimits) acquire(ctx context.Context) bool {
+	if l.slots == nil {
+		return true
+	}
+
+	timer := time.NewTimer(l.maxWait())
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *serverLimits) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// Limits the calls served, and requires a token for each answer or hint
+// application if conf says so. Clients learn the token issuer key from the
+// hint. Tokens taken are recorded as spent at the issuer, which all servers
+// share.
+func (s *Server) SetupLimits(conf *config.Config) {
+	s.limits = newServerLimits(conf.SERVER_LIMITS())
+	if conf.TOKENS() {
+		pub := tokens.ReadPublicKey(conf.TokenPublicKeyFile())
+		if conf.TOKEN_ISSUER() == "" {
+			panic("Servers that take tokens need the address of the token issuer")
+		}
+		s.tokens = tokens.NewVerifier(pub, newIssuerLedger(conf.TOKEN_ISSUER(), conf.TIMEOUTS()))
+		s.hint.TokenKey = tokens.MarshalPublicKey(pub)
+	}
+}
+
+// Serves the RPCs of a connection, which has its own rate limit and its
+// own credit of redeemed tokens. Calls still waiting for their turn or
+// being answered are dropped once the client closes the connection, as it
+// does when it gives up on them.
+func (s *Server) serveConn(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := &connHandler{s: s, ctx: ctx}
+	if s.limits != nil {
+		h.rate = newRateLimiter(s.limits.conf.ConnPerSec, s.limits.conf.Burst)
+	}
+
+	rs := rpc.NewServer()
+	rs.RegisterName("Server", h)
+	rs.ServeConn(&watchedConn{Conn: conn, s: s, cancel: cancel})
+}
+
+// Cancels its context once reading fails, i.e. once the client is gone.
+// The RPC server reads the next call while answering the current one, so
+// this happens while the current one is computed. Calls in flight as the
+// server shuts down, which stops reading, are answered all the same.
+type watchedConn struct {
+	net.Conn
+	s      *Server
+	cancel context.CancelFunc
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil && !c.s.draining.Load() {
+		c.cancel()
+	}
+	return n, err
+}
+
+// Checks the limits of a server and of a connection before each RPC that
+// the connection makes
+type connHandler struct {
+	s    *Server
+	ctx  context.Context // done once the client is gone
+	rate *rateLimiter
+
+	mu      sync.Mutex
+	credits int // tokens redeemed but not yet spent
+}
+
+// Waits for the turn of a call, under the rate limits
+func (h *connHandler) admit() error {
+	l := h.s.limits
+	if l != nil && (!h.rate.wait(h.ctx, l.maxWait()) || !l.global.wait(h.ctx, l.maxWait())) {
+		if err := h.ctx.Err(); err != nil {
+			return err
+		}
+		return utils.ErrRateLimited
+	}
+	return h.ctx.Err()
+}
+
+// As admit, for a call computing an answer, which also spends a token if
+// the server requires them, and waits for a free slot. The call must
+// release the slot when done.
+func (h *connHandler) admitAnswer() error {
+	if err := h.admit(); err != nil {
+		return err
+	}
+
+	if h.s.tokens != nil {
+		h.mu.Lock()
+		if h.credits == 0 {
+			h.mu.Unlock()
+			return ErrNoToken
+		}
+		h.credits -= 1
+		h.mu.Unlock()
+	}
+
+	if h.s.limits != nil && !h.s.limits.acquire(h.ctx) {
+		h.refund()
+		if err := h.ctx.Err(); err != nil {
+			return err
+		}
+		return utils.ErrRateLimited
+	}
+	return nil
+}
+
+func (h *connHandler) refund() {
+	if h.s.tokens != nil {
+		h.mu.Lock()
+		h.credits += 1
+		h.mu.Unlock()
+	}
+}
+
+func (h *connHandler) done() {
+	if h.s.limits != nil {
+		h.s.limits.release()
+	}
+}
+
+// Pays for the next answer or hint application on this connection
+func (h *connHandler) RedeemToken(t *tokens.Token, ok *bool) error {
+	if err := h.admit(); err != nil {
+		return err
+	}
+	if h.s.tokens == nil {
+		*ok = true
+		return nil
+	}
+	if err := h.s.tokens.Redeem(t); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.credits += 1
+	h.mu.Unlock()
+	*ok = true
+	return nil
+}
+
+func (h *connHandler) GetHint(request bool, hint *TiptoeHint) error {
+	if err := h.admit(); err != nil {
+		return err
+	}
+	return h.s.GetHint(request, hint)
+}
+
+func (h *connHandler) GetVersion(request bool, version *string) error {
+	if err := h.admit(); err != nil {
+		return err
+	}
+	return h.s.GetVersion(request, version)
+}
+
+func (h *connHandler) GetEmbeddingsAnswer(query *pir.Query[matrix.Elem64], ans *pir.Answer[matrix.Elem64]) error {
+	if err := h.admitAnswer(); err != nil {
+		return err
+	}
+	defer h.done()
+	return h.s.GetEmbeddingsAnswer(query, ans)
+}
+
+func (h *connHandler) GetEmbeddingsAnswers(queries *[]pir.Query[matrix.Elem64], ans *[]pir.Answer[matrix.Elem64]) error {
+	if err := h.admitAnswer(); err != nil {
+		return err
+	}
+	defer h.done()
+	return h.s.embeddingsAnswers(h.ctx, queries, ans)
+}
+
+func (h *connHandler) GetUrlsAnswer(query *pir.Query[matrix.Elem32], ans *pir.Answer[matrix.Elem32]) error {
+	if err := h.admitAnswer(); err != nil {
+		return err
+	}
+	defer h.done()
+	return h.s.GetUrlsAnswer(query, ans)
+}
+
+func (h *connHandler) ApplyHint(ct *underhood.HintQuery, out *UnderhoodAnswer) error {
+	if err := h.admitAnswer(); err != nil {
+		return err
+	}
+	defer h.done()
+	return h.s.applyHint(h.ctx, ct, out)
+}
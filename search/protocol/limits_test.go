@@ -0,0 +1,242 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"testing"
+	"time"
+
+	"search/config"
+	"search/tokens"
+	"search/utils"
+
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := newRateLimiter(10, 2)
+	start := time.Now()
+	if !l.wait(ctx, 0) || !l.wait(ctx, 0) {
+		t.Fatal("burst refused")
+	}
+	if l.wait(ctx, 0) {
+		t.Fatal("call over the rate let through without waiting")
+	}
+	if !l.wait(ctx, time.Second) {
+		t.Fatal("call refused within its wait")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("call over the rate waited only %v", elapsed)
+	}
+
+	if newRateLimiter(0, 1) != nil || !newRateLimiter(0, 1).wait(ctx, 0) {
+		t.Fatal("zero rate should mean no limit")
+	}
+
+	// A call gives up its turn once its client is gone
+	l = newRateLimiter(1, 1)
+	gone, cancel := context.WithCancel(ctx)
+	cancel()
+	if !l.wait(ctx, 0) || l.wait(gone, time.Minute) {
+		t.Fatal("call of a client gone still waited its turn")
+	}
+}
+
+func TestTokenCredits(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, tokens.KEY_BITS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go NewIssuer(key, 4, tokens.NewSpentSet("")).ServeListener(l)
+	wallet := &tokenWallet{pub: &key.PublicKey, issuer: l.Addr().String(), batch: 4}
+
+	s := Newserver()
+	s.limits = newServerLimits(config.ServerLimits{Burst: 1, MaxConcurrent: 1, MaxWaitSec: 0.05})
+	s.tokens = tokens.NewVerifier(&key.PublicKey, newIssuerLedger(l.Addr().String(), config.DefaultTimeouts()))
+	h := &connHandler{s: s, ctx: context.Background()}
+	take := func() *tokens.Token {
+		tok, err := wallet.take(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+
+	if err := h.admitAnswer(); err != ErrNoToken {
+		t.Fatalf("unpaid call: %v", err)
+	}
+
+	ok := false
+	tok := take()
+	if err := h.RedeemToken(tok, &ok); err != nil || !ok {
+		t.Fatalf("redeeming a token: %v", err)
+	}
+	if err := h.RedeemToken(tok, &ok); err != tokens.ErrSpent {
+		t.Fatalf("token redeemed twice: %v", err)
+	}
+
+	// Nor does another server, or replica, take it
+	other := Newserver()
+	other.tokens = tokens.NewVerifier(&key.PublicKey, newIssuerLedger(l.Addr().String(), config.DefaultTimeouts()))
+	if err := (&connHandler{s: other, ctx: context.Background()}).RedeemToken(tok, &ok); err != tokens.ErrSpent {
+		t.Fatalf("token redeemed at two servers: %v", err)
+	}
+	if err := h.RedeemToken(take(), &ok); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two paid calls, but a single answer computed at once
+	if err := h.admitAnswer(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.admitAnswer(); err != utils.ErrRateLimited {
+		t.Fatalf("call over the concurrency cap: %v", err)
+	}
+	h.done()
+	if err := h.admitAnswer(); err != nil {
+		t.Fatalf("refused call should keep its token: %v", err)
+	}
+	h.done()
+	if err := h.admitAnswer(); err != ErrNoToken {
+		t.Fatalf("tokens spent, yet: %v", err)
+	}
+
+	// Batches are taken from the issuer as needed
+	for i := 0; i < 8; i++ {
+		if err := h.RedeemToken(take(), &ok); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Tokens signed with another key than the servers trust are refused,
+	// without bringing the client down
+	otherKey, err := rsa.GenerateKey(rand.Reader, tokens.KEY_BITS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet = &tokenWallet{pub: &otherKey.PublicKey, issuer: l.Addr().String(), batch: 4}
+	if _, err := wallet.take(context.Background()); err == nil || len(wallet.tokens) != 0 {
+		t.Fatalf("took a token signed with another key: %v", err)
+	}
+}
+
+// Calls to a server that hangs fail within their deadlines, and a server
+// drops the calls that a client gave up on
+func TestDeadlines(t *testing.T) {
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hung.Close() })
+	go utils.ServeTCP(hung, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+
+	c := NewClient()
+	c.SetTimeouts(config.Timeouts{ReadSec: 0.1})
+	if _, err := c.getHint(context.Background(), false, hung.Addr().String()); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("call to a hung server: %v", err)
+	}
+
+	c.SetTimeouts(config.Timeouts{})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.getHint(ctx, false, hung.Addr().String()); err != context.DeadlineExceeded {
+		t.Fatalf("call past the search deadline: %v", err)
+	}
+
+	// The only slot to answer in is taken, so the call waits for its turn
+	s := Newserver()
+	s.limits = newServerLimits(config.ServerLimits{Burst: 1, MaxConcurrent: 1, MaxWaitSec: 60})
+	s.limits.slots <- struct{}{}
+	client, server := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		s.serveConn(server)
+		close(served)
+	}()
+
+	conn := rpc.NewClient(client)
+	call := conn.Go("Server.GetUrlsAnswer", &pir.Query[matrix.Elem32]{}, &pir.Answer[matrix.Elem32]{}, nil)
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	<-call.Done
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still waits to answer a call that was given up on")
+	}
+}
+
+// A server shutting down answers the calls in flight, for as long as it
+// waits, and takes no new ones
+func TestShutdown(t *testing.T) {
+	serve := func(limits config.ServerLimits) (*Server, string) {
+		s := Newserver()
+		s.hint = &TiptoeHint{}
+		s.limits = newServerLimits(limits)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.ServeListener(l)
+		return s, l.Addr().String()
+	}
+	ctx := context.Background()
+	request := true
+	version := ""
+
+	// The second call waits for its turn under the rate limit
+	s, addr := serve(config.ServerLimits{PerSec: 5, Burst: 1, MaxWaitSec: 10})
+	conn, err := utils.DialTCP(ctx, addr, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.Call(ctx, "Server.GetVersion", &request, &version); err != nil {
+		t.Fatal(err)
+	}
+	inFlight := make(chan error, 1)
+	go func() {
+		inFlight <- conn.Call(ctx, "Server.GetVersion", &request, &version)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if !s.Shutdown(5 * time.Second) {
+		t.Fatal("call in flight not answered in time")
+	}
+	if err := <-inFlight; err != nil {
+		t.Fatalf("call in flight: %v", err)
+	}
+	if _, err := utils.DialTCP(ctx, addr, time.Second, 0, 0); err == nil {
+		t.Fatal("server shut down still takes connections")
+	}
+
+	// The call waits for a slot that is never freed
+	s, addr = serve(config.ServerLimits{Burst: 1, MaxConcurrent: 1, MaxWaitSec: 60})
+	s.limits.slots <- struct{}{}
+	conn, err = utils.DialTCP(ctx, addr, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Call(ctx, "Server.GetUrlsAnswer", &pir.Query[matrix.Elem32]{}, &pir.Answer[matrix.Elem32]{})
+	time.Sleep(50 * time.Millisecond)
+	if s.Shutdown(100 * time.Millisecond) {
+		t.Fatal("server waited for a call that never ends")
+	}
+}
@@ -53,10 +53,12 @@ func logHintSize(hint *TiptoeHint) float64 {
 		gob.Register(database.SubclusterMap{})
 		h := utils.MessageSizeMB(hint.UrlsHint)
 		m := utils.MessageSizeMB(hint.UrlsIndexMap)
-		total += (h + m)
+		d := utils.BytesToMB(uint64(len(hint.UrlsDict)))
+		total += (h + m + d)
 
 		fmt.Printf("\t\tUrls hint: %.2f MB\n", h)
 		fmt.Printf("\t\tUrls map: %.2f MB\n", m)
+		fmt.Printf("\t\tUrls dict: %.2f MB\n", d)
 	}
 
 	fmt.Printf("\tTotal metadata: %.2f MB\n", total)
@@ -121,15 +123,15 @@ func checkAnswers(got []uint64, cluster uint, p uint64, emb []int8, corp *corpus
 	}
 }
 
-func checkSubclusterSize(recoveredUrl string,
+func checkSubclusterSize(recoveredDocs []corpus.Doc,
 	clusterIndex uint64,
 	chunkIndex int,
 	corp *corpus.Corpus) {
-	occ := corpus.CountUrls(recoveredUrl)
+	occ := len(recoveredDocs)
 	shouldBe := corp.SizeOfSubclusterByIndex(uint(clusterIndex), chunkIndex)
 
 	if occ != shouldBe {
-		fmt.Println(recoveredUrl)
+		fmt.Println(recoveredDocs)
 		fmt.Printf("Num URLS is %d -- expected %d\n", occ, shouldBe)
 		fmt.Printf("Query to cluster %d, chunk %d\n", clusterIndex, chunkIndex)
 		panic("Should not happen")
@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"search/config"
+	"search/utils"
+)
+
+// Connections to the servers that a client keeps open between calls, by
+// server address, so that a call never goes out on a connection to another
+// server. Each connection carries one call at a time.
+type connPool struct {
+	conf     config.ConnPool
+	timeouts config.Timeouts
+
+	mu   sync.Mutex
+	idle map[string][]idleEntry
+}
+
+type idleEntry struct {
+	conn  *utils.Conn
+	since time.Time
+}
+
+func newConnPool(conf config.ConnPool, timeouts config.Timeouts) *connPool {
+	return &connPool{conf: conf, timeouts: timeouts, idle: make(map[string][]idleEntry)}
+}
+
+// A connection to addr: the most recently used idle one that is still
+// healthy, else a new one. Also returns whether it was idle.
+func (p *connPool) get(ctx context.Context, addr string) (*utils.Conn, bool, error) {
+	p.mu.Lock()
+	for len(p.idle[addr]) > 0 {
+		n := len(p.idle[addr])
+		e := p.idle[addr][n-1]
+		p.idle[addr] = p.idle[addr][:n-1]
+		if p.healthy(e) {
+			p.mu.Unlock()
+			return e.conn, true, nil
+		}
+		e.conn.Close()
+	}
+	p.mu.Unlock()
+
+	conn, err := utils.DialTCP(ctx, addr, utils.Seconds(p.timeouts.DialSec),
+		utils.Seconds(p.timeouts.ReadSec), utils.Seconds(p.conf.KeepAliveSec))
+	return conn, false, err
+}
+
+func (p *connPool) healthy(e idleEntry) bool {
+	if e.conn.Broken() {
+		return false
+	}
+	return p.conf.IdleSec == 0 || time.Since(e.since) < utils.Seconds(p.conf.IdleSec)
+}
+
+// Keeps a connection after its call, if it is healthy and there is room
+// among the idle connections to its server; closes it otherwise
+func (p *connPool) put(addr string, conn *utils.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn.Broken() || len(p.idle[addr]) >= p.conf.MaxIdle {
+		conn.Close()
+		return
+	}
+	p.idle[addr] = append(p.idle[addr], idleEntry{conn, time.Now()})
+}
+
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, entries := range p.idle {
+		for _, e := range entries {
+			e.conn.Close()
+		}
+		delete(p.idle, addr)
+	}
+}
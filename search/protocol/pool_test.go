@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"search/config"
+	"search/corpus"
+	"search/corpus/corpustest"
+
+	"github.com/henrycg/simplepir/rand"
+)
+
+// Serves s on a loopback port, handing each connection it accepts to conns
+func serveTracked(t *testing.T, s *Server, conns chan net.Conn) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go s.serveConn(conn)
+		}
+	}()
+	return l
+}
+
+// Kept connections go back to the server they were dialed to, and broken
+// ones are dialed again
+func TestConnPool(t *testing.T) {
+	servers := make([]string, 2)
+	conns := make([]chan net.Conn, 2)
+	for i := range servers {
+		s := Newserver()
+		s.hint = &TiptoeHint{CParams: corpus.Params{NumDocs: uint64(i + 1)}}
+		conns[i] = make(chan net.Conn, 8)
+		servers[i] = serveTracked(t, s, conns[i]).Addr().String()
+	}
+
+	ctx := context.Background()
+	c := NewClient()
+	c.SetConnPool(config.ConnPool{MaxIdle: 1})
+	defer c.Close()
+	getHint := func(i int) {
+		hint, err := c.getHint(ctx, true, servers[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hint.CParams.NumDocs != uint64(i+1) {
+			t.Fatalf("call to server %d answered by server %d", i, hint.CParams.NumDocs-1)
+		}
+	}
+
+	for _, i := range []int{0, 1, 0, 1} {
+		getHint(i)
+	}
+	if len(conns[0]) != 1 || len(conns[1]) != 1 {
+		t.Fatalf("%d and %d connections dialed, want one per server", len(conns[0]), len(conns[1]))
+	}
+
+	// The server drops the idle connection
+	(<-conns[0]).Close()
+	getHint(0)
+	if len(conns[0]) != 1 {
+		t.Fatal("broken connection not dialed again")
+	}
+
+	// Without room in the pool, each call has its own connection
+	c.SetConnPool(config.ConnPool{})
+	getHint(1)
+	getHint(1)
+	if len(conns[1]) != 3 {
+		t.Fatalf("%d connections dialed to server 1, want 3", len(conns[1]))
+	}
+}
+
+// Calls are spread across the replicas of a shard, pass over one serving
+// another snapshot, and fail over when one goes down
+func TestReplicas(t *testing.T) {
+	seed := rand.RandomPRGKey()
+	servers := make([]string, 3)
+	conns := make([]chan net.Conn, 3)
+	listeners := make([]net.Listener, 3)
+	for i := range servers {
+		s := Newserver()
+		s.hint = &TiptoeHint{CParams: corpus.Params{NumDocs: uint64(i)}, ServeUrls: true}
+		s.hint.UrlsHint.Seeds = []rand.PRGKey{*seed}
+		if i == 2 {
+			s.hint.UrlsHint.Seeds = []rand.PRGKey{*rand.RandomPRGKey()}
+		}
+		conns[i] = make(chan net.Conn, 16)
+		listeners[i] = serveTracked(t, s, conns[i])
+		servers[i] = listeners[i].Addr().String()
+	}
+	addrs := strings.Join(servers, ",")
+
+	ctx := context.Background()
+	c := NewClient()
+	getHint := func() uint64 {
+		hint, err := c.getHint(ctx, false, addrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hint.CParams.NumDocs
+	}
+
+	// The hint comes from the first replica, the two others are checked
+	hint, err := c.getHint(ctx, false, addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.setSnapshot(ctx, addrs, hint)
+
+	answered := make(map[uint64]int)
+	for i := 0; i < 4; i++ {
+		answered[getHint()] += 1
+	}
+	if answered[0] != 2 || answered[1] != 2 {
+		t.Fatalf("calls answered by each replica: %v, want 2 by each of the first two", answered)
+	}
+	if len(conns[2]) != 1 {
+		t.Fatalf("replica of another snapshot called %d times, want only to check it", len(conns[2]))
+	}
+
+	// Replica 1 goes down: replica 0 takes all calls
+	listeners[1].Close()
+	for i := 0; i < 3; i++ {
+		if got := getHint(); got != 0 {
+			t.Fatalf("call answered by replica %d", got)
+		}
+	}
+
+	// Both replicas left serve another snapshot than the client's: calls
+	// fail until the hint is fetched again
+	addrs = servers[0] + "," + servers[2]
+	c = NewClient()
+	set := c.replicaSet(addrs)
+	set.version = "old"
+	if _, err := c.getHint(ctx, false, addrs); !errors.Is(err, ErrStaleSnapshot) {
+		t.Fatalf("call to stale replicas: %v, want %v", err, ErrStaleSnapshot)
+	}
+	set.reset()
+	if _, err := c.getHint(ctx, false, addrs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Replicas serve the same snapshot only if they hold the same DB under the
+// same hint, whatever seed they share
+func TestSnapshotVersion(t *testing.T) {
+	seed := rand.RandomPRGKey()
+	version := func(f *corpustest.Fixture, seed *rand.PRGKey) string {
+		s := Newserver()
+		s.preprocessUrlsSeeded(corpus.ReadUrls(0, f.Conf.NUM_CLUSTERS(), f.Conf), seed, f.Conf)
+		s.preprocessUrlHint()
+		hint := TiptoeHint{}
+		s.GetHint(false, &hint)
+		if hint.SnapshotVersion() != s.hint.SnapshotVersion() {
+			t.Fatal("clients see another snapshot than the server serves")
+		}
+		return hint.SnapshotVersion()
+	}
+
+	f := corpustest.Small(t)
+	v := version(f, seed)
+	if version(f, seed) != v {
+		t.Fatal("replicas of the same DB and seed serve different snapshots")
+	}
+	if version(f, rand.RandomPRGKey()) == v {
+		t.Fatal("replicas under different seeds serve the same snapshot")
+	}
+
+	// A URL changed in place leaves the DB shape as it was
+	file := f.Conf.TxtCorpus(0)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, bytes.Replace(data, []byte("example"), []byte("exbmple"), 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if version(f, seed) == v {
+		t.Fatal("replicas of different corpora serve the same snapshot")
+	}
+}
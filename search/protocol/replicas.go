@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sort"
+	"strings"
+	"time"
+
+	"search/utils"
+)
+
+var errStaleReplica = errors.New("replica serves another DB snapshot")
+
+// Every replica of a server serves another DB snapshot than the client has
+// the hint of, so the hint must be fetched again
+var ErrStaleSnapshot = errors.New("no replica serves the DB snapshot of the hint")
+
+// The servers of a shard, which serve the same DB snapshot. Calls go to
+// each in turn, pass over those that failed lately, and fail over to the
+// next on error.
+type replicaSet struct {
+	replicas []*replica
+	next     int
+	version  string // of the snapshot, once the client has the hint
+}
+
+type replica struct {
+	addr      string
+	stale     bool // whether it serves another snapshot, until the hint is fetched again
+	downUntil time.Time
+}
+
+// The replicas listed in addrs, comma-separated, as many a client method
+// takes in place of a single server address
+func (c *Client) replicaSet(addrs string) *replicaSet {
+	if c.replicas == nil {
+		c.replicas = make(map[string]*replicaSet)
+	}
+	if set, ok := c.replicas[addrs]; ok {
+		return set
+	}
+
+	set := new(replicaSet)
+	for _, addr := range strings.Split(addrs, ",") {
+		set.replicas = append(set.replicas, &replica{addr: strings.TrimSpace(addr)})
+	}
+	c.replicas[addrs] = set
+	return set
+}
+
+// The replicas to try a call on, in order: those up, starting from the
+// next in turn, then those down, which may have come back, by how soon
+// they were to be tried again
+func (s *replicaSet) order(now time.Time) []*replica {
+	up := make([]*replica, 0, len(s.replicas))
+	down := make([]*replica, 0)
+	for i := range s.replicas {
+		r := s.replicas[(s.next+i)%len(s.replicas)]
+		if r.stale {
+			continue
+		} else if now.Before(r.downUntil) {
+			down = append(down, r)
+		} else {
+			up = append(up, r)
+		}
+	}
+	s.next = (s.next + 1) % len(s.replicas)
+
+	sort.SliceStable(down, func(i, j int) bool {
+		return down[i].downUntil.Before(down[j].downUntil)
+	})
+	return append(up, down...)
+}
+
+// Whether a call that failed with err may succeed on another replica:
+// unless the server answered it with an error of its own, other than that
+// it is too busy
+func failover(err error) bool {
+	var serverErr rpc.ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.Error() == utils.ErrRateLimited.Error()
+	}
+	return true
+}
+
+// Checks that the replica on the other end of conn serves the snapshot of
+// the set. Made on each new connection, as the replica may have restarted
+// with another snapshot since the last one.
+func (c *Client) checkVersion(ctx context.Context, conn *utils.Conn, set *replicaSet, r *replica) error {
+	if set.version == "" {
+		return nil
+	}
+
+	request := true
+	version := ""
+	if err := conn.Call(ctx, "Server.GetVersion", &request, &version); err != nil {
+		return err
+	}
+	if version != set.version {
+		r.stale = true
+		fmt.Printf("Replica %s serves DB snapshot %s, not %s -- not used\n", r.addr, version, set.version)
+		return errStaleReplica
+	}
+	return nil
+}
+
+// Forgets the snapshot of the set, and which replicas served another one,
+// before the hint is fetched again
+func (s *replicaSet) reset() {
+	s.version = ""
+	for _, r := range s.replicas {
+		r.stale = false
+	}
+}
+
+// Sets the snapshot that the replicas listed in addrs must serve, as the
+// hint fetched from them shows, and checks those there are more of
+func (c *Client) setSnapshot(ctx context.Context, addrs string, hint *TiptoeHint) {
+	set := c.replicaSet(addrs)
+	set.version = hint.SnapshotVersion()
+	if len(set.replicas) == 1 {
+		return
+	}
+
+	for _, r := range set.replicas {
+		conn, _, err := c.pool.get(ctx, r.addr)
+		if err == nil {
+			err = c.checkVersion(ctx, conn, set, r)
+			conn.Close()
+		}
+		if err != nil && err != errStaleReplica {
+			r.downUntil = time.Now().Add(utils.Seconds(c.pool.conf.DownSec))
+			fmt.Printf("Replica %s is down: %v\n", r.addr, err)
+		}
+	}
+}
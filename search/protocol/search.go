@@ -0,0 +1,247 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"search/config"
+	"search/corpus"
+	"search/embeddings"
+	"search/framework"
+	"search/utils"
+
+	"github.com/ahenzinger/underhood/underhood"
+	"github.com/henrycg/simplepir/matrix"
+	"github.com/henrycg/simplepir/pir"
+)
+
+// The inner products of a query with the docs of a probed cluster
+type probedCluster struct {
+	at             int // position in the clusters searched
+	cluster        uint64
+	scores         []int
+	indicesByScore []uint64
+}
+
+// An answer failed the integrity check: the server answered for other data
+// than the answer checks were made for, or the answer was corrupted
+var ErrTamperedAnswer = errors.New("answer failed the integrity check")
+
+// A server serves another DB than the answer checks were made for
+var ErrUncheckedDB = errors.New("server does not serve the DB that the answer checks were made for")
+
+// A URL chunk to fetch, through the best doc it holds
+type chunkFetch struct {
+	probe    int
+	docIndex uint64
+	chunk    uint64
+}
+
+// The policy should come from a config, which checks it
+func (c *Client) SetRequestPolicy(p config.RequestPolicy) {
+	c.policy = p
+}
+
+// Searches the clusters, nearest first, with requests of the shape set by
+// the request policy: exactly EmbQueries embeddings queries, then exactly
+// UrlQueries URL queries. A secret must not be used twice on a DB, so the
+// k-th query to each server uses the secrets of the k-th ApplyHint round
+// to both servers, run right before the k-th query of either kind: as in
+// the original protocol, an embeddings query and a URL query share a
+// secret. Unserved clusters are skipped, and unused queries go to dummy
+// ones, so that the servers see the same requests in the same order
+// whatever the query. If preprocessed, the first round is the last
+// preprocessRound.
+//
+// The URL queries fetch the chunk of the best doc of each probed cluster,
+// then the next best chunk of each, and so on, skipping chunks whose docs
+// all have a zero score. Returns the results by cluster searched, then by
+// chunk, along with the time spent on each of the two rounds. Stops at the
+// first call that fails, e.g. as ctx is done. An answer that fails the
+// integrity check (with ErrTamperedAnswer) or does not decode fails the
+// search too, but only once all its queries are sent.
+func (c *Client) search(ctx context.Context, clusters []uint64, emb []int8, EmbAddr, UrlAddr string, keepConn, preprocessed bool) ([][][]framework.Answer, float64, float64, error) {
+	fresh := preprocessed
+	nextSecret := func() error {
+		var err error
+		if !fresh {
+			_, err = c.preprocessRound(ctx, EmbAddr, UrlAddr, false, keepConn, c.sub)
+		}
+		fresh = false
+		return err
+	}
+
+	// The first answer that failed the integrity check or did not decode.
+	// The queries left are still sent, as they would be otherwise.
+	var failed error
+
+	// The URL secrets of the rounds run for embeddings queries, kept until
+	// the URL query of the same round
+	urlSecrets := make([]underhood.Client[matrix.Elem32], 0, c.policy.EmbQueries)
+
+	start := time.Now()
+	probes := make([]probedCluster, 0, c.policy.EmbQueries)
+	at := 0
+	for k := 0; k < c.policy.EmbQueries; k++ {
+		for at < len(clusters) && !c.HasCluster(clusters[at]) {
+			at += 1
+		}
+
+		if err := nextSecret(); err != nil {
+			return nil, 0, 0, err
+		}
+		urlSecrets = append(urlSecrets, *c.urlClient)
+		if at == len(clusters) {
+			if _, err := c.getEmbeddingsAnswer(ctx, c.dummyEmbeddingsQuery(), keepConn, EmbAddr); err != nil {
+				return nil, 0, 0, err
+			}
+			continue
+		}
+
+		cluster := clusters[at]
+		at += 1
+		embAns, err := c.getEmbeddingsAnswer(ctx, c.QueryEmbeddings(emb, cluster), keepConn, EmbAddr)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if !c.CheckEmbeddingsAnswers(embAns, emb, cluster) {
+			if failed == nil {
+				failed = fmt.Errorf("embeddings answer for cluster %d: %w", cluster, ErrTamperedAnswer)
+			}
+			continue
+		}
+		embDec := c.ReconstructEmbeddingsWithinCluster(embAns, cluster)
+		if len(embDec) == 0 {
+			continue
+		}
+		scores := embeddings.SmoothResults(embDec, c.embInfo.P())
+		probes = append(probes, probedCluster{at - 1, cluster, scores, utils.SortByScores(scores)})
+	}
+	embTime := time.Since(start).Seconds()
+
+	start = time.Now()
+	out := make([][][]framework.Answer, len(clusters))
+	fetches := c.planChunkFetches(probes, c.policy.UrlQueries)
+	for k := 0; k < c.policy.UrlQueries; k++ {
+		if k < len(urlSecrets) {
+			c.urlClient = &urlSecrets[k]
+		} else if err := nextSecret(); err != nil {
+			return nil, 0, 0, err
+		}
+		if k >= len(fetches) {
+			if _, err := c.getUrlsAnswer(ctx, c.dummyUrlsQuery(), keepConn, UrlAddr); err != nil {
+				return nil, 0, 0, err
+			}
+			continue
+		}
+
+		f := fetches[k]
+		p := probes[f.probe]
+		urlQuery, _ := c.QueryUrls(p.cluster, f.docIndex)
+		urlAns, err := c.getUrlsAnswer(ctx, urlQuery, keepConn, UrlAddr)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if !c.CheckUrlsAnswer(urlAns, p.cluster, f.docIndex) {
+			if failed == nil {
+				failed = fmt.Errorf("URL answer for chunk %d: %w", f.chunk, ErrTamperedAnswer)
+			}
+			continue
+		}
+		urls, err := c.ReconstructUrls(urlAns, p.cluster, f.docIndex)
+		if err != nil {
+			if failed == nil {
+				failed = fmt.Errorf("URL answer for chunk %d: %w", f.chunk, err)
+			}
+			continue
+		}
+		out[p.at] = append(out[p.at], RankRetrievedChunk(p.scores, p.indicesByScore, c.urlMap, p.cluster, f.chunk, urls, false))
+	}
+	urlTime := time.Since(start).Seconds()
+
+	if failed != nil {
+		return nil, 0, 0, failed
+	}
+	return out, embTime, urlTime, nil
+}
+
+// Picks up to n chunks to fetch, taking turns between the probed clusters
+func (c *Client) planChunkFetches(probes []probedCluster, n int) []chunkFetch {
+	byProbe := make([][]chunkFetch, len(probes))
+	for i, p := range probes {
+		fetched := make(map[uint64]bool)
+		for at := 0; at < len(p.indicesByScore); at++ {
+			// The chunk of the best doc is always fetched
+			if at > 0 && p.scores[at] == 0 {
+				break
+			}
+
+			docIndex := p.indicesByScore[at]
+			_, chunk, _ := c.urlMap.SubclusterToIndex(p.cluster, docIndex)
+			if !fetched[chunk] {
+				fetched[chunk] = true
+				byProbe[i] = append(byProbe[i], chunkFetch{i, docIndex, chunk})
+			}
+		}
+	}
+
+	out := make([]chunkFetch, 0, n)
+	for turn := 0; len(out) < n; turn++ {
+		added := false
+		for _, fetches := range byProbe {
+			if turn < len(fetches) && len(out) < n {
+				out = append(out, fetches[turn])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	return out
+}
+
+// Encrypts a query for nothing, which the server cannot tell apart from
+// QueryEmbeddings
+func (c *Client) dummyEmbeddingsQuery() []pir.Query[matrix.Elem64] {
+	queries := make([]pir.Query[matrix.Elem64], len(c.embClients))
+	for i := range queries {
+		queries[i] = *c.embClients[i].QueryLHE(matrix.Zeros[matrix.Elem64](c.embInfo.M, 1))
+	}
+	return queries
+}
+
+func (c *Client) dummyUrlsQuery() *pir.Query[matrix.Elem32] {
+	return c.urlClient.Query(utils.RandomIndex(c.urlInfo.L * c.urlInfo.M))
+}
+
+// Merges the results of all the chunks fetched for a query, by decreasing
+// score, without repeating a page
+func MergeResults(results [][][]framework.Answer) []framework.Answer {
+	merged := make([]framework.Answer, 0)
+	for _, chunks := range results {
+		for _, answers := range chunks {
+			merged = append(merged, answers...)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Score > merged[j].Score
+	})
+
+	var out []framework.Answer
+	seen := make(map[string]bool)
+	for _, a := range merged {
+		if len(out) >= NUM_RESULTS {
+			break
+		}
+		key := corpus.NormalizeUrl(a.Url)
+		if !seen[key] {
+			seen[key] = true
+			out = append(out, a)
+		}
+	}
+	return out
+}
@@ -1,12 +1,20 @@
 package protocol
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
-	"net/rpc"
+	"io"
+	"net"
 	"search/config"
 	"search/corpus"
 	"search/database"
+	"search/tokens"
 	"search/utils"
+	"sort"
+	"sync/atomic"
+	"time"
 
 	"github.com/ahenzinger/underhood/underhood"
 	"github.com/henrycg/simplepir/matrix"
@@ -27,6 +35,80 @@ type TiptoeHint struct {
 	ServeUrls    bool
 	UrlsHint     utils.PIR_hint[matrix.Elem32]
 	UrlsIndexMap database.SubclusterMap
+	UrlsDict     []byte // shared dictionary for decompressing urls
+
+	// Merkle roots of the DBs, which clients checking answers pin
+	EmbeddingsRoot []byte
+	UrlsRoot       []byte
+
+	// Set if the server answers only calls paid for with tokens signed
+	// by this key
+	TokenKey []byte
+
+	// Digest of the DBs and the hint, taken by the server before it drops
+	// the hint matrices, which clients do not get
+	Version string
+}
+
+// Identifies the DB snapshot that a server serves: replicas serve the same
+// one only if they hold the same DBs, by their Merkle roots, under the same
+// hint and index maps
+func (h *TiptoeHint) SnapshotVersion() string {
+	if h.Version != "" {
+		return h.Version
+	}
+	return h.digest()
+}
+
+func (h *TiptoeHint) digest() string {
+	d := sha256.New()
+	if h.ServeEmbeddings {
+		fmt.Fprintf(d, "embeddings %x %v %s\n", h.EmbeddingsRoot, h.EmbeddingsHint.Seeds, dbInfoString(h.EmbeddingsHint.Info))
+		hashMatrix(d, &h.EmbeddingsHint.Hint)
+		hashIndexMap(d, h.EmbeddingsIndexMap)
+	}
+	if h.ServeUrls {
+		fmt.Fprintf(d, "urls %x %v %s\n", h.UrlsRoot, h.UrlsHint.Seeds, dbInfoString(h.UrlsHint.Info))
+		hashMatrix(d, &h.UrlsHint.Hint)
+		hashIndexMap(d, h.UrlsIndexMap)
+		fmt.Fprintf(d, "dict %x\n", h.UrlsDict)
+	}
+	return hex.EncodeToString(d.Sum(nil)[:8])
+}
+
+func hashMatrix[T matrix.Elem](w io.Writer, m *matrix.Matrix[T]) {
+	fmt.Fprintf(w, "matrix %d %d\n", m.Rows(), m.Cols())
+	buf := make([]byte, 0, 1<<16)
+	for _, v := range m.Data() {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(v))
+		if len(buf) == cap(buf) {
+			w.Write(buf)
+			buf = buf[:0]
+		}
+	}
+	w.Write(buf)
+}
+
+// Writes the map in the order of its keys
+func hashIndexMap[V any](w io.Writer, m map[uint][]V) {
+	keys := make([]uint, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, k := range keys {
+		fmt.Fprintf(w, "%d %v\n", k, m[k])
+	}
+}
+
+// The DB shape and parameters, by value
+func dbInfoString(info pir.DBInfo) string {
+	params := info.Params
+	info.Params = nil
+	if params == nil {
+		return fmt.Sprintf("%+v", info)
+	}
+	return fmt.Sprintf("%+v %+v", info, *params)
 }
 
 type Server struct {
@@ -36,22 +118,29 @@ type Server struct {
 
 	embHintServer *underhood.Server[matrix.Elem64]
 	urlHintServer *underhood.Server[matrix.Elem32]
+
+	limits *serverLimits    // nil for no limits
+	tokens *tokens.Verifier // nil if calls are free
+
+	tcp      *utils.TCPServer
+	draining atomic.Bool
 }
 
 func Newserver() *Server {
 	s := new(Server)
+	s.tcp = utils.NewTCPServer(s.serveConn)
 	return s
 }
 
-func (s *Server) PreprocessEmbeddingsFromCorpus(c *corpus.Corpus, hintSz uint64, conf *config.Config) {
+func (s *Server) PreprocessEmbeddingsFromCorpus(c *corpus.Corpus, conf *config.Config) {
 	embeddings_seed := rand.RandomPRGKey()
-	s.preprocessEmbeddingsSeeded(c, embeddings_seed, hintSz, conf)
+	s.preprocessEmbeddingsSeeded(c, embeddings_seed, conf)
 }
 
-func (s *Server) preprocessEmbeddingsSeeded(c *corpus.Corpus, seed *rand.PRGKey, hintSz uint64, conf *config.Config) {
+func (s *Server) preprocessEmbeddingsSeeded(c *corpus.Corpus, seed *rand.PRGKey, conf *config.Config) {
 	// fmt.Printf("Preprocessing a corpus of %d embeddings of length %d\n", c.GetNumDocs(), c.GetEmbeddingSlots())
 	fmt.Printf("Preprocessing a corpus of %d embeddings of length %d\n", c.GetEmbeddingSlots(), c.GetNumDocs())
-	db, indexMap := database.BuildEmbeddingsDatabase(c, seed, hintSz, conf)
+	db, indexMap := database.BuildEmbeddingsDatabase(c, seed, conf)
 	s.embeddingsServer = pir.NewServerSeed(db, seed)
 
 	s.hint = new(TiptoeHint)
@@ -62,6 +151,8 @@ func (s *Server) preprocessEmbeddingsSeeded(c *corpus.Corpus, seed *rand.PRGKey,
 	s.hint.EmbeddingsHint.Seeds = []rand.PRGKey{*seed}
 	s.hint.EmbeddingsHint.Offsets = []uint64{s.hint.EmbeddingsHint.Info.M}
 	s.hint.EmbeddingsIndexMap = indexMap
+	s.hint.EmbeddingsRoot = database.DBRoot(db)
+	fmt.Printf("Embeddings DB commitment: %x\n", s.hint.EmbeddingsRoot)
 
 	max_inner_prod := 2 * (1 << (2*c.GetSlotBits() - 2)) * c.GetEmbeddingSlots()
 	if s.embeddingsServer.Params().P < max_inner_prod {
@@ -73,15 +164,15 @@ func (s *Server) preprocessEmbeddingsSeeded(c *corpus.Corpus, seed *rand.PRGKey,
 	fmt.Println("done")
 }
 
-func (s *Server) PreprocessUrlsFromCorpus(c *corpus.Corpus, hintSz uint64) {
+func (s *Server) PreprocessUrlsFromCorpus(c *corpus.Corpus, conf *config.Config) {
 	urls_seed := rand.RandomPRGKey()
-	s.preprocessUrlsSeeded(c, urls_seed, hintSz)
+	s.preprocessUrlsSeeded(c, urls_seed, conf)
 }
 
-func (s *Server) preprocessUrlsSeeded(c *corpus.Corpus, seed *rand.PRGKey, hintSz uint64) {
+func (s *Server) preprocessUrlsSeeded(c *corpus.Corpus, seed *rand.PRGKey, conf *config.Config) {
 	fmt.Printf("Preprocessing a corpus of %d urls in chunks of length <= %d\n", c.GetNumDocs(), c.GetUrlBytes())
 
-	db, indexMap := database.BuildUrlsDatabase(c, seed, hintSz)
+	db, indexMap := database.BuildUrlsDatabase(c, seed, conf)
 	s.urlsServer = pir.NewServerSeed(db, seed)
 
 	s.hint = new(TiptoeHint)
@@ -92,6 +183,9 @@ func (s *Server) preprocessUrlsSeeded(c *corpus.Corpus, seed *rand.PRGKey, hintS
 	s.hint.UrlsHint.Seeds = []rand.PRGKey{*seed}
 	s.hint.UrlsHint.Offsets = []uint64{s.hint.UrlsHint.Info.M}
 	s.hint.UrlsIndexMap = indexMap
+	s.hint.UrlsDict = c.GetUrlDict()
+	s.hint.UrlsRoot = database.DBRoot(db)
+	fmt.Printf("URL DB commitment: %x\n", s.hint.UrlsRoot)
 
 	fmt.Println("done")
 }
@@ -147,18 +241,18 @@ func launchServersFromLogs(logs string, corpusSetup func() *corpus.Corpus, serve
 	return server, corpus
 }
 
-func NewEmbeddingServers(clustersPerServer int, hintSz uint64, log, wantCorpus, serve bool, conf *config.Config) (*Server, string, *corpus.Corpus) {
+func NewEmbeddingServers(clustersPerServer int, log, wantCorpus, serve bool, conf *config.Config) (*Server, string, *corpus.Corpus) {
 	fmt.Println("Reading corpus...")
 	var servers *Server
 	var corpuses *corpus.Corpus
 	var addrs string
 
 	serverSetup := func(s *Server, c *corpus.Corpus) {
-		s.PreprocessEmbeddingsFromCorpus(c, hintSz, conf)
+		s.PreprocessEmbeddingsFromCorpus(c, conf)
 	}
 
 	corpusSetup := func() *corpus.Corpus {
-		return corpus.ReadEmbeddingsTxt(0, clustersPerServer, conf)
+		return corpus.ReadEmbeddings(0, clustersPerServer, conf)
 	}
 
 	if !log {
@@ -173,6 +267,7 @@ func NewEmbeddingServers(clustersPerServer int, hintSz uint64, log, wantCorpus,
 	}
 
 	if serve {
+		servers.SetupLimits(conf)
 		servers.preprocessEmbHint()
 		addrs = Serve(servers, utils.EmbServerPort)
 	}
@@ -180,17 +275,17 @@ func NewEmbeddingServers(clustersPerServer int, hintSz uint64, log, wantCorpus,
 	return servers, addrs, corpuses
 }
 
-func NewUrlServers(clustersPerServer int, hintSz uint64, log, wantCorpus, serve bool, conf *config.Config) (*Server, string, *corpus.Corpus) {
+func NewUrlServers(clustersPerServer int, log, wantCorpus, serve bool, conf *config.Config) (*Server, string, *corpus.Corpus) {
 	fmt.Println("Reading URL corpus...")
 	var servers *Server
 	var corpuses *corpus.Corpus
 	var addrs string
 
 	serverSetup := func(s *Server, c *corpus.Corpus) {
-		s.PreprocessUrlsFromCorpus(c, hintSz)
+		s.PreprocessUrlsFromCorpus(c, conf)
 	}
 	corpusSetup := func() *corpus.Corpus {
-		return corpus.ReadUrlsTxt(0, clustersPerServer, conf)
+		return corpus.ReadUrls(0, clustersPerServer, conf)
 	}
 
 	if !log {
@@ -205,6 +300,7 @@ func NewUrlServers(clustersPerServer int, hintSz uint64, log, wantCorpus, serve
 	}
 
 	if serve {
+		servers.SetupLimits(conf)
 		servers.preprocessUrlHint()
 		addrs = Serve(servers, utils.UrlServerPort)
 	}
@@ -214,9 +310,19 @@ func NewUrlServers(clustersPerServer int, hintSz uint64, log, wantCorpus, serve
 }
 
 func (s *Server) Serve(port int) {
-	rs := rpc.NewServer()
-	rs.Register(s)
-	utils.ListenAndServeTCP(rs, port)
+	s.tcp.Serve(utils.ListenTCP(port))
+}
+
+// Serves on a listener that is already bound, e.g. to an ephemeral port
+func (s *Server) ServeListener(l net.Listener) {
+	s.tcp.Serve(l)
+}
+
+// Stops taking calls, and waits for up to timeout for those in flight to
+// be answered. Returns whether they all were.
+func (s *Server) Shutdown(timeout time.Duration) bool {
+	s.draining.Store(true)
+	return s.tcp.Shutdown(timeout)
 }
 
 func Serve(servers *Server, port int) string {
@@ -0,0 +1,182 @@
+package tokens
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"search/utils"
+)
+
+// Bytes of a spent token in the file: its epoch, then its nonce
+const SPENT_RECORD_SIZE = 8 + NONCE_SIZE
+
+// The spent tokens that may still be redeemed, by epoch. Each one is also
+// appended to a file, if any, so that they outlast a restart. Epochs are
+// dropped once their tokens have expired, and the file is rewritten then.
+type SpentSet struct {
+	file string
+	now  func() time.Time
+
+	mu     sync.Mutex
+	epochs map[int64]map[string]bool
+	log    *os.File
+}
+
+// Reads the tokens of live epochs from file, if it exists. An empty file
+// name keeps the set in memory only.
+func NewSpentSet(file string) *SpentSet {
+	s := &SpentSet{file: file, now: time.Now, epochs: make(map[int64]map[string]bool)}
+	if file == "" {
+		return s
+	}
+
+	if utils.FileExists(file) {
+		f := utils.OpenFile(file)
+		record := make([]byte, SPENT_RECORD_SIZE)
+		for {
+			if _, err := io.ReadFull(f, record); err != nil {
+				// A record cut short by a crash is dropped
+				if err != io.EOF && err != io.ErrUnexpectedEOF {
+					fmt.Println(err)
+					panic("Error reading spent tokens")
+				}
+				break
+			}
+			epoch := int64(binary.BigEndian.Uint64(record))
+			s.add(epoch, record[8:])
+		}
+		f.Close()
+	}
+	s.prune()
+	if err := s.rewrite(); err != nil {
+		fmt.Println(err)
+		panic("Error writing spent tokens")
+	}
+	return s
+}
+
+func (s *SpentSet) add(epoch int64, nonce []byte) {
+	if s.epochs[epoch] == nil {
+		s.epochs[epoch] = make(map[string]bool)
+	}
+	s.epochs[epoch][string(nonce)] = true
+}
+
+// Drops the epochs whose tokens are no longer live. Returns whether it
+// dropped any.
+func (s *SpentSet) prune() bool {
+	now := EpochOf(s.now())
+	dropped := false
+	for epoch := range s.epochs {
+		if epoch < now-1 {
+			delete(s.epochs, epoch)
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+// Writes the file anew with the tokens in the set, and keeps it open to
+// append to. The tokens are written to a temporary file, synced, then
+// renamed over the old one, so that a crash leaves one file or the other
+// whole.
+func (s *SpentSet) rewrite() error {
+	if s.log != nil {
+		s.log.Close()
+		s.log = nil
+	}
+
+	dir := filepath.Dir(s.file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(s.file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // once renamed, there is nothing to remove
+
+	w := bufio.NewWriter(tmp)
+	for epoch, nonces := range s.epochs {
+		for nonce := range nonces {
+			w.Write(spentRecord(epoch, []byte(nonce)))
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.file)
+	}
+	if err != nil {
+		return fmt.Errorf("rewriting spent tokens: %w", err)
+	}
+
+	// The rename is durable once the directory is synced
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	s.log, err = os.OpenFile(s.file, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+func spentRecord(epoch int64, nonce []byte) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(epoch)), nonce...)
+}
+
+// Records t as spent. The caller checks that t is valid and live.
+func (s *SpentSet) Spend(t *Token) error {
+	if len(t.Nonce) != NONCE_SIZE {
+		return ErrBadSignature
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.prune() && s.file != "" {
+		if err := s.rewrite(); err != nil {
+			return err
+		}
+	}
+	if s.epochs[t.Epoch][string(t.Nonce)] {
+		return ErrSpent
+	}
+	if s.file != "" {
+		if _, err := s.log.Write(spentRecord(t.Epoch, t.Nonce)); err != nil {
+			return fmt.Errorf("recording spent token: %w", err)
+		}
+	}
+	s.add(t.Epoch, t.Nonce)
+	return nil
+}
+
+// Tokens in the set
+func (s *SpentSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, nonces := range s.epochs {
+		n += len(nonces)
+	}
+	return n
+}
+
+func (s *SpentSet) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log != nil {
+		s.log.Close()
+		s.log = nil
+	}
+}
@@ -0,0 +1,218 @@
+// Package tokens implements anonymous access tokens with RSA blind
+// signatures, as RSABSSA-SHA384-PSS-Deterministic of RFC 9474. A client gets
+// tokens signed by an issuer without the issuer seeing them, then redeems
+// each token once with a server, which checks the signature. The issuer can
+// meter how many tokens a client gets, but neither it nor the server can
+// link a redeemed token to its issuance.
+//
+// Tokens expire, so that the set of spent ones stays small: a token is
+// minted for the epoch it is issued in, which servers see, and redeemed in
+// that epoch or the next. All the tokens of an epoch look alike.
+package tokens
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"search/utils"
+
+	"github.com/cloudflare/circl/blindsign/blindrsa"
+)
+
+const (
+	KEY_BITS   = 2048
+	NONCE_SIZE = 32
+	EPOCH      = time.Hour
+)
+
+// Hash of the RFC 9474 variant used. Nonces are random, so the variant that
+// signs them as they are, without a random prefix, is enough.
+const HASH = crypto.SHA384
+
+var (
+	ErrBadSignature = errors.New("bad token signature")
+	ErrSpent        = errors.New("token already spent")
+	ErrExpired      = errors.New("token expired")
+)
+
+type Token struct {
+	Epoch int64
+	Nonce []byte
+	Sig   []byte
+}
+
+func EpochOf(t time.Time) int64 {
+	return t.Unix() / int64(EPOCH/time.Second)
+}
+
+// Whether the token may be redeemed in the given epoch. Tokens of the next
+// epoch are taken too, in case the client's clock is ahead.
+func (t *Token) Live(epoch int64) bool {
+	return t.Epoch >= epoch-1 && t.Epoch <= epoch+1
+}
+
+// What the issuer signs: the epoch, then the nonce
+func (t *Token) message() []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(t.Epoch)), t.Nonce...)
+}
+
+// Signs blinded tokens
+type Issuer struct {
+	key    *rsa.PrivateKey
+	signer blindrsa.Signer
+}
+
+func NewIssuer(key *rsa.PrivateKey) *Issuer {
+	return &Issuer{key: key, signer: blindrsa.NewSigner(key)}
+}
+
+func (i *Issuer) PublicKey() *rsa.PublicKey {
+	return &i.key.PublicKey
+}
+
+func (i *Issuer) Sign(blinded []byte) ([]byte, error) {
+	return i.signer.BlindSign(blinded)
+}
+
+// A token being issued, blinded so that the issuer cannot see it
+type Blinded struct {
+	token Token
+	state blindrsa.VerifierState
+	Msg   []byte // sent to the issuer
+}
+
+func Blind(pub *rsa.PublicKey, epoch int64) *Blinded {
+	b := &Blinded{token: Token{Epoch: epoch, Nonce: make([]byte, NONCE_SIZE)}}
+	if _, err := rand.Read(b.token.Nonce); err != nil {
+		panic(err)
+	}
+
+	// A verifier keeps the hash state of the message it blinds, so each
+	// token gets its own
+	msg, state, err := blindrsa.NewVerifier(pub, HASH).Blind(rand.Reader, b.token.message())
+	if err != nil {
+		fmt.Println(err)
+		panic("Error blinding token")
+	}
+	b.state = state
+	b.Msg = msg
+	return b
+}
+
+// Turns the issuer's signature of the blinded token into a token
+func (b *Blinded) Unblind(blindSig []byte) (*Token, error) {
+	sig, err := b.state.Finalize(blindSig)
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	t := b.token
+	t.Sig = sig
+	return &t, nil
+}
+
+func Valid(t *Token, pub *rsa.PublicKey) bool {
+	if len(t.Nonce) != NONCE_SIZE {
+		return false
+	}
+	return blindrsa.NewVerifier(pub, HASH).Verify(t.message(), t.Sig) == nil
+}
+
+// Where a Verifier records the tokens redeemed, so that each is redeemed
+// once. Spend returns ErrSpent for a token recorded already.
+type Ledger interface {
+	Spend(t *Token) error
+}
+
+// Checks tokens, and records them as spent in its ledger
+type Verifier struct {
+	pub   *rsa.PublicKey
+	spent Ledger
+	now   func() time.Time
+}
+
+func NewVerifier(pub *rsa.PublicKey, spent Ledger) *Verifier {
+	return &Verifier{pub: pub, spent: spent, now: time.Now}
+}
+
+func (v *Verifier) Redeem(t *Token) error {
+	if !Valid(t, v.pub) {
+		return ErrBadSignature
+	}
+	if !t.Live(EpochOf(v.now())) {
+		return ErrExpired
+	}
+	return v.spent.Spend(t)
+}
+
+func MarshalPublicKey(pub *rsa.PublicKey) []byte {
+	return x509.MarshalPKCS1PublicKey(pub)
+}
+
+func ParsePublicKey(der []byte) *rsa.PublicKey {
+	pub, err := x509.ParsePKCS1PublicKey(der)
+	if err != nil {
+		fmt.Println(err)
+		panic("Bad token public key")
+	}
+	return pub
+}
+
+// Reads the issuer key from a PEM file. If there is none, creates one, and
+// writes its public half to pubFile for servers to check tokens against.
+func ReadOrCreateKey(file, pubFile string) *rsa.PrivateKey {
+	if utils.FileExists(file) {
+		key, err := x509.ParsePKCS1PrivateKey(readPem(file).Bytes)
+		if err != nil {
+			fmt.Println(err)
+			panic("Bad token issuer key")
+		}
+		return key
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, KEY_BITS)
+	if err != nil {
+		panic(err)
+	}
+	writePem(file, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	writePem(pubFile, "RSA PUBLIC KEY", MarshalPublicKey(&key.PublicKey))
+	fmt.Printf("Wrote new token issuer key to %s\n", file)
+	return key
+}
+
+func ReadPublicKey(pubFile string) *rsa.PublicKey {
+	if !utils.FileExists(pubFile) {
+		fmt.Printf("No token issuer key at %s\n", pubFile)
+		panic("Start the token issuer first")
+	}
+	return ParsePublicKey(readPem(pubFile).Bytes)
+}
+
+func writePem(file, kind string, der []byte) {
+	f := utils.CreateFile(file)
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: kind, Bytes: der}); err != nil {
+		fmt.Println(err)
+		panic("Error writing file")
+	}
+}
+
+func readPem(file string) *pem.Block {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Println(err)
+		panic("Error reading file")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		panic("No PEM block in " + file)
+	}
+	return block
+}
@@ -0,0 +1,132 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func issue(t *testing.T, issuer *Issuer) *Token {
+	return issueAt(t, issuer, EpochOf(time.Now()))
+}
+
+func issueAt(t *testing.T, issuer *Issuer, epoch int64) *Token {
+	b := Blind(issuer.PublicKey(), epoch)
+	sig, err := issuer.Sign(b.Msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := b.Unblind(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestTokens(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, KEY_BITS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := NewIssuer(key)
+	v := NewVerifier(issuer.PublicKey(), NewSpentSet(""))
+
+	tok := issue(t, issuer)
+	if err := v.Redeem(tok); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Redeem(tok); err != ErrSpent {
+		t.Fatalf("token redeemed twice: %v", err)
+	}
+
+	forged := issue(t, issuer)
+	forged.Nonce[0] ^= 1
+	if err := v.Redeem(forged); err != ErrBadSignature {
+		t.Fatalf("forged token: %v", err)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, KEY_BITS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Redeem(issue(t, NewIssuer(other))); err != ErrBadSignature {
+		t.Fatalf("token of another issuer: %v", err)
+	}
+
+	// The epoch is signed along with the nonce
+	forged = issue(t, issuer)
+	forged.Epoch += 1
+	if err := v.Redeem(forged); err != ErrBadSignature {
+		t.Fatalf("token with a forged epoch: %v", err)
+	}
+
+	// The issuer signed a blinded value, unrelated to the token
+	b := Blind(issuer.PublicKey(), EpochOf(time.Now()))
+	if _, err := b.Unblind(b.Msg); err != ErrBadSignature {
+		t.Fatalf("unsigned token: %v", err)
+	}
+}
+
+// Tokens expire after the next epoch, and spent ones are kept on file until
+// then
+func TestSpentEpochs(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, KEY_BITS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := NewIssuer(key)
+	file := filepath.Join(t.TempDir(), "spent.bin")
+	now := time.Now()
+	epoch := EpochOf(now)
+
+	spent := NewSpentSet(file)
+	v := NewVerifier(issuer.PublicKey(), spent)
+	tok := issueAt(t, issuer, epoch-1)
+	if err := v.Redeem(tok); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Redeem(issueAt(t, issuer, epoch-2)); err != ErrExpired {
+		t.Fatalf("expired token: %v", err)
+	}
+	if err := v.Redeem(issueAt(t, issuer, epoch+2)); err != ErrExpired {
+		t.Fatalf("token of a later epoch: %v", err)
+	}
+	spent.Close()
+
+	// A restart keeps the spent tokens
+	spent = NewSpentSet(file)
+	v = NewVerifier(issuer.PublicKey(), spent)
+	if err := v.Redeem(tok); err != ErrSpent {
+		t.Fatalf("token redeemed again after a restart: %v", err)
+	}
+
+	// Once an epoch is over, the tokens of the one before are dropped
+	later := func() time.Time { return now.Add(EPOCH) }
+	spent.now = later
+	v.now = later
+	if err := v.Redeem(issueAt(t, issuer, epoch+1)); err != nil {
+		t.Fatal(err)
+	}
+	if spent.Len() != 1 {
+		t.Fatalf("%d tokens kept, want 1", spent.Len())
+	}
+	spent.Close()
+
+	spent = NewSpentSet(file)
+	spent.now = later
+	if spent.Len() != 1 {
+		t.Fatalf("%d tokens kept on file, want 1", spent.Len())
+	}
+
+	// Rewrites replace the file whole, leaving no temporary file behind
+	entries, err := os.ReadDir(filepath.Dir(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(file) {
+		t.Fatalf("files left: %v", entries)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
 func OpenFile(file string) *os.File {
@@ -24,6 +25,21 @@ func OpenAppendFile(file string) *os.File {
 	return f
 }
 
+// Creates (or truncates) the file, along with its parent directories
+func CreateFile(file string) *os.File {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		fmt.Println(err)
+		panic("Error creating directory")
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		fmt.Println(err)
+		panic("Error creating file")
+	}
+	return f
+}
+
 func FileExists(file string) bool {
 	if _, err := os.Stat(file); err != nil {
 		return false
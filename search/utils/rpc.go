@@ -1,15 +1,32 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/rpc"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	EmbServerPort = 1240
-	UrlServerPort = 1450
+	EmbServerPort   = 1240
+	UrlServerPort   = 1450
+	TokenIssuerPort = 1560
+	EmbAdminPort    = 1670
+	UrlAdminPort    = 1680
+)
+
+// Returned by servers that are too busy to take a call for now
+var ErrRateLimited = errors.New("rate limited")
+
+// Times a rate-limited call is retried, waiting twice as long each time
+const (
+	RATE_LIMIT_RETRIES = 5
+	RATE_LIMIT_BACKOFF = 200 * time.Millisecond
 )
 
 func LocalAddr(port int) string {
@@ -37,53 +54,260 @@ func localIP() net.IP {
 	panic("Own IP not found")
 }
 
+func Seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
 /*
- * callTLS and callTCP send an RPC to the server; then wait for the response.
+ * DialTCP and Conn.Call send an RPC to the server; then wait for the
+ * response, until ctx is done.
  */
 
-func DialTCP(addr string) *rpc.Client {
-	c, err := rpc.Dial("tcp", addr)
+// A connection to an RPC server. A call fails if the server sends nothing
+// for the read timeout while it is pending.
+type Conn struct {
+	client *rpc.Client
+	conn   *idleConn
+}
 
+// Dials addr, for at most dialTimeout. A zero timeout means none, and a
+// zero keepAlive the default period of keep-alive probes.
+func DialTCP(ctx context.Context, addr string, dialTimeout, readTimeout, keepAlive time.Duration) (*Conn, error) {
+	d := net.Dialer{Timeout: dialTimeout, KeepAlive: keepAlive}
+	conn, err := d.DialContext(ctx, "tcp", addr)
 	if err != nil {
-		fmt.Printf("Tried to dial %s\n", addr)
-		fmt.Printf("DialHTTP error: %s\n", err)
-		panic("Dialing error")
+		return nil, fmt.Errorf("dialing %s: %w", addr, err)
 	}
 
-	return c
+	c := &idleConn{Conn: conn, timeout: readTimeout}
+	return &Conn{client: rpc.NewClient(c), conn: c}, nil
 }
 
-func CallTCP(c *rpc.Client, rpcname string, args interface{}, reply interface{}) {
-	err := c.Call(rpcname, args, reply)
-	if err == nil {
-		return
+func (c *Conn) Close() error {
+	return c.client.Close()
+}
+
+// Whether the connection is known to be of no more use, e.g. as the server
+// closed it or a call on it was cancelled. Keep-alive probes that go
+// unanswered break it too.
+func (c *Conn) Broken() bool {
+	return c.conn.broken.Load()
+}
+
+// Calls rpcname, retrying with backoff while the server is rate limiting.
+// If ctx is done first, the connection is closed, which makes the server
+// drop the call, and ctx.Err() is returned; the connection is of no more
+// use then.
+func (c *Conn) Call(ctx context.Context, rpcname string, args interface{}, reply interface{}) error {
+	backoff := RATE_LIMIT_BACKOFF
+	for attempt := 0; ; attempt++ {
+		err := c.call(ctx, rpcname, args, reply)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		// Errors come back from the server as plain strings
+		if err.Error() != ErrRateLimited.Error() || attempt == RATE_LIMIT_RETRIES {
+			return fmt.Errorf("%s: %w", rpcname, err)
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Conn) call(ctx context.Context, rpcname string, args interface{}, reply interface{}) error {
+	// Closing the connection unblocks the call, even while it is sending
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-stop:
+		}
+	}()
+
+	c.conn.begin()
+	defer c.conn.end()
+	call := <-c.client.Go(rpcname, args, reply, make(chan *rpc.Call, 1)).Done
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return call.Error
+}
+
+// Times out reads while a call is pending and the server sends nothing.
+// An idle connection waits for the next call for as long as it takes.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+
+	broken  atomic.Bool
+	mu      sync.Mutex
+	pending int
+}
+
+// The RPC client reads the connection all the time, so a read fails as
+// soon as it breaks
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.broken.Store(true)
+	}
+	if n > 0 {
+		c.mu.Lock()
+		c.extend()
+		c.mu.Unlock()
 	}
+	return n, err
+}
 
-	fmt.Printf("Err: %s\n", err)
-	panic("Call failed")
+func (c *idleConn) extend() {
+	if c.pending > 0 && c.timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+func (c *idleConn) begin() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending += 1
+	c.extend()
+}
+
+func (c *idleConn) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending -= 1
+	if c.pending == 0 {
+		c.SetReadDeadline(time.Time{})
+	}
 }
 
 /*
  * serveTLS and serveTCP implement the server-side networking logic.
  */
-func ListenAndServeTCP(server *rpc.Server, port int) {
+func ListenTCP(port int) net.Listener {
 	addr := LocalAddr(port)
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		fmt.Printf("Listener error: %v\n", err)
 		panic("Listener error")
 	}
-	defer l.Close()
 
 	fmt.Printf("TCP server listening on %s\n", addr)
+	return l
+}
+
+// Serves each connection accepted on l, until l is closed
+func ServeTCP(l net.Listener, serve func(net.Conn)) {
+	NewTCPServer(serve).Serve(l)
+}
+
+// Serves the connections accepted on its listeners, until it shuts down
+type TCPServer struct {
+	serve func(net.Conn)
+
+	mu        sync.Mutex
+	closing   bool
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	served    sync.WaitGroup // one per connection being served
+}
+
+// serve must return once the connection is closed for reading, when it
+// is done with what it read
+func NewTCPServer(serve func(net.Conn)) *TCPServer {
+	return &TCPServer{serve: serve, listeners: make(map[net.Listener]bool), conns: make(map[net.Conn]bool)}
+}
+
+// Serves each connection accepted on l, until l is closed or the server
+// shuts down
+func (t *TCPServer) Serve(l net.Listener) {
+	t.mu.Lock()
+	if t.closing {
+		t.mu.Unlock()
+		l.Close()
+		return
+	}
+	t.listeners[l] = true
+	t.mu.Unlock()
+
 	for {
 		conn, err := l.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			fmt.Printf("Listener error: %v\n", err)
 			continue
 		}
 
-		defer conn.Close()
-		go server.ServeConn(conn)
+		t.mu.Lock()
+		if t.closing {
+			t.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		t.conns[conn] = true
+		t.served.Add(1)
+		t.mu.Unlock()
+
+		go func() {
+			defer t.served.Done()
+			t.serve(conn)
+			conn.Close()
+
+			t.mu.Lock()
+			delete(t.conns, conn)
+			t.mu.Unlock()
+		}()
+	}
+}
+
+// Stops accepting connections and closes those served for reading, so
+// that they take no more calls but finish those in flight. Waits for them
+// to, for up to timeout, then closes the connections. Returns whether they
+// all finished in time.
+func (t *TCPServer) Shutdown(timeout time.Duration) bool {
+	t.mu.Lock()
+	t.closing = true
+	for l := range t.listeners {
+		l.Close()
+	}
+	for conn := range t.conns {
+		if tcp, ok := conn.(interface{ CloseRead() error }); ok {
+			tcp.CloseRead()
+		} else {
+			conn.Close()
+		}
+	}
+	t.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		t.served.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		conn.Close()
 	}
+	return false
 }